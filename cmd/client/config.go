@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"example.com/service-registry-lb/common"
+	"example.com/service-registry-lb/internal/rpcctx"
+)
+
+var configOps = []string{"get", "put", "delete", "list", "watch"}
+
+func validConfigOp(op string) bool {
+	for _, o := range configOps {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// runConfig executes one operation on the registry config store (-service config).
+// cas makes put/delete conditional on -expect.
+func runConfig(reg *rpcctx.Client, op, key, value, prefix string, cas bool, expect int64) error {
+	switch op {
+	case "get":
+		var rep common.ConfigGetReply
+		if err := reg.Call("Registry.ConfigGet", &common.ConfigGetArgs{Key: key}, &rep); err != nil {
+			return fmt.Errorf("config get: %w", err)
+		}
+		if !rep.Found {
+			fmt.Printf("%s: not found\n", key)
+			return nil
+		}
+		printConfigEntry(rep.Entry)
+
+	case "put":
+		var rep common.ConfigPutReply
+		if err := reg.Call("Registry.ConfigPut", &common.ConfigPutArgs{Key: key, Value: value, CAS: cas, ExpectedVersion: expect}, &rep); err != nil {
+			return fmt.Errorf("config put: %w", err)
+		}
+		if !rep.OK {
+			return fmt.Errorf("config put %s: version is %d, expected %d", key, rep.Entry.Version, expect)
+		}
+		printConfigEntry(rep.Entry)
+
+	case "delete":
+		var rep common.ConfigDeleteReply
+		if err := reg.Call("Registry.ConfigDelete", &common.ConfigDeleteArgs{Key: key, CAS: cas, ExpectedVersion: expect}, &rep); err != nil {
+			return fmt.Errorf("config delete: %w", err)
+		}
+		if !rep.OK {
+			return fmt.Errorf("config delete %s: version is %d, expected %d", key, rep.Entry.Version, expect)
+		}
+		fmt.Printf("%s: deleted=%v\n", key, rep.Deleted)
+
+	case "list":
+		var rep common.ConfigListReply
+		if err := reg.Call("Registry.ConfigList", &common.ConfigListArgs{Prefix: prefix}, &rep); err != nil {
+			return fmt.Errorf("config list: %w", err)
+		}
+		fmt.Printf("%d entries under %q (rev %d)\n", len(rep.Entries), prefix, rep.Revision)
+		for _, e := range rep.Entries {
+			printConfigEntry(e)
+		}
+
+	case "watch":
+		var rev int64
+		var lrep common.ConfigListReply
+		if err := reg.Call("Registry.ConfigList", &common.ConfigListArgs{Prefix: prefix}, &lrep); err != nil {
+			return fmt.Errorf("config list: %w", err)
+		}
+		rev = lrep.Revision
+		fmt.Printf("watching %q from rev %d (Ctrl-C to stop)\n", prefix, rev)
+		for {
+			var rep common.ConfigWatchReply
+			if err := reg.Call("Registry.ConfigWatch", &common.ConfigWatchArgs{Prefix: prefix, AfterRevision: rev, Timeout: watchPoll}, &rep); err != nil {
+				return fmt.Errorf("config watch: %w", err)
+			}
+			rev = rep.Revision
+			if !rep.Changed {
+				continue
+			}
+			fmt.Printf("--- rev %d @ %s: %d entries\n", rep.Revision, time.Now().Format("15:04:05"), len(rep.Entries))
+			for _, e := range rep.Entries {
+				printConfigEntry(e)
+			}
+		}
+
+	default:
+		return fmt.Errorf("invalid config -op %q (use %s)", op, strings.Join(configOps, "|"))
+	}
+	return nil
+}
+
+func printConfigEntry(e common.ConfigEntry) {
+	fmt.Printf(" - %s = %q (version=%d rev=%d)\n", e.Key, e.Value, e.Version, e.Revision)
+}
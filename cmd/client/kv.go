@@ -0,0 +1,329 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/service-registry-lb/common"
+	"example.com/service-registry-lb/internal/connpool"
+)
+
+var kvOps = []string{"get", "put", "delete", "cas", "putifabsent", "scan", "list", "txn", "watch", "rw", "shardmap", "move-shard"}
+
+type kvOptions struct {
+	op     string
+	key    string
+	value  string
+	expect int64         // versione attesa per op=cas
+	ttl    time.Duration // scadenza per op=put|cas|putifabsent (0 = nessuna)
+
+	// op=get
+	consistency string
+	maxLag      int64
+
+	// op=scan|list
+	start  string
+	end    string
+	prefix string
+	limit  int
+
+	// op=txn
+	txnOps   []common.TxnOp
+	compares []common.TxnCompare
+
+	// op=watch: cursore per gruppo aggiornato ad ogni long-poll (il seq è unico
+	// fra le repliche di un gruppo); startSeq è il valore iniziale (-from-seq)
+	startSeq int64
+	fromSeq  map[string]int64
+
+	// token di sessione per gruppo: epoch e seq dell'ultima scrittura confermata,
+	// inviati come GetArgs.MinEpoch/MinSeq
+	session map[string]sessionToken
+
+	group string // -group: limita scan/list/watch per prefisso ad un solo gruppo
+}
+
+// sessionToken orders the writes of a session: seqs restart their meaning at
+// every primary epoch, so a seq is only compared with seqs of the same epoch.
+type sessionToken struct {
+	epoch, seq int64
+}
+
+// observe advances the session token of group with a reply's epoch and seq.
+func (o *kvOptions) observe(group string, epoch, seq int64) {
+	t := o.session[group]
+	switch {
+	case epoch > t.epoch:
+		o.session[group] = sessionToken{epoch: epoch, seq: seq}
+	case epoch == t.epoch && seq > t.seq:
+		o.session[group] = sessionToken{epoch: epoch, seq: seq}
+	}
+}
+
+const watchPoll = 10 * time.Second
+
+// parseTxn parses -txn "put k v;delete k2" and -if "k=3;k2=0".
+func parseTxn(ops, ifs string) ([]common.TxnOp, []common.TxnCompare, error) {
+	var out []common.TxnOp
+	for _, part := range strings.Split(ops, ";") {
+		f := strings.Fields(part)
+		switch {
+		case len(f) == 0:
+			continue
+		case f[0] == common.KVOpPut && len(f) == 3:
+			out = append(out, common.TxnOp{Op: common.KVOpPut, Key: f[1], Value: f[2]})
+		case f[0] == common.KVOpDelete && len(f) == 2:
+			out = append(out, common.TxnOp{Op: common.KVOpDelete, Key: f[1]})
+		default:
+			return nil, nil, fmt.Errorf("bad txn op %q (use 'put <key> <value>' or 'delete <key>')", strings.TrimSpace(part))
+		}
+	}
+	var cmps []common.TxnCompare
+	for _, part := range strings.Split(ifs, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(part, "=")
+		ver, err := strconv.ParseInt(v, 10, 64)
+		if !ok || k == "" || err != nil {
+			return nil, nil, fmt.Errorf("bad txn compare %q (use '<key>=<version>')", part)
+		}
+		cmps = append(cmps, common.TxnCompare{Key: k, Version: ver})
+	}
+	return out, cmps, nil
+}
+
+func validKVOp(op string) bool {
+	for _, o := range kvOps {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// runKV executes request #i of a kv session on inst, a member of replica group.
+// Writes that land on a backup are retried once on the primary it redirects to.
+func runKV(i int, inst common.Instance, c connpool.Caller, group string, o *kvOptions) error {
+	switch o.op {
+	case "get":
+		token := o.session[group]
+		args := &common.GetArgs{Key: o.key, Consistency: o.consistency, MaxLag: o.maxLag, MinSeq: token.seq, MinEpoch: token.epoch}
+		var rep common.GetReply
+		if err := c.Call("KV.Get", args, &rep); err != nil {
+			return fmt.Errorf("KV.Get rpc call: %w", err)
+		}
+		via := ""
+		// la replica non garantisce la consistenza richiesta: leggo dal primary
+		if rep.RedirectTo != "" {
+			primary := rep.RedirectTo
+			rep = common.GetReply{}
+			if err := callPrimary(primary, "KV.Get", args, &rep); err != nil {
+				return err
+			}
+			via = fmt.Sprintf(" (lagging) -> primary=%s", primary)
+		}
+		o.observe(group, rep.Epoch, rep.Seq)
+		if rep.Found {
+			fmt.Printf("[%02d] GET key=%q picked=%s%s => value=%q version=%d seq=%d epoch=%d from=%s\n", i, o.key, inst.ID, via, rep.Value, rep.Version, rep.Seq, rep.Epoch, rep.From)
+		} else {
+			fmt.Printf("[%02d] GET key=%q picked=%s%s => NOT FOUND seq=%d epoch=%d from=%s\n", i, o.key, inst.ID, via, rep.Seq, rep.Epoch, rep.From)
+		}
+
+	case "put":
+		putVal := fmt.Sprintf("%s#%d", o.value, i)
+		args := &common.PutArgs{Key: o.key, Value: putVal, TTL: o.ttl}
+
+		// Provo sul server scelto dal LB
+		var rep common.PutReply
+		if err := c.Call("KV.Put", args, &rep); err != nil {
+			return fmt.Errorf("KV.Put rpc call: %w", err)
+		}
+		via := ""
+		// Se ho colpito un backup: mi dice dove sta il primary -> ritento lì
+		if !rep.OK && rep.RedirectTo != "" {
+			primary := rep.RedirectTo
+			rep = common.PutReply{}
+			if err := callPrimary(primary, "KV.Put", args, &rep); err != nil {
+				return err
+			}
+			via = fmt.Sprintf(" (backup) -> primary=%s", primary)
+		}
+		if !rep.OK {
+			return fmt.Errorf("KV.Put failed (ok=false), from=%s", rep.From)
+		}
+		o.observe(group, rep.Epoch, rep.Seq)
+		fmt.Printf("[%02d] PUT key=%q value=%q picked=%s%s ok version=%d seq=%d from=%s epoch=%d\n",
+			i, o.key, putVal, inst.ID, via, rep.Version, rep.Seq, rep.From, rep.Epoch)
+
+	case "delete":
+		args := &common.DeleteArgs{Key: o.key}
+		var rep common.DeleteReply
+		if err := c.Call("KV.Delete", args, &rep); err != nil {
+			return fmt.Errorf("KV.Delete rpc call: %w", err)
+		}
+		via := ""
+		if !rep.OK && rep.RedirectTo != "" {
+			primary := rep.RedirectTo
+			rep = common.DeleteReply{}
+			if err := callPrimary(primary, "KV.Delete", args, &rep); err != nil {
+				return err
+			}
+			via = fmt.Sprintf(" (backup) -> primary=%s", primary)
+		}
+		if !rep.OK {
+			return fmt.Errorf("KV.Delete failed (ok=false), from=%s", rep.From)
+		}
+		o.observe(group, rep.Epoch, rep.Seq)
+		fmt.Printf("[%02d] DELETE key=%q picked=%s%s deleted=%t from=%s\n", i, o.key, inst.ID, via, rep.Deleted, rep.From)
+
+	case "cas":
+		casVal := fmt.Sprintf("%s#%d", o.value, i)
+		args := &common.CASArgs{Key: o.key, ExpectedVersion: o.expect, Value: casVal, TTL: o.ttl}
+		var rep common.CASReply
+		if err := c.Call("KV.CompareAndSwap", args, &rep); err != nil {
+			return fmt.Errorf("KV.CompareAndSwap rpc call: %w", err)
+		}
+		via := ""
+		if !rep.OK && rep.RedirectTo != "" {
+			primary := rep.RedirectTo
+			rep = common.CASReply{}
+			if err := callPrimary(primary, "KV.CompareAndSwap", args, &rep); err != nil {
+				return err
+			}
+			via = fmt.Sprintf(" (backup) -> primary=%s", primary)
+		}
+		if !rep.OK {
+			return fmt.Errorf("KV.CompareAndSwap failed (ok=false), from=%s", rep.From)
+		}
+		o.observe(group, rep.Epoch, rep.Seq)
+		fmt.Printf("[%02d] CAS key=%q expect=%d value=%q picked=%s%s swapped=%t version=%d from=%s\n",
+			i, o.key, o.expect, casVal, inst.ID, via, rep.Swapped, rep.Version, rep.From)
+
+	case "putifabsent":
+		args := &common.PutArgs{Key: o.key, Value: o.value, TTL: o.ttl}
+		var rep common.PutIfAbsentReply
+		if err := c.Call("KV.PutIfAbsent", args, &rep); err != nil {
+			return fmt.Errorf("KV.PutIfAbsent rpc call: %w", err)
+		}
+		via := ""
+		if !rep.OK && rep.RedirectTo != "" {
+			primary := rep.RedirectTo
+			rep = common.PutIfAbsentReply{}
+			if err := callPrimary(primary, "KV.PutIfAbsent", args, &rep); err != nil {
+				return err
+			}
+			via = fmt.Sprintf(" (backup) -> primary=%s", primary)
+		}
+		if !rep.OK {
+			return fmt.Errorf("KV.PutIfAbsent failed (ok=false), from=%s", rep.From)
+		}
+		o.observe(group, rep.Epoch, rep.Seq)
+		fmt.Printf("[%02d] PUTIFABSENT key=%q picked=%s%s stored=%t value=%q version=%d from=%s\n",
+			i, o.key, inst.ID, via, rep.Stored, rep.Value, rep.Version, rep.From)
+
+	case "rw":
+		// scrivo e rileggo subito sulla stessa istanza: grazie al token di sessione
+		// la lettura vede la propria scrittura anche quando colpisce un backup
+		for _, op := range []string{"put", "get"} {
+			step := *o
+			step.op = op
+			if err := runKV(i, inst, c, group, &step); err != nil {
+				return err
+			}
+		}
+
+	case "scan":
+		// tutte le pagine sulla stessa istanza
+		args := &common.ScanArgs{StartKey: o.start, EndKey: o.end, Limit: o.limit}
+		for page := 1; ; page++ {
+			var rep common.ScanReply
+			if err := c.Call("KV.Scan", args, &rep); err != nil {
+				return fmt.Errorf("KV.Scan rpc call: %w", err)
+			}
+			fmt.Printf("[%02d] SCAN [%q,%q) picked=%s page=%d items=%d from=%s\n", i, o.start, o.end, inst.ID, page, len(rep.Items), rep.From)
+			for _, it := range rep.Items {
+				fmt.Printf("       %q = %q (version=%d)\n", it.Key, it.Value, it.Version)
+			}
+			if rep.NextCursor == "" {
+				break
+			}
+			args.Cursor = rep.NextCursor
+		}
+
+	case "txn":
+		args := &common.TxnArgs{Compares: o.compares, Ops: o.txnOps}
+		var rep common.TxnReply
+		if err := c.Call("KV.Txn", args, &rep); err != nil {
+			return fmt.Errorf("KV.Txn rpc call: %w", err)
+		}
+		via := ""
+		if !rep.OK && rep.RedirectTo != "" {
+			primary := rep.RedirectTo
+			rep = common.TxnReply{}
+			if err := callPrimary(primary, "KV.Txn", args, &rep); err != nil {
+				return err
+			}
+			via = fmt.Sprintf(" (backup) -> primary=%s", primary)
+		}
+		if !rep.OK {
+			return fmt.Errorf("KV.Txn failed (ok=false), from=%s", rep.From)
+		}
+		o.observe(group, rep.Epoch, rep.Seq)
+		if rep.Succeeded {
+			fmt.Printf("[%02d] TXN ops=%d picked=%s%s committed versions=%v from=%s\n", i, len(o.txnOps), inst.ID, via, rep.Versions, rep.From)
+		} else {
+			fmt.Printf("[%02d] TXN ops=%d picked=%s%s aborted conflicts=%+v from=%s\n", i, len(o.txnOps), inst.ID, via, rep.Conflicts, rep.From)
+		}
+
+	case "watch":
+		// -prefix vince su -key
+		from, ok := o.fromSeq[group]
+		if !ok {
+			from = o.startSeq
+		}
+		args := &common.WatchArgs{Key: o.key, FromSeq: from, Timeout: watchPoll}
+		if o.prefix != "" {
+			args.Key, args.Prefix = o.prefix, true
+		}
+		var rep common.WatchReply
+		if err := c.Call("KV.Watch", args, &rep); err != nil {
+			return fmt.Errorf("KV.Watch rpc call: %w", err)
+		}
+		if rep.Compacted {
+			fmt.Printf("[%02d] WATCH picked=%s => history compacted after seq=%d, resuming from seq=%d from=%s\n", i, inst.ID, from, rep.LastSeq, rep.From)
+		} else if len(rep.Events) == 0 {
+			fmt.Printf("[%02d] WATCH picked=%s => no changes up to seq=%d from=%s\n", i, inst.ID, rep.LastSeq, rep.From)
+		}
+		for _, e := range rep.Events {
+			fmt.Printf("[%02d] WATCH picked=%s => seq=%d %s key=%q value=%q version=%d from=%s\n", i, inst.ID, e.Seq, strings.ToUpper(e.Op), e.Key, e.Value, e.Version, rep.From)
+		}
+		o.fromSeq[group] = rep.LastSeq
+
+	case "list":
+		args := &common.ListArgs{Prefix: o.prefix, Limit: o.limit}
+		for page := 1; ; page++ {
+			var rep common.ListReply
+			if err := c.Call("KV.List", args, &rep); err != nil {
+				return fmt.Errorf("KV.List rpc call: %w", err)
+			}
+			fmt.Printf("[%02d] LIST prefix=%q picked=%s page=%d keys=%q from=%s\n", i, o.prefix, inst.ID, page, rep.Keys, rep.From)
+			if rep.NextCursor == "" {
+				break
+			}
+			args.Cursor = rep.NextCursor
+		}
+	}
+	return nil
+}
+
+// callPrimary re-issues a request on the primary a backup redirected us to.
+func callPrimary(addr, method string, args, reply any) error {
+	if err := conns.Call(addr, method, args, reply); err != nil {
+		return fmt.Errorf("%s on primary rpc call: %w", method, err)
+	}
+	return nil
+}
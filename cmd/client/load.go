@@ -0,0 +1,422 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"example.com/service-registry-lb/common"
+	"example.com/service-registry-lb/internal/histogram"
+	"example.com/service-registry-lb/internal/lb"
+)
+
+var loadReports = []string{"text", "json", "csv"}
+
+type loadOptions struct {
+	concurrency int
+	qps         float64 // 0 = closed loop: ogni worker invia appena riceve la risposta
+	duration    time.Duration
+	warmup      time.Duration // richieste eseguite ma escluse dal report
+	report      string        // text|json|csv
+	out         string        // file del report ("" = stdout)
+}
+
+func validLoadReport(r string) bool {
+	for _, x := range loadReports {
+		if r == x {
+			return true
+		}
+	}
+	return false
+}
+
+// loadTarget is what the load generator drives: next chooses the instance
+// (applying staged refreshes), do sends request seq to it.
+type loadTarget struct {
+	mu    sync.Mutex
+	rf    *refresher
+	apply func([]common.Instance)
+	pick  func() (common.Instance, error)
+	do    func(inst common.Instance, seq int64) error
+}
+
+// next is called by every worker: pickers are not safe for concurrent use.
+func (t *loadTarget) next() (common.Instance, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if insts, ok := t.rf.take(); ok {
+		t.apply(insts)
+	}
+	return t.pick()
+}
+
+// serviceLoadTarget sends Echo.Echo or Math.Add to the instances chosen by picker.
+func serviceLoadTarget(service string, picker lb.Picker, rf *refresher) (*loadTarget, error) {
+	t := &loadTarget{rf: rf, apply: picker.Update, pick: picker.Pick}
+	switch service {
+	case "echo":
+		t.do = func(inst common.Instance, seq int64) error {
+			var rep common.EchoReply
+			return conns.Call(inst.Addr, "Echo.Echo", &common.EchoArgs{Msg: fmt.Sprintf("load #%d", seq)}, &rep)
+		}
+	case "math":
+		t.do = func(inst common.Instance, seq int64) error {
+			var rep common.AddReply
+			return conns.Call(inst.Addr, "Math.Add", &common.AddArgs{A: int(seq), B: int(seq)}, &rep)
+		}
+	default:
+		return nil, fmt.Errorf("load mode does not support service %q", service)
+	}
+	return t, nil
+}
+
+// kvLoadTarget sends KV.Get or KV.Put on -key to the group that owns it,
+// following the redirect to the primary like a normal session does.
+func kvLoadTarget(r *kvRouter, rf *refresher, o *kvOptions) (*loadTarget, error) {
+	t := &loadTarget{rf: rf, apply: r.setInstances, pick: func() (common.Instance, error) { return r.pick(r.groupOf(o.key)) }}
+	switch o.op {
+	case "get":
+		t.do = func(inst common.Instance, _ int64) error {
+			args := &common.GetArgs{Key: o.key, Consistency: o.consistency, MaxLag: o.maxLag}
+			var rep common.GetReply
+			if err := conns.Call(inst.Addr, "KV.Get", args, &rep); err != nil {
+				return err
+			}
+			if rep.RedirectTo != "" {
+				return conns.Call(rep.RedirectTo, "KV.Get", args, &common.GetReply{})
+			}
+			return nil
+		}
+	case "put":
+		t.do = func(inst common.Instance, seq int64) error {
+			args := &common.PutArgs{Key: o.key, Value: fmt.Sprintf("%s#%d", o.value, seq), TTL: o.ttl}
+			var rep common.PutReply
+			if err := conns.Call(inst.Addr, "KV.Put", args, &rep); err != nil {
+				return err
+			}
+			if !rep.OK && rep.RedirectTo != "" {
+				primary := rep.RedirectTo
+				rep = common.PutReply{}
+				if err := conns.Call(primary, "KV.Put", args, &rep); err != nil {
+					return err
+				}
+			}
+			if !rep.OK {
+				return fmt.Errorf("KV.Put failed (ok=false)")
+			}
+			return nil
+		}
+	default:
+		return nil, fmt.Errorf("load mode supports kv op get|put, not %q", o.op)
+	}
+	return t, nil
+}
+
+// loadResult is what one worker measured; results are merged at the end.
+type loadResult struct {
+	latency   *histogram.Histogram // solo richieste riuscite
+	requests  int64
+	errors    map[string]int64 // messaggio -> occorrenze
+	instances map[string]int64 // instance id scelto dal picker -> richieste
+}
+
+func newLoadResult() *loadResult {
+	return &loadResult{latency: histogram.New(), errors: map[string]int64{}, instances: map[string]int64{}}
+}
+
+func (r *loadResult) merge(o *loadResult) {
+	r.latency.Merge(o.latency)
+	r.requests += o.requests
+	for k, v := range o.errors {
+		r.errors[k] += v
+	}
+	for k, v := range o.instances {
+		r.instances[k] += v
+	}
+}
+
+func (r *loadResult) errorCount() int64 {
+	var n int64
+	for _, v := range r.errors {
+		n += v
+	}
+	return n
+}
+
+// errorKey groups errors in the breakdown; long messages are cut.
+func errorKey(err error) string {
+	s := err.Error()
+	if len(s) > 80 {
+		s = s[:77] + "..."
+	}
+	return s
+}
+
+// runLoad drives t for warmup+duration. Closed loop: concurrency workers each
+// send the next request as soon as the previous one returns. Open loop (qps>0):
+// requests are scheduled at a fixed rate and their latency counts from the
+// scheduled time, so a slow server is not hidden by the client waiting for it
+// (coordinated omission); requests the workers cannot even queue are dropped.
+func runLoad(t *loadTarget, o loadOptions) (res *loadResult, dropped int64, elapsed time.Duration) {
+	start := time.Now()
+	measureFrom := start.Add(o.warmup)
+	end := measureFrom.Add(o.duration)
+
+	var seq atomic.Int64
+	exec := func(r *loadResult, scheduled time.Time) {
+		n := seq.Add(1)
+		inst, err := t.next()
+		if err == nil {
+			err = t.do(inst, n)
+		}
+		lat := time.Since(scheduled)
+		if scheduled.Before(measureFrom) {
+			return
+		}
+		r.requests++
+		if err != nil {
+			r.errors[errorKey(err)]++
+			return
+		}
+		r.instances[inst.ID]++
+		r.latency.Record(lat)
+	}
+
+	var jobs chan time.Time
+	if o.qps > 0 {
+		jobs = make(chan time.Time, max(o.concurrency*64, 1024))
+		go func() {
+			defer close(jobs)
+			interval := time.Duration(float64(time.Second) / o.qps)
+			for k := int64(0); ; k++ {
+				at := start.Add(time.Duration(k) * interval)
+				if !at.Before(end) {
+					return
+				}
+				time.Sleep(time.Until(at))
+				select {
+				case jobs <- at:
+				default:
+					if !at.Before(measureFrom) {
+						atomic.AddInt64(&dropped, 1)
+					}
+				}
+			}
+		}()
+	}
+
+	results := make([]*loadResult, o.concurrency)
+	var wg sync.WaitGroup
+	for w := range results {
+		r := newLoadResult()
+		results[w] = r
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if jobs != nil {
+				for at := range jobs {
+					exec(r, at)
+				}
+				return
+			}
+			for now := time.Now(); now.Before(end); now = time.Now() {
+				exec(r, now)
+			}
+		}()
+	}
+	wg.Wait()
+
+	res = newLoadResult()
+	for _, r := range results {
+		res.merge(r)
+	}
+	return res, dropped, time.Since(measureFrom)
+}
+
+// loadSession runs the load test and writes its report.
+func loadSession(service string, t *loadTarget, o loadOptions) {
+	mode := "closed loop"
+	if o.qps > 0 {
+		mode = fmt.Sprintf("open loop at %.0f req/s", o.qps)
+	}
+	log.Printf("load test %s: %d workers, %s, %s warm-up + %s", service, o.concurrency, mode, o.warmup, o.duration)
+	res, dropped, elapsed := runLoad(t, o)
+	rep := buildLoadReport(service, o, res, dropped, elapsed)
+	if err := saveLoadReport(o.out, o.report, rep); err != nil {
+		log.Fatalf("write report: %v", err)
+	}
+	if o.out != "" {
+		log.Printf("report written to %s", o.out)
+	}
+}
+
+// -------- report --------
+
+type loadReport struct {
+	Service       string           `json:"service"`
+	Mode          string           `json:"mode"` // closed|open
+	Concurrency   int              `json:"concurrency"`
+	TargetQPS     float64          `json:"target_qps,omitempty"`
+	Duration      string           `json:"duration"`
+	Warmup        string           `json:"warmup"`
+	Requests      int64            `json:"requests"`
+	Errors        int64            `json:"errors"`
+	Dropped       int64            `json:"dropped,omitempty"`
+	ThroughputRPS float64          `json:"throughput_rps"` // richieste riuscite al secondo
+	LatencyMs     latencyReport    `json:"latency_ms"`
+	ErrorCounts   map[string]int64 `json:"error_breakdown,omitempty"`
+	Instances     []instanceShare  `json:"instances"`
+}
+
+type latencyReport struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	P999 float64 `json:"p999"`
+	Max  float64 `json:"max"`
+}
+
+type instanceShare struct {
+	ID       string  `json:"id"`
+	Requests int64   `json:"requests"`
+	Share    float64 `json:"share"` // frazione delle richieste riuscite
+}
+
+func ms(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+
+func buildLoadReport(service string, o loadOptions, res *loadResult, dropped int64, elapsed time.Duration) loadReport {
+	h := res.latency
+	rep := loadReport{
+		Service:     service,
+		Mode:        "closed",
+		Concurrency: o.concurrency,
+		TargetQPS:   o.qps,
+		Duration:    o.duration.String(),
+		Warmup:      o.warmup.String(),
+		Requests:    res.requests,
+		Errors:      res.errorCount(),
+		Dropped:     dropped,
+		LatencyMs: latencyReport{
+			Min: ms(h.Min()), Mean: ms(h.Mean()), Max: ms(h.Max()),
+			P50: ms(h.Quantile(0.5)), P90: ms(h.Quantile(0.9)), P99: ms(h.Quantile(0.99)), P999: ms(h.Quantile(0.999)),
+		},
+		ErrorCounts: res.errors,
+	}
+	if o.qps > 0 {
+		rep.Mode = "open"
+	}
+	if elapsed > 0 {
+		rep.ThroughputRPS = float64(h.Count()) / elapsed.Seconds()
+	}
+	for id, n := range res.instances {
+		rep.Instances = append(rep.Instances, instanceShare{ID: id, Requests: n, Share: float64(n) / float64(max(h.Count(), 1))})
+	}
+	sort.Slice(rep.Instances, func(i, j int) bool { return rep.Instances[i].ID < rep.Instances[j].ID })
+	return rep
+}
+
+func writeLoadReport(w io.Writer, format string, rep loadReport) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rep)
+	case "csv":
+		return writeLoadCSV(w, rep)
+	}
+
+	mode := fmt.Sprintf("closed loop, %d workers", rep.Concurrency)
+	if rep.Mode == "open" {
+		mode = fmt.Sprintf("open loop, %.0f req/s target, %d workers", rep.TargetQPS, rep.Concurrency)
+	}
+	l := rep.LatencyMs
+	fmt.Fprintf(w, "Load test %s: %s, %s (+%s warm-up)\n", rep.Service, mode, rep.Duration, rep.Warmup)
+	fmt.Fprintf(w, "  requests   %d (errors %d, dropped %d)\n", rep.Requests, rep.Errors, rep.Dropped)
+	fmt.Fprintf(w, "  throughput %.1f req/s\n", rep.ThroughputRPS)
+	fmt.Fprintf(w, "  latency ms min=%.3f mean=%.3f p50=%.3f p90=%.3f p99=%.3f p999=%.3f max=%.3f\n",
+		l.Min, l.Mean, l.P50, l.P90, l.P99, l.P999, l.Max)
+	fmt.Fprintln(w, "  instances:")
+	for _, in := range rep.Instances {
+		fmt.Fprintf(w, "    %-20s %8d  %5.1f%%\n", in.ID, in.Requests, 100*in.Share)
+	}
+	if len(rep.ErrorCounts) > 0 {
+		fmt.Fprintln(w, "  errors:")
+		for _, k := range sortedKeys(rep.ErrorCounts) {
+			fmt.Fprintf(w, "    %8d  %s\n", rep.ErrorCounts[k], k)
+		}
+	}
+	return nil
+}
+
+// writeLoadCSV writes one "section,name,value" row per figure of the report.
+func writeLoadCSV(w io.Writer, rep loadReport) error {
+	cw := csv.NewWriter(w)
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	i := func(v int64) string { return strconv.FormatInt(v, 10) }
+	l := rep.LatencyMs
+	rows := [][]string{
+		{"section", "name", "value"},
+		{"run", "service", rep.Service},
+		{"run", "mode", rep.Mode},
+		{"run", "concurrency", strconv.Itoa(rep.Concurrency)},
+		{"run", "target_qps", f(rep.TargetQPS)},
+		{"run", "duration", rep.Duration},
+		{"run", "warmup", rep.Warmup},
+		{"summary", "requests", i(rep.Requests)},
+		{"summary", "errors", i(rep.Errors)},
+		{"summary", "dropped", i(rep.Dropped)},
+		{"summary", "throughput_rps", f(rep.ThroughputRPS)},
+		{"latency_ms", "min", f(l.Min)},
+		{"latency_ms", "mean", f(l.Mean)},
+		{"latency_ms", "p50", f(l.P50)},
+		{"latency_ms", "p90", f(l.P90)},
+		{"latency_ms", "p99", f(l.P99)},
+		{"latency_ms", "p999", f(l.P999)},
+		{"latency_ms", "max", f(l.Max)},
+	}
+	for _, in := range rep.Instances {
+		rows = append(rows, []string{"instance", in.ID, i(in.Requests)})
+	}
+	for _, k := range sortedKeys(rep.ErrorCounts) {
+		rows = append(rows, []string{"error", k, i(rep.ErrorCounts[k])})
+	}
+	if err := cw.WriteAll(rows); err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// saveLoadReport writes the report to path, or to stdout if path is "".
+func saveLoadReport(path, format string, rep loadReport) error {
+	if path == "" {
+		return writeLoadReport(os.Stdout, format, rep)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeLoadReport(f, format, rep); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
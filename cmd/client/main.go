@@ -3,40 +3,155 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
-	"net/rpc"
+	"os"
+	"strings"
 	"time"
 
 	"example.com/service-registry-lb/common"
+	"example.com/service-registry-lb/internal/connpool"
 	"example.com/service-registry-lb/internal/lb"
+	"example.com/service-registry-lb/internal/rpcctx"
 )
 
 func main() {
 	registryAddr := flag.String("registry", "localhost:9000", "registry address host:port")
-	service := flag.String("service", "echo", "service name: echo|math|kv")
-	algo := flag.String("algo", "rr", "load balancing algorithm: random|rr|wrr")
+	service := flag.String("service", "echo", "service name: echo|math|kv, or config for the registry config store")
+	algo := flag.String("algo", "rr", "load balancing algorithm: random|rr|wrr|adaptive (weights from the load the instances report)")
 	n := flag.Int("n", 20, "number of requests in the session")
 	sleep := flag.Duration("sleep", 200*time.Millisecond, "sleep between requests")
 
-	op := flag.String("op", "get", "kv operation: get|put (only for service=kv)")
+	op := flag.String("op", "get", "kv operation: "+strings.Join(kvOps, "|")+" (service=kv), or "+strings.Join(configOps, "|")+" (service=config)")
 	key := flag.String("key", "x", "kv key (only for service=kv)")
-	value := flag.String("value", "v", "kv value (only for service=kv and op=put)")
+	value := flag.String("value", "v", "kv value (only for service=kv and op=put|cas|putifabsent)")
+	consistency := flag.String("consistency", common.ReadAny, "read consistency: any|bounded|linearizable (only for service=kv and op=get)")
+	maxLag := flag.Int64("max-lag", 0, "max seq lag behind the primary for -consistency bounded")
+	minSeq := flag.Int64("min-seq", 0, "initial session token for reads (seq of a previous write; only for service=kv)")
+	minEpoch := flag.Int64("min-epoch", 0, "epoch of the -min-seq write (0 = whatever epoch the replica is in; only for service=kv)")
+	ttl := flag.Duration("ttl", 0, "key TTL, e.g. 30s (only for service=kv and op=put|cas|putifabsent; 0 = no expiry)")
+	start := flag.String("start", "", "first key of the range (only for service=kv and op=scan)")
+	end := flag.String("end", "", "end of the range, exclusive; empty = no bound (only for service=kv and op=scan)")
+	prefix := flag.String("prefix", "", "key prefix (only for service=kv and op=list|watch)")
+	limit := flag.Int("limit", 0, "page size for op=scan|list (0 = server default)")
+	txn := flag.String("txn", "", "txn ops, e.g. 'put a 1;put b 2;delete c' (only for service=kv and op=txn)")
+	txnIf := flag.String("if", "", "txn guards, e.g. 'a=3;b=0' (key=version, 0 = absent; only for op=txn)")
+	fromSeq := flag.Int64("from-seq", -1, "watch changes after this seq; -1 = from now (only for service=kv and op=watch)")
+	expect := flag.Int64("expect", 0, "expected key version (service=kv and op=cas, or service=config and op=put|delete; 0 = key must not exist)")
+	group := flag.String("group", "", "kv replica group for op=scan|list|watch (default: all groups)")
+	shard := flag.Int("shard", -1, "shard to move (only for service=kv and op=move-shard)")
+	to := flag.String("to", "", "destination group (only for service=kv and op=move-shard)")
+	method := flag.String("method", "", "generic mode: call this RPC, e.g. Math.Add (service from the prefix unless -service is set); 'list' prints the known methods")
+	argsJSON := flag.String("args", "", `arguments of -method as JSON with Go field names, e.g. '{"A":1,"B":2}'`)
+	refresh := flag.Duration("refresh", 0, "re-run the registry lookup every interval during the session (0 = cache for the whole session)")
+	watch := flag.Bool("watch", false, "follow instance changes as they happen via Registry.WatchService (instead of -refresh polling)")
+	load := flag.Bool("load", false, "load generator mode: run for -duration with -c workers instead of -n requests (echo, math, kv op=get|put)")
+	concurrency := flag.Int("c", 8, "load mode: concurrent workers")
+	qps := flag.Float64("qps", 0, "load mode: target request rate, open loop (0 = closed loop, each worker sends as soon as it gets a reply)")
+	duration := flag.Duration("duration", 10*time.Second, "load mode: measured run time")
+	warmup := flag.Duration("warmup", time.Second, "load mode: run time before measuring (requests not reported)")
+	report := flag.String("report", "text", "load mode: report format "+strings.Join(loadReports, "|"))
+	out := flag.String("out", "", "load mode: write the report to this file (default stdout)")
+	timeout := flag.Duration("timeout", 0, "deadline of every request to the instances, sent along to the server (0 = per-method default, e.g. 5s)")
+	pool := flag.Bool("pool", true, "reuse connections to the instances (false = dial per request)")
+	poolMaxIdle := flag.Int("pool-max-idle", 4, "idle connections kept per instance")
+	poolMinIdle := flag.Int("pool-min-idle", 0, "connections opened up front on the first use of an instance")
 
 	flag.Parse()
 
-	if *service == "kv" {
-		if *op != "get" && *op != "put" {
-			log.Fatalf("invalid -op %q (use get|put)", *op)
+	if *load {
+		if *concurrency < 1 || *duration <= 0 || *qps < 0 || !validLoadReport(*report) {
+			log.Fatalf("load mode needs -c >= 1, -duration > 0, -qps >= 0 and -report %s", strings.Join(loadReports, "|"))
+		}
+		// ogni worker tiene occupata una connessione per istanza
+		*poolMaxIdle = max(*poolMaxIdle, *concurrency)
+	}
+	if !*pool {
+		*poolMaxIdle, *poolMinIdle = 0, 0
+	}
+	conns = connpool.New(connpool.Options{MaxIdle: *poolMaxIdle, MinIdle: *poolMinIdle, Timeout: *timeout})
+	defer conns.Close()
+
+	// per service=config il confronto di versione si fa solo se -expect è stato passato
+	expectSet, serviceSet := false, false
+	flag.Visit(func(f *flag.Flag) {
+		expectSet = expectSet || f.Name == "expect"
+		serviceSet = serviceSet || f.Name == "service"
+	})
+
+	var methodArgs any
+	if *method == "list" {
+		printMethods()
+		return
+	}
+	if *method != "" {
+		a, err := parseMethodArgs(*method, *argsJSON)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		methodArgs = a
+		if !serviceSet {
+			*service = common.MethodService(*method)
+		}
+	}
+
+	if *service == "config" && !validConfigOp(*op) {
+		log.Fatalf("invalid -op %q (use %s)", *op, strings.Join(configOps, "|"))
+	}
+	if *service == "kv" && *method == "" {
+		if !validKVOp(*op) {
+			log.Fatalf("invalid -op %q (use %s)", *op, strings.Join(kvOps, "|"))
 		}
 		if *key == "" {
 			log.Fatalf("missing -key for kv")
 		}
 	}
-	// Lookup ONCE per session (cache)
-	reg, err := rpc.DialHTTP("tcp", *registryAddr)
+	if *algo == "adaptive" {
+		// i carichi arrivano con gli heartbeat senza cambiare revisione: WatchService non li vede
+		if *watch {
+			log.Fatalf("-algo adaptive needs -refresh polling, not -watch")
+		}
+		if *refresh == 0 {
+			*refresh = 2 * time.Second
+		}
+	}
+	txnOps, txnCmps, err := parseTxn(*txn, *txnIf)
+	if err != nil {
+		log.Fatalf("invalid -txn/-if: %v", err)
+	}
+	if *service == "kv" && *op == "txn" && len(txnOps) == 0 {
+		log.Fatalf("missing -txn for op=txn")
+	}
+	if *service == "kv" && *op == "move-shard" && (*shard < 0 || *to == "") {
+		log.Fatalf("op=move-shard needs -shard and -to")
+	}
+	kvOpts := kvOptions{op: *op, key: *key, value: *value, expect: *expect, ttl: *ttl,
+		consistency: *consistency, maxLag: *maxLag,
+		start: *start, end: *end, prefix: *prefix, limit: *limit,
+		txnOps: txnOps, compares: txnCmps, startSeq: *fromSeq, fromSeq: map[string]int64{},
+		session: map[string]sessionToken{}, group: *group}
+	loadOpts := loadOptions{concurrency: *concurrency, qps: *qps, duration: *duration, warmup: *warmup,
+		report: *report, out: *out}
+
+	// Lookup all'inizio della sessione (cache), riletto solo con -refresh/-watch
+	regConn, err := rpcctx.Dial(*registryAddr)
 	if err != nil {
 		log.Fatalf("dial registry: %v", err)
 	}
+	reg := &rpcctx.Client{Client: regConn}
+
+	if strings.HasPrefix(*method, "Registry.") {
+		if err := callRegistryMethod(reg, *method, methodArgs); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
+	if *service == "config" {
+		if err := runConfig(reg, *op, *key, *value, *prefix, expectSet, *expect); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
 
 	var lrep common.LookupReply
 	if err := reg.Call("Registry.Lookup", &common.LookupArgs{Service: *service}, &lrep); err != nil {
@@ -47,41 +162,114 @@ func main() {
 		log.Fatalf("no instances for service %q", *service)
 	}
 
-	fmt.Printf("Session started. Cached instances for %q:\n", *service)
+	// in modalità load stdout è del report (json/csv): il resto va su stderr
+	info := io.Writer(os.Stdout)
+	if *load {
+		info = os.Stderr
+	}
+	fmt.Fprintf(info, "Session started. Cached instances for %q:\n", *service)
 	for _, inst := range instances {
-		fmt.Printf(" - id=%s addr=%s weight=%d\n", inst.ID, inst.Addr, inst.Weight)
+		fmt.Fprintf(info, " - id=%s addr=%s weight=%d\n", inst.ID, inst.Addr, inst.Weight)
 	}
 
 	// Choose picker
-	var picker lb.Picker
-	switch *algo {
-	case "random":
-		picker = lb.NewRandom(instances)
-	case "rr":
-		picker = lb.NewRoundRobin(instances)
-	case "wrr":
-		picker = lb.NewSmoothWeightedRR(instances)
-	default:
-		log.Fatalf("unknown algo %q", *algo)
+	picker, err := lb.New(*algo, instances)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	var rf *refresher
+	ended := "\nSession ended (client did NOT refresh registry during the session)."
+	switch {
+	case *watch:
+		rf = newRefresher(reg, *service, instances, lrep.Revision)
+		go rf.watch()
+		ended = "\nSession ended (instances followed with Registry.WatchService)."
+	case *refresh > 0:
+		rf = newRefresher(reg, *service, instances, lrep.Revision)
+		go rf.poll(*refresh)
+		ended = fmt.Sprintf("\nSession ended (registry lookup refreshed every %s).", *refresh)
+	}
+
+	if *method != "" {
+		fmt.Printf("\nUsing LB algorithm: %s, method %s\n\n", picker.Name(), *method)
+		runMethod(picker, rf, *method, methodArgs, *n, *sleep)
+		stats.print(*pool)
+		fmt.Println(ended)
+		return
+	}
+
+	if *service == "kv" {
+		// kv: un picker per replica group, la chiave sceglie il gruppo tramite la shard map
+		router, err := newKVRouter(reg, instances, func(insts []common.Instance) lb.Picker {
+			p, _ := lb.New(*algo, insts)
+			return p
+		})
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		// il token passato a mano vale per il gruppo della chiave
+		kvOpts.session[router.groupOf(*key)] = sessionToken{epoch: *minEpoch, seq: *minSeq}
+		switch *op {
+		case "shardmap":
+			printShardMap(router)
+			return
+		case "move-shard":
+			if err := moveShard(router, *shard, *to); err != nil {
+				log.Fatalf("move shard: %v", err)
+			}
+			printShardMap(router)
+			return
+		}
+		if *load {
+			t, err := kvLoadTarget(router, rf, &kvOpts)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			loadSession(*service, t, loadOpts)
+			return
+		}
+		fmt.Printf("\nUsing LB algorithm: %s (per group %v)\n\n", picker.Name(), router.groups)
+		runKVSession(router, rf, &kvOpts, *n, *sleep)
+		stats.print(*pool)
+		fmt.Println(ended)
+		return
+	}
+
+	if *load {
+		t, err := serviceLoadTarget(*service, picker, rf)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		loadSession(*service, t, loadOpts)
+		return
 	}
 
 	fmt.Printf("\nUsing LB algorithm: %s\n\n", picker.Name())
 
 	for i := 1; i <= *n; i++ {
+		if insts, ok := rf.take(); ok {
+			picker.Update(insts)
+		}
 		inst, err := picker.Pick()
 		if err != nil {
-			log.Fatalf("pick: %v", err)
+			if rf == nil {
+				log.Fatalf("pick: %v", err)
+			}
+			// con refresh attivo il servizio può tornare: salto la richiesta
+			log.Printf("[%02d] pick: %v", i, err)
+			time.Sleep(*sleep)
+			continue
 		}
 
-		c, err := rpc.DialHTTP("tcp", inst.Addr)
-		if err != nil {
-			log.Fatalf("dial %s: %v", inst.Addr, err)
-		}
+		c := conns.Caller(inst.Addr)
+		start := time.Now()
 
 		switch *service {
 		case "echo":
 			var rep common.EchoReply
 			err = c.Call("Echo.Echo", &common.EchoArgs{Msg: fmt.Sprintf("hello #%d", i)}, &rep)
+			stats.add(time.Since(start))
 			if err != nil {
 				log.Fatalf("rpc call: %v", err)
 			}
@@ -90,79 +278,18 @@ func main() {
 		case "math":
 			var rep common.AddReply
 			err = c.Call("Math.Add", &common.AddArgs{A: i, B: i}, &rep)
+			stats.add(time.Since(start))
 			if err != nil {
 				log.Fatalf("rpc call: %v", err)
 			}
 			fmt.Printf("[%02d] picked=%s => %d+%d=%d from=%s\n", i, inst.ID, i, i, rep.Sum, rep.From)
 
-		case "kv":
-
-			switch *op {
-			case "get":
-				var rep common.GetReply
-				err = c.Call("KV.Get", &common.GetArgs{Key: *key}, &rep)
-				if err != nil {
-					_ = c.Close()
-					log.Fatalf("KV.Get rpc call: %v", err)
-				}
-				if rep.Found {
-					fmt.Printf("[%02d] GET key=%q picked=%s => value=%q from=%s\n", i, *key, inst.ID, rep.Value, rep.From)
-				} else {
-					fmt.Printf("[%02d] GET key=%q picked=%s => NOT FOUND from=%s\n", i, *key, inst.ID, rep.From)
-				}
-
-			case "put":
-				// Provo sul server scelto dal LB
-				putVal := fmt.Sprintf("%s#%d", *value, i)
-
-				var rep common.PutReply
-				err = c.Call("KV.Put", &common.PutArgs{Key: *key, Value: putVal}, &rep)
-				if err != nil {
-					_ = c.Close()
-					log.Fatalf("KV.Put rpc call: %v", err)
-				}
-
-				// Se ho colpito un backup: mi dice dove sta il primary -> ritento lì
-				if !rep.OK && rep.RedirectTo != "" {
-					pc, derr := rpc.DialHTTP("tcp", rep.RedirectTo)
-					if derr != nil {
-						_ = c.Close()
-						log.Fatalf("dial primary %s: %v", rep.RedirectTo, derr)
-					}
-
-					var rep2 common.PutReply
-					err2 := pc.Call("KV.Put", &common.PutArgs{Key: *key, Value: putVal}, &rep2)
-					_ = pc.Close()
-					if err2 != nil {
-						_ = c.Close()
-						log.Fatalf("KV.Put on primary rpc call: %v", err2)
-					}
-					if !rep2.OK {
-						_ = c.Close()
-						log.Fatalf("KV.Put on primary failed (ok=false), from=%s", rep2.From)
-					}
-
-					fmt.Printf("[%02d] PUT key=%q value=%q picked=%s (backup) -> primary=%s ok from=%s\n",
-						i, *key, putVal, inst.ID, rep.RedirectTo, rep2.From)
-				} else {
-					// Ho colpito direttamente il primary
-					if !rep.OK {
-						_ = c.Close()
-						log.Fatalf("KV.Put failed (ok=false) without redirect, from=%s", rep.From)
-					}
-					fmt.Printf("[%02d] PUT key=%q value=%q picked=%s ok from=%s\n",
-						i, *key, putVal, inst.ID, rep.From)
-				}
-			}
-
 		default:
-			_ = c.Close()
 			log.Fatalf("unknown service %q", *service)
 		}
 
-		_ = c.Close()
 		time.Sleep(*sleep)
 	}
-
-	fmt.Println("\nSession ended (client did NOT refresh registry during the session).")
+	stats.print(*pool)
+	fmt.Println(ended)
 }
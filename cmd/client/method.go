@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"example.com/service-registry-lb/common"
+	"example.com/service-registry-lb/internal/lb"
+	"example.com/service-registry-lb/internal/rpcctx"
+)
+
+// parseMethodArgs builds the arguments of method from JSON; field names are
+// the Go ones (e.g. {"A":1,"B":2} for Math.Add) and unknown fields are an error.
+func parseMethodArgs(method, argsJSON string) (any, error) {
+	args, _, err := common.NewMethodValues(method)
+	if err != nil {
+		return nil, fmt.Errorf("%w (see -method list)", err)
+	}
+	if strings.TrimSpace(argsJSON) == "" {
+		return args, nil
+	}
+	dec := json.NewDecoder(strings.NewReader(argsJSON))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(args); err != nil {
+		return nil, fmt.Errorf("invalid -args for %s: %w", method, err)
+	}
+	return args, nil
+}
+
+// printMethods lists the known methods with the JSON of their zero arguments.
+func printMethods() {
+	for _, m := range common.Methods() {
+		args, _, _ := common.NewMethodValues(m)
+		b, _ := json.Marshal(args)
+		fmt.Printf("%-28s %s\n", m, b)
+	}
+}
+
+// callRegistryMethod invokes a Registry.* method once and prints the reply.
+func callRegistryMethod(reg *rpcctx.Client, method string, args any) error {
+	_, reply, _ := common.NewMethodValues(method)
+	if err := reg.Call(method, args, reply); err != nil {
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	fmt.Println(jsonReply(reply))
+	return nil
+}
+
+// runMethod sends method n times to the instances chosen by picker; there is no
+// shard routing, so for kv it suits single-group deployments or explicit instances.
+func runMethod(picker lb.Picker, rf *refresher, method string, args any, n int, sleep time.Duration) {
+	for i := 1; i <= n; i++ {
+		if insts, ok := rf.take(); ok {
+			picker.Update(insts)
+		}
+		inst, err := picker.Pick()
+		if err != nil {
+			log.Fatalf("pick: %v", err)
+		}
+		_, reply, _ := common.NewMethodValues(method)
+		start := time.Now()
+		err = conns.Call(inst.Addr, method, args, reply)
+		stats.add(time.Since(start))
+		if err != nil {
+			log.Fatalf("%s rpc call: %v", method, err)
+		}
+		fmt.Printf("[%02d] picked=%s => %s\n", i, inst.ID, jsonReply(reply))
+		time.Sleep(sleep)
+	}
+}
+
+func jsonReply(reply any) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(reply); err != nil {
+		return fmt.Sprintf("%+v", reply)
+	}
+	return strings.TrimSpace(buf.String())
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"example.com/service-registry-lb/internal/connpool"
+)
+
+// conns holds the connections to the instances, shared by every picker and
+// request of the session (main replaces it according to the -pool flags).
+var conns = connpool.New(connpool.Options{MaxIdle: 4})
+
+// stats accumulates the time spent in requests, sleeps excluded, so that
+// -pool=false and -pool=true can be compared on the same workload.
+var stats sessionStats
+
+type sessionStats struct {
+	requests int
+	busy     time.Duration
+}
+
+func (s *sessionStats) add(d time.Duration) {
+	s.requests++
+	s.busy += d
+}
+
+func (s *sessionStats) print(pooled bool) {
+	if s.requests == 0 {
+		return
+	}
+	cs := conns.Stats()
+	fmt.Printf("\n%d requests in %s: %.0f req/s, avg %s (pool=%v dials=%d reuses=%d evictions=%d)\n",
+		s.requests, s.busy.Round(time.Millisecond), float64(s.requests)/s.busy.Seconds(),
+		(s.busy / time.Duration(s.requests)).Round(time.Microsecond), pooled, cs.Dials, cs.Reuses, cs.Evictions)
+}
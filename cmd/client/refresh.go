@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/service-registry-lb/common"
+	"example.com/service-registry-lb/internal/rpcctx"
+)
+
+// refresher keeps the cached instance list of the session up to date, polling
+// Registry.Lookup every interval or long-polling Registry.WatchService. New lists
+// are only staged here: the session applies them between two requests (take),
+// so pickers are never touched concurrently with Pick.
+type refresher struct {
+	reg     *rpcctx.Client
+	service string
+
+	mu      sync.Mutex
+	current []common.Instance
+	pending []common.Instance
+	staged  bool
+	rev     int64
+}
+
+func newRefresher(reg *rpcctx.Client, service string, instances []common.Instance, rev int64) *refresher {
+	return &refresher{reg: reg, service: service, current: instances, rev: rev}
+}
+
+// poll re-runs the lookup every interval.
+func (r *refresher) poll(interval time.Duration) {
+	for range time.Tick(interval) {
+		var rep common.LookupReply
+		if err := r.reg.Call("Registry.Lookup", &common.LookupArgs{Service: r.service}, &rep); err != nil {
+			log.Printf("[refresh] lookup %s: %v", r.service, err)
+			continue
+		}
+		r.stage(rep.Instances, rep.Revision)
+	}
+}
+
+// watch long-polls the registry and stages every change as soon as it happens.
+func (r *refresher) watch() {
+	for {
+		r.mu.Lock()
+		rev := r.rev
+		r.mu.Unlock()
+		var rep common.WatchServiceReply
+		if err := r.reg.Call("Registry.WatchService", &common.WatchServiceArgs{Service: r.service, AfterRevision: rev}, &rep); err != nil {
+			log.Printf("[refresh] watch %s: %v", r.service, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if rep.Changed {
+			r.stage(rep.Instances, rep.Revision)
+		}
+	}
+}
+
+func (r *refresher) stage(instances []common.Instance, rev int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rev = rev
+	r.pending = instances
+	r.staged = true
+}
+
+// take returns the staged list if it differs from the current one, logging the
+// difference; ok is false when there is nothing to apply. r may be nil (no refresh).
+func (r *refresher) take() (instances []common.Instance, ok bool) {
+	if r == nil {
+		return nil, false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.staged {
+		return nil, false
+	}
+	r.staged = false
+	diff := diffInstances(r.current, r.pending)
+	if diff == "" {
+		// solo il carico riportato è cambiato: niente log, ma il picker adaptive lo vuole
+		if !loadsChanged(r.current, r.pending) {
+			return nil, false
+		}
+		r.current = r.pending
+		return r.current, true
+	}
+	log.Printf("[refresh] %s instances changed (rev %d): %s", r.service, r.rev, diff)
+	// le connessioni in pool verso istanze sparite non servono più
+	still := make(map[string]bool, len(r.pending))
+	for _, inst := range r.pending {
+		still[inst.Addr] = true
+	}
+	for _, inst := range r.current {
+		if !still[inst.Addr] {
+			conns.Drop(inst.Addr)
+		}
+	}
+	r.current = r.pending
+	return r.current, true
+}
+
+// diffInstances describes the changes from old to cur: "+id(addr)", "-id(addr)",
+// "~id addr a->b", "~id weight a->b", "~id maintenance true|false" or "~id meta";
+// "" if nothing changed.
+func diffInstances(old, cur []common.Instance) string {
+	byID := make(map[string]common.Instance, len(old))
+	for _, inst := range old {
+		byID[inst.ID] = inst
+	}
+	var out []string
+	for _, inst := range cur {
+		prev, ok := byID[inst.ID]
+		delete(byID, inst.ID)
+		switch {
+		case !ok:
+			out = append(out, fmt.Sprintf("+%s(%s)", inst.ID, inst.Addr))
+		case prev.Addr != inst.Addr:
+			out = append(out, fmt.Sprintf("~%s addr %s->%s", inst.ID, prev.Addr, inst.Addr))
+		case prev.Weight != inst.Weight:
+			out = append(out, fmt.Sprintf("~%s weight %d->%d", inst.ID, prev.Weight, inst.Weight))
+		case common.InMaintenance(prev) != common.InMaintenance(inst):
+			out = append(out, fmt.Sprintf("~%s maintenance %v", inst.ID, common.InMaintenance(inst)))
+		case !maps.Equal(prev.Meta, inst.Meta):
+			out = append(out, fmt.Sprintf("~%s meta", inst.ID))
+		}
+	}
+	for _, inst := range old {
+		if _, gone := byID[inst.ID]; gone {
+			out = append(out, fmt.Sprintf("-%s(%s)", inst.ID, inst.Addr))
+		}
+	}
+	return strings.Join(out, " ")
+}
+
+// loadsChanged reports whether some instance reported a new load (same IDs in both lists).
+func loadsChanged(old, cur []common.Instance) bool {
+	reported := make(map[string]time.Time, len(old))
+	for _, inst := range old {
+		reported[inst.ID] = inst.Load.ReportedAt
+	}
+	for _, inst := range cur {
+		if !inst.Load.ReportedAt.Equal(reported[inst.ID]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"example.com/service-registry-lb/common"
+	"example.com/service-registry-lb/internal/lb"
+	"example.com/service-registry-lb/internal/rpcctx"
+)
+
+// kvRouter sends every key to the replica group that owns its shard and balances
+// among that group's cached instances, with one picker per group.
+type kvRouter struct {
+	reg       *rpcctx.Client
+	smap      common.ShardMap
+	groups    []string
+	pickers   map[string]lb.Picker
+	newPicker func([]common.Instance) lb.Picker
+}
+
+func newKVRouter(reg *rpcctx.Client, instances []common.Instance, newPicker func([]common.Instance) lb.Picker) (*kvRouter, error) {
+	r := &kvRouter{reg: reg, pickers: map[string]lb.Picker{}, newPicker: newPicker}
+	r.setInstances(instances)
+	if err := r.refreshMap(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// setInstances regroups instances by replica group: the pickers of known groups
+// are updated in place, new groups get a new picker, empty groups are dropped.
+func (r *kvRouter) setInstances(instances []common.Instance) {
+	byGroup := map[string][]common.Instance{}
+	for _, inst := range instances {
+		g := common.GroupOfInstance(inst)
+		byGroup[g] = append(byGroup[g], inst)
+	}
+	r.groups = r.groups[:0]
+	for g, insts := range byGroup {
+		r.groups = append(r.groups, g)
+		if p, ok := r.pickers[g]; ok {
+			p.Update(insts)
+		} else {
+			r.pickers[g] = r.newPicker(insts)
+		}
+	}
+	for g := range r.pickers {
+		if _, ok := byGroup[g]; !ok {
+			delete(r.pickers, g)
+		}
+	}
+	sort.Strings(r.groups)
+}
+
+// refreshMap re-reads the shard map (the instance lists are refreshed only with -refresh/-watch).
+func (r *kvRouter) refreshMap() error {
+	var rep common.GetShardMapReply
+	if err := r.reg.Call("Registry.GetShardMap", &common.GetShardMapArgs{Service: "kv"}, &rep); err != nil {
+		return fmt.Errorf("get shard map: %w", err)
+	}
+	r.smap = rep.Map
+	return nil
+}
+
+func (r *kvRouter) groupOf(key string) string {
+	if g := r.smap.GroupOf(key); g != "" {
+		return g
+	}
+	// senza mappa si può instradare solo se c'è un unico gruppo
+	if len(r.groups) == 1 {
+		return r.groups[0]
+	}
+	return ""
+}
+
+func (r *kvRouter) pick(group string) (common.Instance, error) {
+	if group == "" {
+		return common.Instance{}, fmt.Errorf("no shard map: cannot route among groups %v", r.groups)
+	}
+	p, ok := r.pickers[group]
+	if !ok {
+		return common.Instance{}, fmt.Errorf("no cached instances for group %q", group)
+	}
+	return p.Pick()
+}
+
+// targets returns the groups a kv operation must be sent to.
+func (r *kvRouter) targets(o *kvOptions) ([]string, error) {
+	switch {
+	case o.op == "scan" || o.op == "list":
+		if o.group != "" {
+			return []string{o.group}, nil
+		}
+		return r.groups, nil
+	case o.op == "watch" && o.prefix != "":
+		if o.group != "" {
+			return []string{o.group}, nil
+		}
+		if len(r.groups) > 1 {
+			return nil, fmt.Errorf("prefix watch spans groups %v: choose one with -group", r.groups)
+		}
+		return r.groups, nil
+	case o.op == "txn":
+		return []string{r.groupOf(o.txnOps[0].Key)}, nil
+	default:
+		return []string{r.groupOf(o.key)}, nil
+	}
+}
+
+// runKVSession sends n requests, each routed by key. Requests that hit a group no
+// longer owning the shard (or a shard being moved) are retried after re-reading the map.
+func runKVSession(r *kvRouter, rf *refresher, o *kvOptions, n int, sleep time.Duration) {
+	for i := 1; i <= n; i++ {
+		if insts, ok := rf.take(); ok {
+			r.setInstances(insts)
+		}
+		for attempt := 1; ; attempt++ {
+			start := time.Now()
+			err := runKVRequest(i, r, o)
+			stats.add(time.Since(start))
+			if err == nil {
+				break
+			}
+			if !common.IsShardRetryable(err) || attempt == common.ShardRetries {
+				log.Fatalf("%v", err)
+			}
+			log.Printf("[%02d] %v: refreshing shard map and retrying", i, err)
+			time.Sleep(common.ShardRetryBackoff)
+			if err := r.refreshMap(); err != nil {
+				log.Fatalf("%v", err)
+			}
+		}
+		time.Sleep(sleep)
+	}
+}
+
+func runKVRequest(i int, r *kvRouter, o *kvOptions) error {
+	groups, err := r.targets(o)
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		inst, err := r.pick(g)
+		if err != nil {
+			return fmt.Errorf("pick: %w", err)
+		}
+		if err := runKV(i, inst, conns.Caller(inst.Addr), g, o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// -------- admin: shard map e ribilanciamento --------
+
+func printShardMap(r *kvRouter) {
+	if r.smap.Version == 0 {
+		fmt.Println("No shard map for \"kv\"")
+		return
+	}
+	owned := map[string][]int{}
+	for shard, g := range r.smap.Groups {
+		owned[g] = append(owned[g], shard)
+	}
+	fmt.Printf("Shard map v%d (%d shards):\n", r.smap.Version, len(r.smap.Groups))
+	for _, g := range r.groups {
+		fmt.Printf(" - group=%s shards=%v\n", g, owned[g])
+	}
+	for g, shards := range owned {
+		if _, ok := r.pickers[g]; !ok {
+			fmt.Printf(" - group=%s shards=%v (no live instances!)\n", g, shards)
+		}
+	}
+}
+
+// moveShard moves a shard to another group while the service stays online:
+// writes to the shard are frozen on the source only between export and drop.
+func moveShard(r *kvRouter, shard int, to string) error {
+	if err := r.refreshMap(); err != nil {
+		return err
+	}
+	if shard < 0 || shard >= len(r.smap.Groups) {
+		return fmt.Errorf("invalid shard %d (map has %d)", shard, len(r.smap.Groups))
+	}
+	from := r.smap.Groups[shard]
+	if from == to {
+		fmt.Printf("shard %d already owned by %s\n", shard, to)
+		return nil
+	}
+	src, err := r.pick(from)
+	if err != nil {
+		return err
+	}
+	dst, err := r.pick(to)
+	if err != nil {
+		return err
+	}
+
+	// 1) congelo ed esporto dal primary sorgente
+	var exp common.ShardReply
+	if err := callGroupPrimary(src, "KV.ExportShard", &common.ShardArgs{Shard: shard}, &exp); err != nil {
+		return err
+	}
+	fmt.Printf("exported shard %d from %s: %d keys (seq=%d, by %s)\n", shard, from, exp.Count, exp.Seq, exp.From)
+
+	abort := func(cause error) error {
+		var rep common.ShardReply
+		if err := callGroupPrimary(src, "KV.UnfreezeShard", &common.ShardArgs{Shard: shard}, &rep); err != nil {
+			return fmt.Errorf("%v (and unfreeze failed: %v)", cause, err)
+		}
+		return cause
+	}
+
+	// 2) importo nel gruppo destinazione (replicato come una scrittura)
+	var imp common.ShardReply
+	if err := callGroupPrimary(dst, "KV.ImportShard", &common.ImportShardArgs{Shard: shard, Items: exp.Items}, &imp); err != nil {
+		return abort(err)
+	}
+	fmt.Printf("imported shard %d into %s: %d keys (seq=%d, by %s)\n", shard, to, imp.Count, imp.Seq, imp.From)
+
+	// 3) passo la proprietà nella mappa (CAS sulla versione)
+	groups := append([]string(nil), r.smap.Groups...)
+	groups[shard] = to
+	var set common.SetShardMapReply
+	if err := r.reg.Call("Registry.SetShardMap", &common.SetShardMapArgs{Service: "kv", ExpectedVersion: r.smap.Version, Groups: groups}, &set); err != nil {
+		return abort(fmt.Errorf("set shard map: %w", err))
+	}
+	if !set.OK {
+		return abort(fmt.Errorf("shard map changed concurrently (now v%d)", set.Map.Version))
+	}
+	r.smap = set.Map
+	fmt.Printf("shard map v%d: shard %d -> %s\n", set.Map.Version, shard, to)
+
+	// 4) cancello dal sorgente e tolgo il freeze
+	var drop common.ShardReply
+	if err := callGroupPrimary(src, "KV.DropShard", &common.ShardArgs{Shard: shard}, &drop); err != nil {
+		return fmt.Errorf("drop shard on %s (map already switched, retry the drop): %w", from, err)
+	}
+	fmt.Printf("dropped shard %d from %s: %d keys (by %s)\n", shard, from, drop.Count, drop.From)
+	return nil
+}
+
+// callGroupPrimary calls a shard-move RPC on inst, following the redirect to its primary.
+func callGroupPrimary(inst common.Instance, method string, args any, reply *common.ShardReply) error {
+	if err := conns.Call(inst.Addr, method, args, reply); err != nil {
+		return fmt.Errorf("%s rpc call: %w", method, err)
+	}
+	if !reply.OK && reply.RedirectTo != "" {
+		primary := reply.RedirectTo
+		*reply = common.ShardReply{}
+		if err := callPrimary(primary, method, args, reply); err != nil {
+			return err
+		}
+	}
+	if !reply.OK {
+		return fmt.Errorf("%s failed (ok=false), from=%s", method, reply.From)
+	}
+	return nil
+}
+
+func isShardAdminOp(op string) bool {
+	return op == "shardmap" || op == "move-shard"
+}
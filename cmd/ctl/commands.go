@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/service-registry-lb/common"
+	"example.com/service-registry-lb/internal/cliout"
+	"example.com/service-registry-lb/internal/lb"
+)
+
+// command is one shell command; complete returns the candidates for the next
+// argument given the ones already typed.
+type command struct {
+	name     string
+	usage    string
+	help     string
+	run      func(s *shell, args []string) error
+	complete func(s *shell, args []string) []string
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{name: "help", usage: "help [command]", help: "list the commands or show one", run: runHelp,
+			complete: func(s *shell, args []string) []string { return nth(args, 0, commandNames()) }},
+		{name: "catalog", usage: "catalog [table|json|yaml]", help: "services with instance and healthy counts, tags", run: runCatalog,
+			complete: func(s *shell, args []string) []string { return nth(args, 0, cliout.Formats) }},
+		{name: "lookup", usage: "lookup <service>", help: "instances of a service", run: runLookup,
+			complete: func(s *shell, args []string) []string { return nth(args, 0, s.services) }},
+		{name: "register", usage: "register <service> <id> <addr> [weight] [key=value...]",
+			help: "register an instance (it stays until deregistered)", run: runRegister,
+			complete: func(s *shell, args []string) []string { return nth(args, 0, s.services) }},
+		{name: "instance", usage: "instance <service> <id> [table|json|yaml]", help: "one instance with its health",
+			run: runInstance, complete: completeInstance},
+		{name: "deregister", usage: "deregister <service> <id>", help: "remove an instance", run: runDeregister,
+			complete: completeInstance},
+		{name: "echo", usage: "echo <message...>", help: "Echo.Echo on the picked instance", run: runEcho},
+		{name: "math", usage: "math add <a> <b>", help: "Math.Add on the picked instance", run: runMath,
+			complete: func(s *shell, args []string) []string { return nth(args, 0, []string{"add"}) }},
+		{name: "kv", usage: "kv get|put|delete <key> [value]", help: "kv request routed by shard, writes go to the primary",
+			run: runKV, complete: func(s *shell, args []string) []string {
+				return nth(args, 0, []string{"delete", "get", "put"})
+			}},
+		{name: "call", usage: "call <Service.Method> [json args]", help: "any known RPC (Registry.* goes to the registry)",
+			run: runCall, complete: func(s *shell, args []string) []string { return nth(args, 0, common.Methods()) }},
+		{name: "algo", usage: "algo [random|rr|wrr|adaptive]", help: "show or switch the LB algorithm", run: runAlgo,
+			complete: func(s *shell, args []string) []string { return nth(args, 0, lb.Algos) }},
+		{name: "stats", usage: "stats [reset]", help: "requests, errors and latency per instance", run: runStats,
+			complete: func(s *shell, args []string) []string { return nth(args, 0, []string{"reset"}) }},
+		{name: "quit", usage: "quit", help: "leave the shell (also exit, Ctrl-D)"},
+	}
+}
+
+func commandByName(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name && c.run != nil {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+func commandNames() []string {
+	names := make([]string, 0, len(commands)+1)
+	for _, c := range commands {
+		names = append(names, c.name)
+	}
+	return append(names, "exit")
+}
+
+// nth offers candidates only for the i-th argument.
+func nth(args []string, i int, candidates []string) []string {
+	if len(args) != i {
+		return nil
+	}
+	return candidates
+}
+
+func completeInstance(s *shell, args []string) []string {
+	switch len(args) {
+	case 0:
+		return s.services
+	case 1:
+		var ids []string
+		for _, inst := range s.known[args[0]] {
+			ids = append(ids, inst.ID)
+		}
+		return ids
+	}
+	return nil
+}
+
+// -------- comandi --------
+
+func runHelp(s *shell, args []string) error {
+	t := cliout.NewTable(os.Stdout)
+	for _, c := range commands {
+		if len(args) == 0 || args[0] == c.name {
+			t.Row(c.usage, c.help)
+		}
+	}
+	return t.Flush()
+}
+
+func runCatalog(s *shell, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: catalog [table|json|yaml]")
+	}
+	f, err := cliout.ParseFormat(strings.Join(args, ""))
+	if err != nil {
+		return err
+	}
+	cat, err := s.catalog()
+	if err != nil {
+		return err
+	}
+	return cliout.Write(os.Stdout, f, cat, func(t *cliout.TableWriter) {
+		t.Header("service", "instances", "healthy", "revision", "tags")
+		for _, svc := range cat {
+			t.Row(svc.Name, svc.Instances, svc.Healthy, svc.Revision, svc.Tags)
+		}
+	})
+}
+
+func runInstance(s *shell, args []string) error {
+	if len(args) < 2 || len(args) > 3 {
+		return fmt.Errorf("usage: instance <service> <id> [table|json|yaml]")
+	}
+	f, err := cliout.ParseFormat(strings.Join(args[2:], ""))
+	if err != nil {
+		return err
+	}
+	var rep common.GetInstanceReply
+	if err := s.reg.Call("Registry.GetInstance", &common.GetInstanceArgs{Service: args[0], ID: args[1]}, &rep); err != nil {
+		return fmt.Errorf("get instance: %w", err)
+	}
+	if !rep.Found {
+		return fmt.Errorf("no instance %s/%s", args[0], args[1])
+	}
+	return cliout.Write(os.Stdout, f, rep, func(t *cliout.TableWriter) {
+		t.Row("id", rep.Instance.ID)
+		t.Row("addr", rep.Instance.Addr)
+		t.Row("weight", rep.Instance.Weight)
+		t.Row("meta", cliout.Pairs(rep.Instance.Meta))
+		t.Row("healthy", rep.Healthy)
+		t.Row("registered", rep.RegisteredAt.Format(time.RFC3339))
+		if rep.LastSeen.IsZero() {
+			t.Row("last seen", "never")
+		} else {
+			t.Row("last seen", time.Since(rep.LastSeen).Round(time.Second).String()+" ago")
+		}
+		if l := rep.Instance.Load; !l.ReportedAt.IsZero() {
+			t.Row("load", fmt.Sprintf("cpu=%.0f%% inflight=%.1f queue=%d qps=%.1f", l.CPU*100, l.InFlight, l.Queue, l.QPS))
+			t.Row("adaptive weight", fmt.Sprintf("%.2f", lb.EffectiveWeight(rep.Instance, time.Now())))
+		}
+	})
+}
+
+func runLookup(s *shell, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: lookup <service>")
+	}
+	insts, err := s.lookup(args[0])
+	if err != nil {
+		return err
+	}
+	if len(insts) == 0 {
+		fmt.Printf("no instances for %q\n", args[0])
+		return nil
+	}
+	printInstances(insts)
+	return nil
+}
+
+func runRegister(s *shell, args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("usage: register <service> <id> <addr> [weight] [key=value...]")
+	}
+	inst := common.Instance{ID: args[1], Addr: args[2], Weight: 1, Meta: map[string]string{"kind": args[0]}}
+	rest := args[3:]
+	if len(rest) > 0 && !strings.Contains(rest[0], "=") {
+		w, err := strconv.Atoi(rest[0])
+		if err != nil || w < 1 {
+			return fmt.Errorf("invalid weight %q", rest[0])
+		}
+		inst.Weight, rest = w, rest[1:]
+	}
+	for _, kv := range rest {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("invalid metadata %q (want key=value)", kv)
+		}
+		inst.Meta[k] = v
+	}
+	var rep common.RegisterReply
+	if err := s.reg.Call("Registry.Register", &common.RegisterArgs{Service: args[0], Instance: inst}, &rep); err != nil {
+		return fmt.Errorf("register: %w", err)
+	}
+	fmt.Printf("registered %s/%s at %s (ok=%v)\n", args[0], inst.ID, inst.Addr, rep.OK)
+	return s.refreshServices()
+}
+
+func runDeregister(s *shell, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: deregister <service> <id>")
+	}
+	var rep common.DeregisterReply
+	if err := s.reg.Call("Registry.Deregister", &common.DeregisterArgs{Service: args[0], ID: args[1]}, &rep); err != nil {
+		return fmt.Errorf("deregister: %w", err)
+	}
+	fmt.Printf("deregister %s/%s: ok=%v\n", args[0], args[1], rep.OK)
+	return s.refreshServices()
+}
+
+func runEcho(s *shell, args []string) error {
+	inst, err := s.pick("echo")
+	if err != nil {
+		return err
+	}
+	var rep common.EchoReply
+	if err := s.call("echo", inst, "Echo.Echo", &common.EchoArgs{Msg: strings.Join(args, " ")}, &rep); err != nil {
+		return err
+	}
+	fmt.Printf("%s (from %s)\n", rep.Msg, rep.From)
+	return nil
+}
+
+func runMath(s *shell, args []string) error {
+	if len(args) != 3 || args[0] != "add" {
+		return fmt.Errorf("usage: math add <a> <b>")
+	}
+	a, errA := strconv.Atoi(args[1])
+	b, errB := strconv.Atoi(args[2])
+	if errA != nil || errB != nil {
+		return fmt.Errorf("math add: operands must be integers")
+	}
+	inst, err := s.pick("math")
+	if err != nil {
+		return err
+	}
+	var rep common.AddReply
+	if err := s.call("math", inst, "Math.Add", &common.AddArgs{A: a, B: b}, &rep); err != nil {
+		return err
+	}
+	fmt.Printf("%d (from %s)\n", rep.Sum, rep.From)
+	return nil
+}
+
+func runKV(s *shell, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: kv get|put|delete <key> [value]")
+	}
+	op, key := args[0], args[1]
+	switch {
+	case op == "get" && len(args) == 2:
+		rep, err := s.kvCall(key, "KV.Get", &common.GetArgs{Key: key},
+			func() any { return &common.GetReply{} },
+			func(r any) string { return r.(*common.GetReply).RedirectTo })
+		if err != nil {
+			return err
+		}
+		g := rep.(*common.GetReply)
+		if !g.Found {
+			fmt.Printf("%s not found (from %s)\n", key, g.From)
+			return nil
+		}
+		fmt.Printf("%s = %s (version %d, from %s)\n", key, g.Value, g.Version, g.From)
+	case op == "put" && len(args) >= 3:
+		value := strings.Join(args[2:], " ")
+		rep, err := s.kvCall(key, "KV.Put", &common.PutArgs{Key: key, Value: value},
+			func() any { return &common.PutReply{} },
+			func(r any) string { return r.(*common.PutReply).RedirectTo })
+		if err != nil {
+			return err
+		}
+		p := rep.(*common.PutReply)
+		if !p.OK {
+			return fmt.Errorf("put %s failed (from %s)", key, p.From)
+		}
+		fmt.Printf("ok, %s version %d (from %s)\n", key, p.Version, p.From)
+	case op == "delete" && len(args) == 2:
+		rep, err := s.kvCall(key, "KV.Delete", &common.DeleteArgs{Key: key},
+			func() any { return &common.DeleteReply{} },
+			func(r any) string { return r.(*common.DeleteReply).RedirectTo })
+		if err != nil {
+			return err
+		}
+		d := rep.(*common.DeleteReply)
+		if !d.OK {
+			return fmt.Errorf("delete %s failed (from %s)", key, d.From)
+		}
+		fmt.Printf("deleted=%v (from %s)\n", d.Deleted, d.From)
+	default:
+		return fmt.Errorf("usage: kv get|put|delete <key> [value]")
+	}
+	return nil
+}
+
+func runCall(s *shell, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: call <Service.Method> [json args]")
+	}
+	method := args[0]
+	req, _, err := common.NewMethodValues(method)
+	if err != nil {
+		return err
+	}
+	if raw := strings.Join(args[1:], " "); raw != "" {
+		dec := json.NewDecoder(strings.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(req); err != nil {
+			return fmt.Errorf("invalid args for %s: %w", method, err)
+		}
+	}
+	_, reply, _ := common.NewMethodValues(method)
+	service := common.MethodService(method)
+	if service == "registry" {
+		if err := s.reg.Call(method, req, reply); err != nil {
+			return fmt.Errorf("%s: %w", method, err)
+		}
+	} else {
+		inst, err := s.pick(service)
+		if err != nil {
+			return err
+		}
+		if err := s.call(service, inst, method, req, reply); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(reply); err != nil {
+		return err
+	}
+	fmt.Print(buf.String())
+	return nil
+}
+
+func runAlgo(s *shell, args []string) error {
+	switch len(args) {
+	case 0:
+		fmt.Println(s.algo)
+		return nil
+	case 1:
+		if _, err := lb.New(args[0], nil); err != nil {
+			return err
+		}
+		// i picker ripartono da zero con il nuovo algoritmo
+		s.algo = args[0]
+		s.pickers = map[string]lb.Picker{}
+		fmt.Printf("LB algorithm: %s\n", s.algo)
+		return nil
+	}
+	return fmt.Errorf("usage: algo [random|rr|wrr|adaptive]")
+}
+
+func runStats(s *shell, args []string) error {
+	switch {
+	case len(args) == 0:
+		s.printStats()
+	case len(args) == 1 && args[0] == "reset":
+		s.stats = map[string]*instStats{}
+		fmt.Println("stats cleared")
+	default:
+		return fmt.Errorf("usage: stats [reset]")
+	}
+	return nil
+}
+
+func printInstances(insts []common.Instance) {
+	t := cliout.NewTable(os.Stdout, "id", "addr", "weight", "meta")
+	for _, inst := range insts {
+		t.Row(inst.ID, inst.Addr, inst.Weight, cliout.Pairs(inst.Meta))
+	}
+	t.Flush()
+}
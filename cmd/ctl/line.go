@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const maxHistory = 500
+
+// errInterrupted is returned by readLine on Ctrl-C: the line is discarded.
+var errInterrupted = errors.New("interrupted")
+
+// lineEditor reads commands from stdin. On a terminal it edits the line in raw
+// mode (cursor keys, history with up/down, tab completion); otherwise (pipe,
+// file, non-linux) it reads plain lines, so scripts can be fed to ctl.
+type lineEditor struct {
+	in       *bufio.Reader
+	out      io.Writer
+	fd       int
+	history  []string
+	histFile string // "" = history non salvata
+	complete func(words []string) []string
+}
+
+func newLineEditor(histFile string, complete func(words []string) []string) *lineEditor {
+	e := &lineEditor{in: bufio.NewReader(os.Stdin), out: os.Stdout, fd: int(os.Stdin.Fd()),
+		histFile: histFile, complete: complete}
+	e.loadHistory()
+	return e
+}
+
+// interactive reports whether stdin is a terminal the editor can drive.
+func (e *lineEditor) interactive() bool {
+	restore, err := makeRaw(e.fd)
+	if err != nil {
+		return false
+	}
+	restore()
+	return true
+}
+
+// readLine returns the next line without the trailing newline (io.EOF at the end).
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	restore, err := makeRaw(e.fd)
+	if err != nil {
+		line, err := e.in.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	defer restore()
+
+	ed := editState{prompt: prompt, out: e.out, hist: len(e.history)}
+	ed.redraw()
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\n")
+			line := string(ed.buf)
+			e.addHistory(line)
+			return line, nil
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\n")
+			return "", errInterrupted
+		case 4: // Ctrl-D: EOF su riga vuota, altrimenti cancella sotto il cursore
+			if len(ed.buf) == 0 {
+				fmt.Fprint(e.out, "\n")
+				return "", io.EOF
+			}
+			ed.deleteAt(ed.pos)
+		case 127, 8: // backspace
+			if ed.pos > 0 {
+				ed.pos--
+				ed.deleteAt(ed.pos)
+			}
+		case 1: // Ctrl-A
+			ed.pos = 0
+		case 5: // Ctrl-E
+			ed.pos = len(ed.buf)
+		case 11: // Ctrl-K
+			ed.buf = ed.buf[:ed.pos]
+		case 21: // Ctrl-U
+			ed.buf = append([]rune(nil), ed.buf[ed.pos:]...)
+			ed.pos = 0
+		case 23: // Ctrl-W
+			ed.deleteWord()
+		case 12: // Ctrl-L
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+		case '\t':
+			e.completeLine(&ed)
+		case 27:
+			e.escape(&ed)
+		default:
+			if r >= ' ' {
+				ed.insert(r)
+			}
+		}
+		ed.redraw()
+	}
+}
+
+// escape handles the ANSI sequences of arrows, Home/End and Delete.
+func (e *lineEditor) escape(ed *editState) {
+	if b, err := e.in.ReadByte(); err != nil || (b != '[' && b != 'O') {
+		return
+	}
+	b, err := e.in.ReadByte()
+	if err != nil {
+		return
+	}
+	switch b {
+	case 'A':
+		e.historyMove(ed, -1)
+	case 'B':
+		e.historyMove(ed, 1)
+	case 'C':
+		if ed.pos < len(ed.buf) {
+			ed.pos++
+		}
+	case 'D':
+		if ed.pos > 0 {
+			ed.pos--
+		}
+	case 'H':
+		ed.pos = 0
+	case 'F':
+		ed.pos = len(ed.buf)
+	case '1', '3', '4', '7', '8': // ESC [ n ~
+		if t, err := e.in.ReadByte(); err != nil || t != '~' {
+			return
+		}
+		switch b {
+		case '3':
+			ed.deleteAt(ed.pos)
+		case '1', '7':
+			ed.pos = 0
+		case '4', '8':
+			ed.pos = len(ed.buf)
+		}
+	}
+}
+
+// historyMove replaces the line with an older (dir -1) or newer (dir 1) entry;
+// the line being typed is kept and restored past the newest entry.
+func (e *lineEditor) historyMove(ed *editState, dir int) {
+	next := ed.hist + dir
+	if next < 0 || next > len(e.history) {
+		return
+	}
+	if ed.hist == len(e.history) {
+		ed.draft = string(ed.buf)
+	}
+	ed.hist = next
+	line := ed.draft
+	if next < len(e.history) {
+		line = e.history[next]
+	}
+	ed.buf = []rune(line)
+	ed.pos = len(ed.buf)
+}
+
+// completeLine completes the word before the cursor: a single candidate is
+// inserted, several are extended to their common prefix or else listed.
+func (e *lineEditor) completeLine(ed *editState) {
+	if e.complete == nil {
+		return
+	}
+	head := string(ed.buf[:ed.pos])
+	words := strings.Fields(head)
+	if head == "" || strings.HasSuffix(head, " ") {
+		words = append(words, "")
+	}
+	prefix := words[len(words)-1]
+	var matches []string
+	for _, c := range e.complete(words) {
+		if strings.HasPrefix(c, prefix) {
+			matches = append(matches, c)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return
+	case 1:
+		ed.insertString(strings.TrimPrefix(matches[0], prefix) + " ")
+		return
+	}
+	if common := commonPrefix(matches); len(common) > len(prefix) {
+		ed.insertString(strings.TrimPrefix(common, prefix))
+		return
+	}
+	fmt.Fprintf(e.out, "\n%s\n", strings.Join(matches, "  "))
+}
+
+func commonPrefix(words []string) string {
+	p := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(w, p) {
+			p = p[:len(p)-1]
+		}
+	}
+	return p
+}
+
+func (e *lineEditor) addHistory(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > maxHistory {
+		e.history = e.history[len(e.history)-maxHistory:]
+	}
+	if e.histFile == "" {
+		return
+	}
+	f, err := os.OpenFile(e.histFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
+
+func (e *lineEditor) loadHistory() {
+	if e.histFile == "" {
+		return
+	}
+	data, err := os.ReadFile(e.histFile)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			e.history = append(e.history, line)
+		}
+	}
+	if len(e.history) > maxHistory {
+		e.history = e.history[len(e.history)-maxHistory:]
+	}
+}
+
+// editState is the line being edited.
+type editState struct {
+	prompt string
+	out    io.Writer
+	buf    []rune
+	pos    int
+	hist   int    // indice in history (len = riga nuova)
+	draft  string // riga in scrittura mentre si scorre la history
+}
+
+func (ed *editState) insert(r rune) {
+	ed.buf = append(ed.buf, 0)
+	copy(ed.buf[ed.pos+1:], ed.buf[ed.pos:])
+	ed.buf[ed.pos] = r
+	ed.pos++
+}
+
+func (ed *editState) insertString(s string) {
+	for _, r := range s {
+		ed.insert(r)
+	}
+}
+
+func (ed *editState) deleteAt(i int) {
+	if i < len(ed.buf) {
+		ed.buf = append(ed.buf[:i], ed.buf[i+1:]...)
+	}
+}
+
+func (ed *editState) deleteWord() {
+	i := ed.pos
+	for i > 0 && ed.buf[i-1] == ' ' {
+		i--
+	}
+	for i > 0 && ed.buf[i-1] != ' ' {
+		i--
+	}
+	ed.buf = append(ed.buf[:i], ed.buf[ed.pos:]...)
+	ed.pos = i
+}
+
+func (ed *editState) redraw() {
+	fmt.Fprintf(ed.out, "\r%s%s\x1b[K", ed.prompt, string(ed.buf))
+	if back := len(ed.buf) - ed.pos; back > 0 {
+		fmt.Fprintf(ed.out, "\x1b[%dD", back)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"example.com/service-registry-lb/internal/connpool"
+	"example.com/service-registry-lb/internal/lb"
+	"example.com/service-registry-lb/internal/rpcctx"
+)
+
+func main() {
+	registryAddr := flag.String("registry", "localhost:9000", "registry address host:port")
+	algo := flag.String("algo", "rr", "initial load balancing algorithm: random|rr|wrr|adaptive")
+	history := flag.String("history", defaultHistory(), "file keeping the command history (empty = none)")
+	timeout := flag.Duration("timeout", 0, "deadline of every request to the instances (0 = per-method default)")
+	flag.Parse()
+
+	if _, err := lb.New(*algo, nil); err != nil {
+		log.Fatalf("%v", err)
+	}
+	regConn, err := rpcctx.Dial(*registryAddr)
+	if err != nil {
+		log.Fatalf("dial registry: %v", err)
+	}
+	reg := &rpcctx.Client{Client: regConn}
+	conns := connpool.New(connpool.Options{MaxIdle: 2, Timeout: *timeout})
+	defer conns.Close()
+
+	sh := newShell(reg, conns, *algo)
+	if err := sh.refreshServices(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	// un comando sulla riga di comando (es. ctl catalog json): lo eseguo ed esco
+	if flag.NArg() > 0 {
+		if _, err := sh.exec(strings.Join(flag.Args(), " ")); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
+
+	ed := newLineEditor(*history, sh.complete)
+	interactive := ed.interactive()
+	if interactive {
+		fmt.Printf("Connected to registry %s, LB algorithm %s. Type help for the commands, Tab completes.\n", *registryAddr, *algo)
+	}
+
+	prompt := ""
+	if interactive {
+		prompt = "ctl> "
+	}
+	for {
+		line, err := ed.readLine(prompt)
+		if errors.Is(err, errInterrupted) {
+			continue
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Fatalf("read: %v", err)
+		}
+		quit, err := sh.exec(line)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+func defaultHistory() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ctl_history")
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"example.com/service-registry-lb/common"
+	"example.com/service-registry-lb/internal/cliout"
+	"example.com/service-registry-lb/internal/connpool"
+	"example.com/service-registry-lb/internal/lb"
+	"example.com/service-registry-lb/internal/rpcctx"
+)
+
+// shell keeps the state of an interactive session: one picker per service
+// (per replica group for kv), rebuilt when the algorithm changes, and the
+// per-instance counters shown by "stats".
+type shell struct {
+	reg      *rpcctx.Client
+	conns    *connpool.Pool
+	algo     string
+	pickers  map[string]lb.Picker
+	known    map[string][]common.Instance // ultima lookup per servizio
+	services []string                     // nomi del catalogo, per il completamento
+	stats    map[string]*instStats        // chiave service/id
+}
+
+type instStats struct {
+	service, id, addr string
+	requests, errors  int
+	busy              time.Duration
+	last              time.Time
+}
+
+func newShell(reg *rpcctx.Client, conns *connpool.Pool, algo string) *shell {
+	return &shell{reg: reg, conns: conns, algo: algo, pickers: map[string]lb.Picker{},
+		known: map[string][]common.Instance{}, stats: map[string]*instStats{}}
+}
+
+// exec runs one command line; quit reports whether the session is over.
+func (s *shell) exec(line string) (quit bool, err error) {
+	words := strings.Fields(line)
+	if len(words) == 0 || strings.HasPrefix(words[0], "#") {
+		return false, nil
+	}
+	if words[0] == "quit" || words[0] == "exit" {
+		return true, nil
+	}
+	cmd, ok := commandByName(words[0])
+	if !ok {
+		return false, fmt.Errorf("unknown command %q (try help)", words[0])
+	}
+	return false, cmd.run(s, words[1:])
+}
+
+// complete returns the candidates for the last of words (the one being typed).
+func (s *shell) complete(words []string) []string {
+	if len(words) == 1 {
+		return commandNames()
+	}
+	cmd, ok := commandByName(words[0])
+	if !ok || cmd.complete == nil {
+		return nil
+	}
+	return cmd.complete(s, words[1:len(words)-1])
+}
+
+// -------- registry --------
+
+func (s *shell) lookup(service string) ([]common.Instance, error) {
+	var rep common.LookupReply
+	if err := s.reg.Call("Registry.Lookup", &common.LookupArgs{Service: service}, &rep); err != nil {
+		return nil, fmt.Errorf("lookup %s: %w", service, err)
+	}
+	if len(rep.Instances) == 0 {
+		delete(s.known, service)
+	} else {
+		s.known[service] = rep.Instances
+	}
+	return rep.Instances, nil
+}
+
+// refreshServices re-reads the service names used by the completion.
+func (s *shell) refreshServices() error {
+	cat, err := s.catalog()
+	if err != nil {
+		return err
+	}
+	s.services = s.services[:0]
+	for _, svc := range cat {
+		s.services = append(s.services, svc.Name)
+	}
+	return nil
+}
+
+func (s *shell) catalog() ([]common.ServiceInfo, error) {
+	var rep common.ListServicesReply
+	if err := s.reg.Call("Registry.ListServices", &common.ListServicesArgs{}, &rep); err != nil {
+		return nil, fmt.Errorf("list services: %w", err)
+	}
+	return rep.Services, nil
+}
+
+// -------- chiamate alle istanze --------
+
+// pick looks the service up again (so new or vanished instances are seen) and
+// updates its picker, which keeps its state across calls.
+func (s *shell) pick(service string) (common.Instance, error) {
+	insts, err := s.lookup(service)
+	if err != nil {
+		return common.Instance{}, err
+	}
+	if len(insts) == 0 {
+		return common.Instance{}, fmt.Errorf("no instances for service %q", service)
+	}
+	return s.pickFrom(service, insts)
+}
+
+func (s *shell) pickFrom(key string, insts []common.Instance) (common.Instance, error) {
+	p, ok := s.pickers[key]
+	if ok {
+		p.Update(insts)
+	} else {
+		var err error
+		if p, err = lb.New(s.algo, insts); err != nil {
+			return common.Instance{}, err
+		}
+		s.pickers[key] = p
+	}
+	return p.Pick()
+}
+
+// call sends method to inst and records the outcome in the per-instance stats.
+func (s *shell) call(service string, inst common.Instance, method string, args, reply any) error {
+	start := time.Now()
+	err := s.conns.Call(inst.Addr, method, args, reply)
+	st := s.stats[service+"/"+inst.ID]
+	if st == nil {
+		st = &instStats{service: service, id: inst.ID}
+		s.stats[service+"/"+inst.ID] = st
+	}
+	st.addr = inst.Addr
+	st.requests++
+	st.busy += time.Since(start)
+	st.last = time.Now()
+	if err != nil {
+		st.errors++
+		return fmt.Errorf("%s on %s: %w", method, inst.ID, err)
+	}
+	return nil
+}
+
+// instanceAt resolves a redirect address to the cached instance (if any).
+func (s *shell) instanceAt(service, addr string) common.Instance {
+	for _, inst := range s.known[service] {
+		if inst.Addr == addr {
+			return inst
+		}
+	}
+	return common.Instance{ID: addr, Addr: addr}
+}
+
+// -------- kv --------
+
+// kvPick routes key to the replica group owning its shard.
+func (s *shell) kvPick(key string) (common.Instance, error) {
+	insts, err := s.lookup("kv")
+	if err != nil {
+		return common.Instance{}, err
+	}
+	byGroup := map[string][]common.Instance{}
+	for _, inst := range insts {
+		g := common.GroupOfInstance(inst)
+		byGroup[g] = append(byGroup[g], inst)
+	}
+	var smap common.GetShardMapReply
+	if err := s.reg.Call("Registry.GetShardMap", &common.GetShardMapArgs{Service: "kv"}, &smap); err != nil {
+		return common.Instance{}, fmt.Errorf("get shard map: %w", err)
+	}
+	group := smap.Map.GroupOf(key)
+	if group == "" && len(byGroup) == 1 {
+		for g := range byGroup {
+			group = g
+		}
+	}
+	if len(byGroup[group]) == 0 {
+		return common.Instance{}, fmt.Errorf("no kv instances for the group of %q (%q)", key, group)
+	}
+	return s.pickFrom("kv/"+group, byGroup[group])
+}
+
+// kvCall sends a kv request routed by key, follows the redirect to the primary
+// (redirect returns it, "" if none) and retries while a shard is moving or the
+// cached routing is stale (kvPick re-reads the shard map at every attempt).
+func (s *shell) kvCall(key, method string, args any, newReply func() any, redirect func(any) string) (any, error) {
+	var err error
+	for attempt := 0; attempt < common.ShardRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(common.ShardRetryBackoff)
+		}
+		var inst common.Instance
+		if inst, err = s.kvPick(key); err != nil {
+			return nil, err
+		}
+		reply := newReply()
+		if err = s.call("kv", inst, method, args, reply); err == nil {
+			if to := redirect(reply); to != "" {
+				reply = newReply()
+				err = s.call("kv", s.instanceAt("kv", to), method, args, reply)
+			}
+		}
+		if err == nil {
+			return reply, nil
+		}
+		if !common.IsShardRetryable(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// -------- stats --------
+
+func (s *shell) printStats() {
+	if len(s.stats) == 0 {
+		fmt.Println("no requests yet")
+		return
+	}
+	keys := make([]string, 0, len(s.stats))
+	for k := range s.stats {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	t := cliout.NewTable(os.Stdout, "service", "instance", "addr", "requests", "errors", "avg", "last")
+	for _, k := range keys {
+		st := s.stats[k]
+		avg := (st.busy / time.Duration(st.requests)).Round(time.Microsecond)
+		t.Row(st.service, st.id, st.addr, st.requests, st.errors, avg, time.Since(st.last).Round(time.Second).String()+" ago")
+	}
+	t.Flush()
+	cs := s.conns.Stats()
+	fmt.Printf("pool: dials=%d reuses=%d evictions=%d\n", cs.Dials, cs.Reuses, cs.Evictions)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"example.com/service-registry-lb/common"
+)
+
+// The primary of a replica group is whoever holds the registry lease
+// "kv/<group>/primary"; its fencing token becomes the group's epoch.
+func leaseName(group string) string {
+	return "kv/" + group + "/primary"
+}
+
+// leaseOwner is unique per process: a restarted instance (empty state) never
+// inherits the lease of its previous incarnation.
+func leaseOwner(id string) string {
+	return fmt.Sprintf("%s/%d", id, time.Now().UnixNano())
+}
+
+// holderID strips the process suffix added by leaseOwner.
+func holderID(owner string) string {
+	id, _, _ := strings.Cut(owner, "/")
+	return id
+}
+
+// roleLoop keeps the lease while primary, otherwise follows the holder as backup
+// and campaigns as soon as the lease is free. An instance that is not the
+// preferred one (PRIMARY_ID hint) waits one lease period before its first campaign.
+func (s *KVService) roleLoop(owner, pub string, ttl time.Duration, preferred string) {
+	campaignAt := time.Now()
+	if preferred != "" && preferred != s.id {
+		campaignAt = campaignAt.Add(ttl)
+	}
+	for {
+		_ = s.loadShardMap()
+		switch {
+		case s.holdsLease():
+			s.renewLease(owner, ttl)
+		case time.Now().Before(campaignAt):
+			s.followHolder()
+		default:
+			s.campaign(owner, pub, ttl)
+		}
+		if s.isPrimary() {
+			s.commitPending()
+		}
+		time.Sleep(ttl / 3)
+	}
+}
+
+// holdsLease reports whether this instance believes it is primary (even with an expired lease).
+func (s *KVService) holdsLease() bool {
+	s.roleMu.RLock()
+	defer s.roleMu.RUnlock()
+	return s.role == "primary"
+}
+
+func (s *KVService) renewLease(owner string, ttl time.Duration) {
+	s.roleMu.RLock()
+	token := s.leaseToken
+	s.roleMu.RUnlock()
+
+	start := time.Now()
+	var rep common.RenewLockReply
+	err := s.registry.CallRegistry("Registry.RenewLock", &common.RenewLockArgs{Name: leaseName(s.group), Owner: owner, Token: token, TTL: ttl}, &rep)
+	if err != nil {
+		// registry irraggiungibile: resto primary solo fino alla scadenza locale del lease
+		if !s.isPrimary() {
+			s.loseLease(fmt.Sprintf("lease expired while registry unreachable: %v", err))
+		}
+		return
+	}
+	if !rep.OK {
+		s.loseLease(fmt.Sprintf("lease lost (holder=%s token=%d)", rep.Holder, rep.Token))
+		return
+	}
+	s.roleMu.Lock()
+	s.leaseUntil = start.Add(ttl)
+	s.roleMu.Unlock()
+}
+
+func (s *KVService) loseLease(why string) {
+	s.roleMu.Lock()
+	s.role = "backup"
+	s.primary = common.Instance{}
+	s.leaseUntil = time.Time{}
+	s.roleMu.Unlock()
+	log.Printf("[kv %s] role => backup: %s", s.id, why)
+}
+
+func (s *KVService) campaign(owner, pub string, ttl time.Duration) {
+	start := time.Now()
+	var rep common.AcquireLockReply
+	err := s.registry.CallRegistry("Registry.AcquireLock", &common.AcquireLockArgs{
+		Name: leaseName(s.group), Owner: owner, Value: pub, TTL: ttl, MinToken: s.currentEpoch(),
+	}, &rep)
+	if err != nil {
+		return
+	}
+	if !rep.Acquired {
+		s.follow(rep.Holder, rep.Value, rep.Token)
+		return
+	}
+
+	// il token del lease è la nuova epoch: i backup scarteranno il vecchio primary
+	s.mu.Lock()
+	if rep.Token > s.epoch {
+		s.epoch = rep.Token
+	}
+	epoch := s.epoch
+	s.termStart = s.lastApply + 1 // il primo commit dell'epoch conferma lo stato ereditato
+	s.mu.Unlock()
+
+	s.roleMu.Lock()
+	s.role = "primary"
+	s.primary = common.Instance{ID: s.id, Addr: pub}
+	s.leaseToken = rep.Token
+	s.leaseUntil = start.Add(ttl)
+	s.roleMu.Unlock()
+	log.Printf("[kv %s] role => primary (lease %s, epoch=%d)", s.id, leaseName(s.group), epoch)
+}
+
+// followHolder reads the lease without competing (startup grace period).
+func (s *KVService) followHolder() {
+	var rep common.GetLockReply
+	if err := s.registry.CallRegistry("Registry.GetLock", &common.GetLockArgs{Name: leaseName(s.group)}, &rep); err != nil || !rep.Held {
+		return
+	}
+	s.follow(rep.Holder, rep.Value, rep.Token)
+}
+
+// follow makes this instance a backup of the lease holder. A snapshot is taken
+// only when the replication stream cannot be trusted: never synced, a gap
+// (resync) or a new primary epoch (token) not seen yet through KV.Apply.
+func (s *KVService) follow(holder, addr string, token int64) {
+	if holder == "" || addr == "" {
+		return
+	}
+	p := common.Instance{ID: holderID(holder), Addr: addr}
+	s.roleMu.Lock()
+	changed := s.primary.ID != p.ID || s.primary.Addr != p.Addr
+	s.role = "backup"
+	s.primary = p
+	s.roleMu.Unlock()
+	if changed {
+		log.Printf("[kv %s] role => backup (primary=%s@%s)", s.id, p.ID, p.Addr)
+	}
+	s.mu.RLock()
+	need := s.resync || s.lastApply == 0 || token > s.epoch
+	s.mu.RUnlock()
+	if need {
+		_ = bootstrapFromPrimary(s, addr)
+	}
+}
+
+// releaseLease hands the lease over on shutdown, so a backup does not have to wait for it to expire.
+func (s *KVService) releaseLease(owner string) {
+	if !s.holdsLease() {
+		return
+	}
+	s.roleMu.RLock()
+	token := s.leaseToken
+	s.roleMu.RUnlock()
+	s.loseLease("shutting down")
+	var rep common.ReleaseLockReply
+	_ = s.registry.CallRegistry("Registry.ReleaseLock", &common.ReleaseLockArgs{Name: leaseName(s.group), Owner: owner, Token: token}, &rep)
+}
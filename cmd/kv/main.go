@@ -0,0 +1,1006 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"example.com/service-registry-lb/common"
+	"example.com/service-registry-lb/internal/discovery"
+	"example.com/service-registry-lb/internal/kvstore"
+	"example.com/service-registry-lb/internal/rpcctx"
+	"example.com/service-registry-lb/internal/servicekit"
+	"example.com/service-registry-lb/internal/util"
+)
+
+type KVService struct {
+	id       string
+	group    string // replica group: primary/backup e shard sono per gruppo
+	registry *discovery.Client
+
+	mu        sync.RWMutex
+	store     *kvstore.Store // ordinato per chiave (Scan/List)
+	seq       int64
+	lastApply int64
+	// committed is the primary's highest seq acked by every backup: lastApply may be
+	// ahead with writes applied locally whose replication failed. pending maps the
+	// keys of those writes to their seq; termStart is lastApply at promotion, since
+	// the state inherited from the previous primary is confirmed only by the first
+	// commit of the new epoch.
+	committed int64
+	pending   map[string]int64
+	termStart int64
+	epoch     int64 // fencing token: cresce ad ogni cambio di primary
+	resync    bool  // epoch nuova con buco di sequenza: serve uno snapshot
+	changes   *changeLog
+	frozen    map[int]bool // shard in uscita: scritture sospese fino a DropShard (replicato ai backup)
+	// maxVersion is the highest key version applied here (imports included): new
+	// versions start above it, so a key deleted and created again never gets back
+	// a version a stale CompareAndSwap could still hold.
+	maxVersion int64
+
+	shardMu     sync.RWMutex
+	shardMap    common.ShardMap
+	mapLoadedAt time.Time
+
+	roleMu     sync.RWMutex
+	role       string // "primary" | "backup"
+	primary    common.Instance
+	leaseToken int64     // token del lease da primary (= epoch)
+	leaseUntil time.Time // scadenza locale del lease: oltre non accetto scritture
+}
+
+// isPrimary is true only while the leader lease is valid by the local clock:
+// the registry grants it to someone else only after it expired for us too.
+func (s *KVService) isPrimary() bool {
+	s.roleMu.RLock()
+	defer s.roleMu.RUnlock()
+	return s.role == "primary" && time.Now().Before(s.leaseUntil)
+}
+func (s *KVService) primaryAddr() string {
+	s.roleMu.RLock()
+	defer s.roleMu.RUnlock()
+	return s.primary.Addr
+}
+
+// currentEpoch returns the highest primary epoch seen by this instance.
+func (s *KVService) currentEpoch() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.epoch
+}
+
+// currentResync reports whether this replica missed a batch and needs a snapshot.
+func (s *KVService) currentResync() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.resync
+}
+
+// stepDown demotes a primary that discovered a newer epoch elsewhere.
+// The real primary address is filled in by the role loop; the lease expires on its own.
+func (s *KVService) stepDown(epoch int64) {
+	s.mu.Lock()
+	if epoch > s.epoch {
+		s.epoch = epoch
+	}
+	s.mu.Unlock()
+
+	s.roleMu.Lock()
+	defer s.roleMu.Unlock()
+	if s.role == "primary" {
+		log.Printf("[kv %s] fenced by epoch %d: stepping down", s.id, epoch)
+		s.role = "backup"
+		s.primary = common.Instance{}
+		s.leaseUntil = time.Time{}
+	}
+}
+
+// -------- RPC: Get (su primary e backup) --------
+func (s *KVService) Get(args *common.GetArgs, reply *common.GetReply) error {
+	if args == nil {
+		args = &common.GetArgs{}
+	}
+	if err := s.checkOwner(args.Key); err != nil {
+		return err
+	}
+	reply.From = s.id
+	primary := s.isPrimary()
+	switch args.Consistency {
+	case "", common.ReadAny:
+	case common.ReadBounded, common.ReadLinearizable:
+		// il primary legge solo scritture confermate; un backup si confronta con il suo read index
+		if !primary {
+			ok, err := s.catchUp(args)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				reply.RedirectTo = s.primaryAddr()
+				return nil
+			}
+		}
+	default:
+		return fmt.Errorf("unknown consistency %q", args.Consistency)
+	}
+	// read-your-writes: un backup aspetta brevemente la replica della scrittura della sessione
+	minSeq, err := s.sessionSeq(args, primary)
+	if err != nil {
+		return err
+	}
+	if minSeq < 0 || minSeq > 0 && !primary && !s.waitApplied(minSeq, readWait) {
+		reply.RedirectTo = s.primaryAddr()
+		return nil
+	}
+
+	var (
+		e   common.KVEntry
+		ok  bool
+		seq int64
+	)
+	if primary && (args.Consistency == common.ReadBounded || args.Consistency == common.ReadLinearizable || minSeq > 0) {
+		if e, ok, seq, err = s.readCommitted(args.Key, minSeq); err != nil {
+			return err
+		}
+	} else {
+		s.mu.RLock()
+		e, ok = s.liveLocked(args.Key)
+		seq = s.lastApply
+		if primary {
+			seq = s.committed
+		}
+		s.mu.RUnlock()
+	}
+	reply.Epoch = s.currentEpoch()
+
+	reply.Found = ok
+	reply.Value = e.Value
+	reply.Version = e.Version
+	reply.Seq = seq
+	return nil
+}
+
+// readWait bounds how long a backup waits to catch up before redirecting a read.
+const readWait = 500 * time.Millisecond
+
+// catchUp checks a backup against the primary's read index. It reports false
+// when the replica cannot serve the read and the client should go to the primary.
+func (s *KVService) catchUp(args *common.GetArgs) (bool, error) {
+	idx, err := s.primaryReadIndex()
+	if err != nil {
+		return false, fmt.Errorf("read index: %w", err)
+	}
+	if args.Consistency == common.ReadBounded {
+		s.mu.RLock()
+		lag := idx - s.lastApply
+		s.mu.RUnlock()
+		return lag <= args.MaxLag, nil
+	}
+	return s.waitApplied(idx, readWait), nil
+}
+
+// sessionSeq returns the seq this replica must reach to honour the session token
+// of args: 0 when a token from an older epoch is satisfied by the inherited state,
+// -1 when a backup has not seen the token's epoch yet (redirect to the primary).
+// A primary behind the token's epoch has been replaced and cannot serve the read.
+func (s *KVService) sessionSeq(args *common.GetArgs, primary bool) (int64, error) {
+	epoch := s.currentEpoch()
+	switch {
+	case args.MinSeq <= 0 || args.MinEpoch == 0 || args.MinEpoch == epoch:
+		return max(args.MinSeq, 0), nil
+	case args.MinEpoch < epoch:
+		return 0, nil
+	case primary:
+		return 0, fmt.Errorf("stale primary: session epoch %d is ahead of epoch %d", args.MinEpoch, epoch)
+	default:
+		return -1, nil
+	}
+}
+
+// readCommitted reads key on the primary once the last write to it (and the
+// session's minSeq) is replicated, waiting up to readWait. It returns the
+// committed seq the read reflects.
+func (s *KVService) readCommitted(key string, minSeq int64) (common.KVEntry, bool, int64, error) {
+	var (
+		e         common.KVEntry
+		ok        bool
+		need, seq int64
+	)
+	done := s.waitUntil(func() bool {
+		e, ok = s.liveLocked(key)
+		need = max(s.pending[key], s.termStart, minSeq)
+		seq = s.committed
+		return seq >= need
+	}, readWait)
+	if done {
+		return e, ok, seq, nil
+	}
+	if minSeq > seq {
+		return e, false, 0, fmt.Errorf("session seq %d is ahead of primary committed seq %d", minSeq, seq)
+	}
+	return e, false, 0, fmt.Errorf("key %q: write %d not replicated yet (committed %d)", key, need, seq)
+}
+
+// waitApplied blocks until this replica has applied seq, or timeout elapses.
+func (s *KVService) waitApplied(seq int64, timeout time.Duration) bool {
+	return s.waitUntil(func() bool { return s.lastApply >= seq }, timeout)
+}
+
+// waitUntil blocks until cond, evaluated under the read lock after every
+// commit, holds or timeout elapses.
+func (s *KVService) waitUntil(cond func() bool, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		s.mu.RLock()
+		ok := cond()
+		notify := s.changes.notify
+		s.mu.RUnlock()
+		if ok {
+			return true
+		}
+		select {
+		case <-notify:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+func (s *KVService) primaryReadIndex() (int64, error) {
+	addr := s.primaryAddr()
+	if addr == "" {
+		return 0, errors.New("primary unknown")
+	}
+	c, err := rpcctx.Dial(addr)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	var rep common.ReadIndexReply
+	if err := rpcctx.Call(context.Background(), c, "KV.ReadIndex", &common.ReadIndexArgs{}, &rep); err != nil {
+		return 0, err
+	}
+	if rep.Epoch < s.currentEpoch() {
+		return 0, fmt.Errorf("stale primary: epoch %d", rep.Epoch)
+	}
+	return rep.Seq, nil
+}
+
+// -------- RPC: ReadIndex (backup -> primary) --------
+func (s *KVService) ReadIndex(_ *common.ReadIndexArgs, reply *common.ReadIndexReply) error {
+	if !s.isPrimary() {
+		return errors.New("not primary")
+	}
+	// appena promosso, aspetto che il primo commit dell'epoch confermi lo stato ereditato
+	if !s.waitUntil(func() bool { return s.committed >= s.termStart }, readWait) {
+		return errors.New("primary has not committed in this epoch yet")
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	reply.Seq = s.committed
+	reply.Epoch = s.epoch
+	return nil
+}
+
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+)
+
+func scanLimit(n int) int {
+	if n <= 0 {
+		return defaultScanLimit
+	}
+	if n > maxScanLimit {
+		return maxScanLimit
+	}
+	return n
+}
+
+// scanLocked walks live keys in [start, end) resuming after cursor, and stops after limit
+// items; the returned cursor is the last visited key if more keys follow. Caller holds s.mu.
+func (s *KVService) scanLocked(start, end, cursor string, limit int, fn func(k string, e common.KVEntry)) string {
+	from := start
+	if cursor != "" && cursor >= start {
+		from = cursor + "\x00" // prima chiave strettamente maggiore del cursore
+	}
+	now := time.Now()
+	n, last, more := 0, "", false
+	s.store.Ascend(from, end, func(k string, e common.KVEntry) bool {
+		if e.Expired(now) || !s.ownsCached(k) {
+			return true
+		}
+		if n == limit {
+			more = true
+			return false
+		}
+		fn(k, e)
+		n++
+		last = k
+		return true
+	})
+	if !more {
+		return ""
+	}
+	return last
+}
+
+// -------- RPC: Scan (su primary e backup) --------
+func (s *KVService) Scan(args *common.ScanArgs, reply *common.ScanReply) error {
+	if args == nil {
+		args = &common.ScanArgs{}
+	}
+	if args.EndKey != "" && args.EndKey <= args.StartKey {
+		return errors.New("empty range: EndKey must be greater than StartKey")
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	reply.Items = []common.KVItem{}
+	reply.NextCursor = s.scanLocked(args.StartKey, args.EndKey, args.Cursor, scanLimit(args.Limit), func(k string, e common.KVEntry) {
+		reply.Items = append(reply.Items, common.KVItem{Key: k, Value: e.Value, Version: e.Version})
+	})
+	reply.From = s.id
+	return nil
+}
+
+// -------- RPC: List (su primary e backup) --------
+func (s *KVService) List(args *common.ListArgs, reply *common.ListReply) error {
+	if args == nil {
+		args = &common.ListArgs{}
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	reply.Keys = []string{}
+	reply.NextCursor = s.scanLocked(args.Prefix, kvstore.PrefixEnd(args.Prefix), args.Cursor, scanLimit(args.Limit), func(k string, _ common.KVEntry) {
+		reply.Keys = append(reply.Keys, k)
+	})
+	reply.From = s.id
+	return nil
+}
+
+// redirect fills the common fields of a write reply sent by a backup.
+func (s *KVService) redirect() (from, to string, epoch int64) {
+	return s.id, s.primaryAddr(), s.currentEpoch()
+}
+
+// -------- RPC: Put (solo primary) --------
+func (s *KVService) Put(args *common.PutArgs, reply *common.PutReply) error {
+	if args == nil {
+		args = &common.PutArgs{}
+	}
+	if args.Key == "" {
+		return errors.New("missing key")
+	}
+	if err := s.checkOwner(args.Key); err != nil {
+		return err
+	}
+
+	// Se sono backup: rifiuto e comunico il primary
+	if !s.isPrimary() {
+		reply.From, reply.RedirectTo, reply.Epoch = s.redirect()
+		return nil
+	}
+
+	ctx, cancel := rpcctx.Context(args) // la scadenza del client limita anche la replica
+	defer cancel()
+	a, _, err := s.write(ctx, func() ([]common.KVMutation, bool) {
+		return []common.KVMutation{{Op: common.KVOpPut, Key: args.Key, Value: args.Value, Version: s.nextVersionLocked(), ExpiresAt: expiresAt(args.TTL)}}, true
+	})
+	if err != nil {
+		return err
+	}
+
+	reply.OK = true
+	reply.Version = a.Ops[0].Version
+	reply.From = s.id
+	reply.Epoch = a.Epoch
+	reply.Seq = a.Seq
+	return nil
+}
+
+// -------- RPC: Delete (solo primary) --------
+func (s *KVService) Delete(args *common.DeleteArgs, reply *common.DeleteReply) error {
+	if args == nil {
+		args = &common.DeleteArgs{}
+	}
+	if args.Key == "" {
+		return errors.New("missing key")
+	}
+	if err := s.checkOwner(args.Key); err != nil {
+		return err
+	}
+	if !s.isPrimary() {
+		reply.From, reply.RedirectTo, reply.Epoch = s.redirect()
+		return nil
+	}
+
+	ctx, cancel := rpcctx.Context(args)
+	defer cancel()
+	a, done, err := s.write(ctx, func() ([]common.KVMutation, bool) {
+		if _, ok := s.liveLocked(args.Key); !ok {
+			return nil, false
+		}
+		return []common.KVMutation{{Op: common.KVOpDelete, Key: args.Key}}, true
+	})
+	if err != nil {
+		return err
+	}
+
+	reply.OK = true
+	reply.Deleted = done
+	reply.From = s.id
+	reply.Epoch = a.Epoch
+	reply.Seq = a.Seq
+	return nil
+}
+
+// -------- RPC: CompareAndSwap (solo primary) --------
+func (s *KVService) CompareAndSwap(args *common.CASArgs, reply *common.CASReply) error {
+	if args == nil {
+		args = &common.CASArgs{}
+	}
+	if args.Key == "" {
+		return errors.New("missing key")
+	}
+	if err := s.checkOwner(args.Key); err != nil {
+		return err
+	}
+	if !s.isPrimary() {
+		reply.From, reply.RedirectTo, reply.Epoch = s.redirect()
+		return nil
+	}
+
+	var current int64
+	ctx, cancel := rpcctx.Context(args)
+	defer cancel()
+	a, done, err := s.write(ctx, func() ([]common.KVMutation, bool) {
+		cur, _ := s.liveLocked(args.Key)
+		if cur.Version != args.ExpectedVersion {
+			current = cur.Version
+			return nil, false
+		}
+		return []common.KVMutation{{Op: common.KVOpPut, Key: args.Key, Value: args.Value, Version: s.nextVersionLocked(), ExpiresAt: expiresAt(args.TTL)}}, true
+	})
+	if err != nil {
+		return err
+	}
+
+	reply.OK = true
+	reply.Swapped = done
+	reply.Version = current
+	if done {
+		reply.Version = a.Ops[0].Version
+	}
+	reply.From = s.id
+	reply.Epoch = a.Epoch
+	reply.Seq = a.Seq
+	return nil
+}
+
+// -------- RPC: PutIfAbsent (solo primary) --------
+func (s *KVService) PutIfAbsent(args *common.PutArgs, reply *common.PutIfAbsentReply) error {
+	if args == nil {
+		args = &common.PutArgs{}
+	}
+	if args.Key == "" {
+		return errors.New("missing key")
+	}
+	if err := s.checkOwner(args.Key); err != nil {
+		return err
+	}
+	if !s.isPrimary() {
+		reply.From, reply.RedirectTo, reply.Epoch = s.redirect()
+		return nil
+	}
+
+	var existing common.KVEntry
+	ctx, cancel := rpcctx.Context(args)
+	defer cancel()
+	a, done, err := s.write(ctx, func() ([]common.KVMutation, bool) {
+		if cur, ok := s.liveLocked(args.Key); ok {
+			existing = cur
+			return nil, false
+		}
+		return []common.KVMutation{{Op: common.KVOpPut, Key: args.Key, Value: args.Value, Version: s.nextVersionLocked(), ExpiresAt: expiresAt(args.TTL)}}, true
+	})
+	if err != nil {
+		return err
+	}
+
+	reply.OK = true
+	reply.Stored = done
+	reply.Value = existing.Value
+	reply.Version = existing.Version
+	if done {
+		reply.Value = args.Value
+		reply.Version = a.Ops[0].Version
+	}
+	reply.From = s.id
+	reply.Epoch = a.Epoch
+	reply.Seq = a.Seq
+	return nil
+}
+
+const maxTxnOps = 128
+
+// -------- RPC: Txn (solo primary) --------
+func (s *KVService) Txn(args *common.TxnArgs, reply *common.TxnReply) error {
+	if args == nil {
+		args = &common.TxnArgs{}
+	}
+	if len(args.Ops) == 0 {
+		return errors.New("empty txn")
+	}
+	if len(args.Ops) > maxTxnOps {
+		return fmt.Errorf("too many ops in txn: %d > %d", len(args.Ops), maxTxnOps)
+	}
+	seen := make(map[string]bool, len(args.Ops))
+	for _, op := range args.Ops {
+		if op.Key == "" {
+			return errors.New("missing key in txn op")
+		}
+		if op.Op != common.KVOpPut && op.Op != common.KVOpDelete {
+			return fmt.Errorf("unknown txn op %q", op.Op)
+		}
+		if seen[op.Key] {
+			return fmt.Errorf("duplicate key %q in txn", op.Key)
+		}
+		seen[op.Key] = true
+	}
+	// una transazione non può attraversare gruppi diversi
+	keys := make([]string, 0, len(args.Ops)+len(args.Compares))
+	for _, op := range args.Ops {
+		keys = append(keys, op.Key)
+	}
+	for _, c := range args.Compares {
+		keys = append(keys, c.Key)
+	}
+	if err := s.checkOwner(keys...); err != nil {
+		return err
+	}
+	if !s.isPrimary() {
+		reply.From, reply.RedirectTo, reply.Epoch = s.redirect()
+		return nil
+	}
+
+	var conflicts []common.TxnCompare
+	ctx, cancel := rpcctx.Context(args)
+	defer cancel()
+	a, done, err := s.write(ctx, func() ([]common.KVMutation, bool) {
+		for _, c := range args.Compares {
+			if cur, _ := s.liveLocked(c.Key); cur.Version != c.Version {
+				conflicts = append(conflicts, common.TxnCompare{Key: c.Key, Version: cur.Version})
+			}
+		}
+		if len(conflicts) > 0 {
+			return nil, false
+		}
+		ops := make([]common.KVMutation, 0, len(args.Ops))
+		for _, op := range args.Ops {
+			if op.Op == common.KVOpDelete {
+				ops = append(ops, common.KVMutation{Op: common.KVOpDelete, Key: op.Key})
+				continue
+			}
+			ops = append(ops, common.KVMutation{Op: common.KVOpPut, Key: op.Key, Value: op.Value, Version: s.nextVersionLocked(), ExpiresAt: expiresAt(op.TTL)})
+		}
+		return ops, true
+	})
+	if err != nil {
+		return err
+	}
+
+	reply.OK = true
+	reply.Succeeded = done
+	reply.Conflicts = conflicts
+	if done {
+		reply.Versions = make([]int64, len(a.Ops))
+		for i, m := range a.Ops {
+			reply.Versions[i] = m.Version
+		}
+	}
+	reply.From = s.id
+	reply.Epoch = a.Epoch
+	reply.Seq = a.Seq
+	return nil
+}
+
+// write is the single write path of the primary. decide runs under the store lock and
+// returns the mutations to perform, or false if the write's condition does not hold.
+// The mutations share the next seq, are applied locally and then replicated synchronously.
+func (s *KVService) write(ctx context.Context, decide func() ([]common.KVMutation, bool)) (common.ApplyArgs, bool, error) {
+	return s.commit(ctx, decide, false)
+}
+
+// commit implements write; shard moves pass force to bypass the ownership/freeze check.
+func (s *KVService) commit(ctx context.Context, decide func() ([]common.KVMutation, bool), force bool) (common.ApplyArgs, bool, error) {
+	s.mu.Lock()
+	ops, ok := decide()
+	if !ok {
+		a := common.ApplyArgs{Epoch: s.epoch, Seq: s.lastApply}
+		s.mu.Unlock()
+		return a, false, nil
+	}
+	if !force {
+		if err := s.checkWritableLocked(ops); err != nil {
+			s.mu.Unlock()
+			return common.ApplyArgs{}, false, err
+		}
+	}
+	// Applico localmente con sequenza monotona
+	s.seq++
+	a := common.ApplyArgs{Epoch: s.epoch, Seq: s.seq, Ops: ops, MapVersion: s.mapVersion(), Frozen: s.frozenLocked()}
+	s.applyLocked(&a)
+	s.lastApply = a.Seq
+	if s.pending == nil {
+		s.pending = make(map[string]int64)
+	}
+	for _, m := range a.Ops {
+		s.pending[m.Key] = a.Seq
+	}
+	s.mu.Unlock()
+
+	if err := s.replicate(ctx, &a); err != nil {
+		return a, false, err
+	}
+	// i backup applicano in ordine: il loro ack copre anche i batch precedenti
+	s.mu.Lock()
+	s.markCommittedLocked(a.Seq)
+	s.mu.Unlock()
+	return a, true, nil
+}
+
+// markCommittedLocked advances the committed seq and wakes up waiting readers. Caller holds s.mu.
+func (s *KVService) markCommittedLocked(seq int64) {
+	if seq <= s.committed {
+		return
+	}
+	s.committed = seq
+	for k, p := range s.pending {
+		if p <= seq {
+			delete(s.pending, k)
+		}
+	}
+	s.changes.wake()
+}
+
+// commitPending replicates an empty batch when the primary has writes not
+// acked by every backup yet (a failed replication, or the state inherited
+// at promotion), so that committed catches up with lastApply.
+func (s *KVService) commitPending() {
+	s.mu.RLock()
+	behind := s.committed < s.lastApply || s.committed < s.termStart
+	s.mu.RUnlock()
+	if !behind {
+		return
+	}
+	if _, _, err := s.commit(context.Background(), func() ([]common.KVMutation, bool) { return nil, true }, true); err != nil {
+		log.Printf("[kv %s] commit pending writes: %v", s.id, err)
+	}
+}
+
+// replicate sends a batch to every backup ("strict": all must ack) within ctx;
+// each KV.Apply is also bounded by its default timeout, so a hung backup cannot block writes.
+func (s *KVService) replicate(ctx context.Context, a *common.ApplyArgs) error {
+	backups, err := s.lookupBackups()
+	if err != nil {
+		return err
+	}
+
+	for _, b := range backups {
+		callCtx, cancel := context.WithTimeout(ctx, rpcctx.Timeout("KV.Apply"))
+		c, err := rpcctx.DialContext(callCtx, b.Addr)
+		if err != nil {
+			cancel()
+			return fmt.Errorf("replicate dial %s: %w", b.Addr, err)
+		}
+		var arep common.ApplyReply
+		callErr := rpcctx.Call(callCtx, c, "KV.Apply", a, &arep)
+		cancel()
+		_ = c.Close()
+		if callErr == nil && !arep.OK && arep.Epoch > a.Epoch {
+			// un altro primary ha un'epoch più recente: smetto di scrivere
+			s.stepDown(arep.Epoch)
+			return fmt.Errorf("fenced: epoch %d superseded by %d", a.Epoch, arep.Epoch)
+		}
+		if callErr != nil || !arep.OK {
+			return fmt.Errorf("replicate apply to %s: %v", b.ID, callErr)
+		}
+	}
+	return nil
+}
+
+// applyLocked mutates the store; caller holds s.mu, so readers see the whole batch or none of it.
+func (s *KVService) applyLocked(a *common.ApplyArgs) {
+	for _, m := range a.Ops {
+		switch m.Op {
+		case common.KVOpDelete:
+			s.store.Delete(m.Key)
+		default:
+			s.store.Set(m.Key, common.KVEntry{Value: m.Value, Version: m.Version, ExpiresAt: m.ExpiresAt})
+			s.maxVersion = max(s.maxVersion, m.Version)
+		}
+	}
+	s.changes.append(a)
+}
+
+// nextVersionLocked is the version of the puts of the batch being decided (all
+// the puts of a batch share it). Caller holds s.mu.
+func (s *KVService) nextVersionLocked() int64 {
+	return s.maxVersion + 1
+}
+
+// liveLocked returns the entry for key, hiding values whose TTL has elapsed
+// even if the primary's delete record has not arrived yet. Caller holds s.mu.
+func (s *KVService) liveLocked(key string) (common.KVEntry, bool) {
+	e, ok := s.store.Get(key)
+	if !ok || e.Expired(time.Now()) {
+		return common.KVEntry{}, false
+	}
+	return e, true
+}
+
+func expiresAt(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).UnixNano()
+}
+
+// expireLoop runs on every instance but only acts while primary: expired keys are
+// removed through the normal write path, so backups receive explicit delete records
+// in seq order and converge deterministically.
+func (s *KVService) expireLoop(every time.Duration) {
+	for range time.Tick(every) {
+		if !s.isPrimary() {
+			continue
+		}
+		now := time.Now()
+		s.mu.RLock()
+		var expired []string
+		s.store.Ascend("", "", func(k string, e common.KVEntry) bool {
+			if e.Expired(now) && s.ownsCached(k) {
+				expired = append(expired, k)
+			}
+			return true
+		})
+		s.mu.RUnlock()
+
+		for _, k := range expired {
+			_, _, err := s.write(context.Background(), func() ([]common.KVMutation, bool) {
+				// ricontrollo sotto lock: la chiave può essere stata riscritta nel frattempo
+				e, ok := s.store.Get(k)
+				if !ok || !e.Expired(time.Now()) {
+					return nil, false
+				}
+				return []common.KVMutation{{Op: common.KVOpDelete, Key: k}}, true
+			})
+			if err != nil {
+				log.Printf("[kv %s] expire %q: %v", s.id, k, err)
+				break
+			}
+		}
+	}
+}
+
+// reorderWait is how long a backup waits for the batches before an early one.
+const reorderWait = time.Second
+
+// -------- RPC: Apply (primary -> backup) --------
+func (s *KVService) Apply(args *common.ApplyArgs, reply *common.ApplyReply) error {
+	if args == nil {
+		args = &common.ApplyArgs{}
+	}
+	// il primary conosce una mappa più recente (es. DropShard): mi allineo prima di applicare
+	if args.MapVersion > s.mapVersion() {
+		_ = s.loadShardMap()
+	}
+	// valido tutto il batch prima di toccare lo stato (all-or-nothing)
+	for _, m := range args.Ops {
+		if m.Op != common.KVOpPut && m.Op != common.KVOpDelete {
+			return fmt.Errorf("unknown apply op %q", m.Op)
+		}
+	}
+
+	// il primary replica fuori dal lock: con scrittori concorrenti un batch può
+	// arrivare prima del precedente, che aspetto un poco prima di dichiarare un buco
+	s.mu.RLock()
+	early := args.Epoch == s.epoch && !s.resync && args.Seq > s.lastApply+1
+	s.mu.RUnlock()
+	if early {
+		s.waitApplied(args.Seq-1, reorderWait)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// fencing: rifiuto repliche da un primary con epoch vecchia
+	if args.Epoch < s.epoch {
+		reply.OK = false
+		reply.Epoch = s.epoch
+		return nil
+	}
+	newEpoch := args.Epoch > s.epoch
+	if newEpoch {
+		s.epoch = args.Epoch
+		if s.isPrimary() {
+			go s.stepDown(args.Epoch)
+		}
+	}
+	reply.Epoch = s.epoch
+
+	// idempotenza: se arriva due volte lo stesso seq (solo nella stessa epoch)
+	if !newEpoch && !s.resync && args.Seq <= s.lastApply {
+		reply.OK = true
+		return nil
+	}
+
+	// ordine stretto: se manca una replica, forza resync (snapshot); anche una
+	// replica mai sincronizzata accetta solo seq 1, altrimenti le manca lo storico
+	if s.resync || args.Seq != s.lastApply+1 {
+		s.resync = true
+		reply.OK = false
+		return fmt.Errorf("out of order apply: have=%d got=%d", s.lastApply, args.Seq)
+	}
+
+	s.applyLocked(args)
+	s.setFrozenLocked(args.Frozen)
+	s.lastApply = args.Seq
+	if args.Seq > s.seq {
+		s.seq = args.Seq
+	}
+
+	reply.OK = true
+	return nil
+}
+
+// -------- RPC: Snapshot (backup -> primary) --------
+func (s *KVService) Snapshot(_ *common.SnapshotArgs, reply *common.SnapshotReply) error {
+	if !s.isPrimary() {
+		return errors.New("not primary")
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	state := make(map[string]common.KVEntry, s.store.Len())
+	s.store.Ascend("", "", func(k string, e common.KVEntry) bool {
+		state[k] = e
+		return true
+	})
+	reply.Epoch = s.epoch
+	reply.Seq = s.seq
+	reply.State = state
+	reply.Frozen = s.frozenLocked()
+	reply.MaxVersion = s.maxVersion
+	return nil
+}
+
+// ----- registry helpers -----
+// lookupAll returns the kv instances of this replica group.
+func (s *KVService) lookupAll() ([]common.Instance, error) {
+	var rep common.LookupReply
+	if err := s.registry.CallRegistry("Registry.Lookup", &common.LookupArgs{Service: "kv"}, &rep); err != nil {
+		return nil, err
+	}
+	out := make([]common.Instance, 0, len(rep.Instances))
+	for _, in := range rep.Instances {
+		if common.GroupOfInstance(in) == s.group {
+			out = append(out, in)
+		}
+	}
+	return out, nil
+}
+func (s *KVService) lookupBackups() ([]common.Instance, error) {
+	inst, err := s.lookupAll()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]common.Instance, 0, len(inst))
+	for _, in := range inst {
+		if in.ID != s.id {
+			out = append(out, in)
+		}
+	}
+	return out, nil
+}
+
+func bootstrapFromPrimary(svc *KVService, primaryAddr string) error {
+	c, err := rpcctx.Dial(primaryAddr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	var rep common.SnapshotReply
+	if err := rpcctx.Call(context.Background(), c, "KV.Snapshot", &common.SnapshotArgs{}, &rep); err != nil {
+		return err
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	if rep.Epoch < svc.epoch {
+		return fmt.Errorf("stale snapshot: epoch %d < %d", rep.Epoch, svc.epoch)
+	}
+	// con un'epoch nuova lo stato del primary è autorevole anche se ha seq minore;
+	// nella stessa epoch basta lo stream di KV.Apply (e lo storico per Watch resta)
+	if rep.Epoch > svc.epoch || svc.resync || (svc.lastApply == 0 && rep.Seq > 0) {
+		svc.restoreLocked(&rep)
+	}
+	return nil
+}
+
+// restoreLocked replaces the replica state with a primary snapshot. Caller holds s.mu.
+func (s *KVService) restoreLocked(rep *common.SnapshotReply) {
+	s.store = kvstore.New()
+	s.maxVersion = rep.MaxVersion
+	for k, v := range rep.State {
+		s.store.Set(k, v)
+		s.maxVersion = max(s.maxVersion, v.Version)
+	}
+	s.seq = rep.Seq
+	s.lastApply = rep.Seq
+	s.epoch = rep.Epoch
+	s.setFrozenLocked(rep.Frozen)
+	s.resync = false
+	s.changes.reset(rep.Seq)
+}
+
+func main() {
+	kit := servicekit.New("kv", ":9301")
+	forcedPrimary := flag.String("primary-id", "", "preferred primary instance ID (hint: the others campaign one lease later)")
+	leaseTTL := flag.Duration("lease", 0, "primary lease duration (default: env LEASE_TTL or 6s)")
+	groupFlag := flag.String("group", "", "replica group (default: env GROUP or '"+common.DefaultGroup+"')")
+	shards := flag.Int("shards", 0, "shards of the kv keyspace, used only if no shard map exists yet (default: env SHARDS or 16)")
+	kit.Parse()
+
+	group := *groupFlag
+	if group == "" {
+		group = util.Env("GROUP", common.DefaultGroup)
+	}
+	nShards := *shards
+	if nShards == 0 {
+		nShards = util.EnvInt("SHARDS", 16)
+	}
+	ttl := *leaseTTL
+	if ttl == 0 {
+		ttl = util.EnvDuration("LEASE_TTL", 6*time.Second)
+	}
+	// Primary del gruppo: chi tiene il lease nel registry (PRIMARY_ID è solo una preferenza)
+	primaryID := *forcedPrimary
+	if primaryID == "" {
+		primaryID = util.Env("PRIMARY_ID", "")
+	}
+	kit.SetMeta("group", group)
+	id, pub := kit.ID(), kit.Instance().Addr
+	owner := leaseOwner(id)
+
+	svc := &KVService{id: id, group: group, registry: kit.Connect(), store: kvstore.New(), changes: newChangeLog(), frozen: map[int]bool{}}
+	kit.RegisterRPC("KV", svc)
+	kit.LongPoll("KV.Watch")
+	kit.HealthCheck(func() error {
+		if svc.currentResync() {
+			return errors.New("waiting for a snapshot from the primary")
+		}
+		return nil
+	})
+	kit.OnStart(func(_ *discovery.Client) error {
+		log.Printf("[kv %s] group=%s lease=%s", id, group, ttl)
+		// Shard map: la prima istanza la crea assegnando tutti gli shard al proprio gruppo
+		if err := svc.ensureShardMap(nShards); err != nil {
+			log.Printf("[kv %s] shard map: %v", id, err)
+		}
+		go svc.expireLoop(500 * time.Millisecond)
+		go svc.roleLoop(owner, pub, ttl, primaryID)
+		return nil
+	})
+	kit.OnStop(func(context.Context) {
+		svc.releaseLease(owner)
+	})
+	kit.Run()
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"example.com/service-registry-lb/common"
+	"example.com/service-registry-lb/internal/discovery"
+	"example.com/service-registry-lb/internal/kvstore"
+	"example.com/service-registry-lb/internal/registry"
+	"example.com/service-registry-lb/internal/rpcctx"
+)
+
+// newTestService returns a replica with an empty store, not connected to a registry.
+func newTestService() *KVService {
+	return &KVService{id: "t", group: common.DefaultGroup, store: kvstore.New(), changes: newChangeLog(), frozen: map[int]bool{}}
+}
+
+// newTestPrimary returns a primary holding its lease, connected to an
+// in-process registry (returned too) where it has no backups yet.
+func newTestPrimary(t *testing.T) (*KVService, *registry.Registry) {
+	t.Helper()
+	reg := registry.New()
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Registry", reg); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	rpcctx.Handle(mux, srv, nil)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	dc, err := discovery.Dial(ts.Listener.Addr().String(), discovery.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dc.Close() })
+
+	s := newTestService()
+	s.registry = dc
+	s.epoch = 1
+	s.role = "primary"
+	s.leaseUntil = time.Now().Add(time.Hour)
+	return s, reg
+}
+
+// applyBatch commits ops as the next batch, as the primary's write path does;
+// puts with Version 0 get the next version.
+func applyBatch(s *KVService, ops ...common.KVMutation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range ops {
+		if ops[i].Op == common.KVOpPut && ops[i].Version == 0 {
+			ops[i].Version = s.nextVersionLocked()
+		}
+	}
+	s.seq++
+	s.applyLocked(&common.ApplyArgs{Epoch: s.epoch, Seq: s.seq, Ops: ops})
+	s.lastApply = s.seq
+}
+
+func version(t *testing.T, s *KVService, key string) int64 {
+	t.Helper()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.liveLocked(key)
+	if !ok {
+		t.Fatalf("key %q missing", key)
+	}
+	return e.Version
+}
+
+// value returns the live value of key, "" if absent.
+func value(s *KVService, key string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, _ := s.liveLocked(key)
+	return e.Value
+}
+
+func del(key string) common.KVMutation { return common.KVMutation{Op: common.KVOpDelete, Key: key} }
+
+func put(key, value string, version int64) common.KVMutation {
+	return common.KVMutation{Op: common.KVOpPut, Key: key, Value: value, Version: version}
+}
+
+func TestApplyEpochAndOrder(t *testing.T) {
+	const epoch, last = 2, 5
+	tests := []struct {
+		name       string
+		args       common.ApplyArgs
+		wantOK     bool
+		wantErr    bool
+		wantEpoch  int64
+		wantLast   int64
+		wantResync bool
+	}{
+		{"stale epoch rejected", common.ApplyArgs{Epoch: epoch - 1, Seq: last + 1}, false, false, epoch, last, false},
+		{"same epoch next seq", common.ApplyArgs{Epoch: epoch, Seq: last + 1}, true, false, epoch, last + 1, false},
+		{"same epoch duplicate", common.ApplyArgs{Epoch: epoch, Seq: last}, true, false, epoch, last, false},
+		{"newer epoch raises it", common.ApplyArgs{Epoch: epoch + 1, Seq: last + 1}, true, false, epoch + 1, last + 1, false},
+		{"newer epoch with a gap", common.ApplyArgs{Epoch: epoch + 1, Seq: last + 3}, false, true, epoch + 1, last, true},
+		{"newer epoch replaying an old seq", common.ApplyArgs{Epoch: epoch + 1, Seq: last}, false, true, epoch + 1, last, true},
+		{"same epoch gap never filled", common.ApplyArgs{Epoch: epoch, Seq: last + 2}, false, true, epoch, last, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService()
+			s.epoch, s.seq, s.lastApply = epoch, last, last
+			tt.args.Ops = []common.KVMutation{put("k", tt.name, 1)}
+
+			var rep common.ApplyReply
+			err := s.Apply(&tt.args, &rep)
+			if (err != nil) != tt.wantErr || rep.OK != tt.wantOK {
+				t.Fatalf("Apply: ok=%v err=%v, want ok=%v err=%v", rep.OK, err, tt.wantOK, tt.wantErr)
+			}
+			if rep.Epoch != tt.wantEpoch || s.epoch != tt.wantEpoch {
+				t.Fatalf("epoch: reply %d, replica %d, want %d", rep.Epoch, s.epoch, tt.wantEpoch)
+			}
+			if s.lastApply != tt.wantLast || s.resync != tt.wantResync {
+				t.Fatalf("lastApply=%d resync=%v, want %d %v", s.lastApply, s.resync, tt.wantLast, tt.wantResync)
+			}
+			// un batch rifiutato non tocca lo store
+			if _, applied := s.store.Get("k"); applied != (tt.wantOK && tt.wantLast > last) {
+				t.Fatalf("store changed=%v", applied)
+			}
+		})
+	}
+}
+
+func TestApplyWaitsForEarlierBatch(t *testing.T) {
+	s := newTestService()
+	s.epoch = 1
+
+	// il batch 2 arriva prima dell'1: aspetta invece di chiedere uno snapshot
+	done := make(chan error, 1)
+	go func() {
+		var rep common.ApplyReply
+		done <- s.Apply(&common.ApplyArgs{Epoch: 1, Seq: 2, Ops: []common.KVMutation{put("b", "2", 2)}}, &rep)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	var rep common.ApplyReply
+	if err := s.Apply(&common.ApplyArgs{Epoch: 1, Seq: 1, Ops: []common.KVMutation{put("a", "1", 1)}}, &rep); err != nil || !rep.OK {
+		t.Fatalf("batch 1: ok=%v err=%v", rep.OK, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("batch 2: %v", err)
+	}
+	if s.lastApply != 2 || s.resync {
+		t.Fatalf("lastApply=%d resync=%v, want 2 false", s.lastApply, s.resync)
+	}
+}
+
+func TestApplyRefusedDuringResync(t *testing.T) {
+	s := newTestService()
+	s.epoch, s.lastApply, s.resync = 1, 3, true
+	var rep common.ApplyReply
+	if err := s.Apply(&common.ApplyArgs{Epoch: 1, Seq: 4}, &rep); err == nil || rep.OK {
+		t.Fatal("batch applied while waiting for a snapshot")
+	}
+	if err := s.Apply(&common.ApplyArgs{Epoch: 1, Seq: 3}, &rep); err == nil || rep.OK {
+		t.Fatal("duplicate acknowledged while waiting for a snapshot")
+	}
+}
+
+func TestVersionsNeverReused(t *testing.T) {
+	past := time.Now().Add(-time.Second).UnixNano()
+	tests := []struct {
+		name    string
+		batches [][]common.KVMutation
+	}{
+		{"deleted and created again", [][]common.KVMutation{
+			{put("k", "a", 0)}, {del("k")},
+		}},
+		{"expired and created again", [][]common.KVMutation{
+			{{Op: common.KVOpPut, Key: "k", Value: "a", ExpiresAt: past}}, {del("k")},
+		}},
+		{"other keys raise it too", [][]common.KVMutation{
+			{put("k", "a", 0)}, {put("x", "b", 0)}, {del("x")}, {del("k")},
+		}},
+		{"imported version", [][]common.KVMutation{
+			{put("k", "a", 100)}, {del("k")},
+		}},
+		{"deleted in the same batch as a put", [][]common.KVMutation{
+			{put("k", "a", 0), put("y", "b", 0)}, {del("k"), put("y", "c", 0)},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService()
+			var seen int64
+			for _, b := range tt.batches {
+				applyBatch(s, b...)
+				for _, m := range b {
+					seen = max(seen, m.Version)
+				}
+			}
+			applyBatch(s, put("k", "again", 0))
+			if v := version(t, s, "k"); v <= seen {
+				t.Fatalf("version %d reused (highest so far %d)", v, seen)
+			}
+		})
+	}
+}
+
+func TestMaxVersionSurvivesSnapshot(t *testing.T) {
+	p := newTestService()
+	p.epoch, p.role, p.leaseUntil = 1, "primary", time.Now().Add(time.Hour)
+	applyBatch(p, put("k", "a", 0))
+	applyBatch(p, put("gone", "b", 0))
+	applyBatch(p, del("gone"))
+
+	var snap common.SnapshotReply
+	if err := p.Snapshot(&common.SnapshotArgs{}, &snap); err != nil {
+		t.Fatal(err)
+	}
+	b := newTestService()
+	b.restoreLocked(&snap)
+	if got, want := b.nextVersionLocked(), p.nextVersionLocked(); got != want {
+		t.Fatalf("backup next version %d, primary %d", got, want)
+	}
+	if b.nextVersionLocked() <= 2 {
+		t.Fatalf("next version %d would reuse the deleted key's version", b.nextVersionLocked())
+	}
+}
+
+func TestConditionalWritesRejectStaleVersions(t *testing.T) {
+	s, _ := newTestPrimary(t)
+	var pr common.PutReply
+	if err := s.Put(&common.PutArgs{Key: "k", Value: "a"}, &pr); err != nil || !pr.OK {
+		t.Fatalf("put: %+v %v", pr, err)
+	}
+	v1 := pr.Version
+	var cur int64 // versione attesa dopo ogni passo (0 = assente)
+
+	steps := []struct {
+		name string
+		do   func() (ok bool, version int64, err error)
+		ok   bool
+	}{
+		{"cas on current version", func() (bool, int64, error) {
+			var r common.CASReply
+			err := s.CompareAndSwap(&common.CASArgs{Key: "k", ExpectedVersion: v1, Value: "b"}, &r)
+			return r.Swapped, r.Version, err
+		}, true},
+		{"cas on stale version", func() (bool, int64, error) {
+			var r common.CASReply
+			err := s.CompareAndSwap(&common.CASArgs{Key: "k", ExpectedVersion: v1, Value: "c"}, &r)
+			return r.Swapped, r.Version, err
+		}, false},
+		{"cas expecting absent on existing key", func() (bool, int64, error) {
+			var r common.CASReply
+			err := s.CompareAndSwap(&common.CASArgs{Key: "k", ExpectedVersion: 0, Value: "c"}, &r)
+			return r.Swapped, r.Version, err
+		}, false},
+		{"put if absent on existing key", func() (bool, int64, error) {
+			var r common.PutIfAbsentReply
+			err := s.PutIfAbsent(&common.PutArgs{Key: "k", Value: "c"}, &r)
+			return r.Stored, r.Version, err
+		}, false},
+		{"delete", func() (bool, int64, error) {
+			var r common.DeleteReply
+			err := s.Delete(&common.DeleteArgs{Key: "k"}, &r)
+			return r.Deleted, 0, err
+		}, true},
+		{"delete of a missing key", func() (bool, int64, error) {
+			var r common.DeleteReply
+			err := s.Delete(&common.DeleteArgs{Key: "k"}, &r)
+			return r.Deleted, 0, err
+		}, false},
+		{"put if absent after delete", func() (bool, int64, error) {
+			var r common.PutIfAbsentReply
+			err := s.PutIfAbsent(&common.PutArgs{Key: "k", Value: "d"}, &r)
+			return r.Stored, r.Version, err
+		}, true},
+		{"cas with the version before the delete", func() (bool, int64, error) {
+			var r common.CASReply
+			err := s.CompareAndSwap(&common.CASArgs{Key: "k", ExpectedVersion: v1, Value: "e"}, &r)
+			return r.Swapped, r.Version, err
+		}, false},
+	}
+	for _, st := range steps {
+		ok, v, err := st.do()
+		if err != nil {
+			t.Fatalf("%s: %v", st.name, err)
+		}
+		if ok != st.ok {
+			t.Fatalf("%s: ok=%v, want %v", st.name, ok, st.ok)
+		}
+		switch {
+		case st.name == "delete":
+			cur = 0
+		case ok:
+			if v <= max(cur, v1) {
+				t.Fatalf("%s: new version %d not above %d", st.name, v, max(cur, v1))
+			}
+			cur = v
+		case v != cur && cur != 0:
+			// il confronto fallito riporta la versione corrente
+			t.Fatalf("%s: reported version %d, current is %d", st.name, v, cur)
+		}
+	}
+}
+
+func TestTxn(t *testing.T) {
+	tests := []struct {
+		name      string
+		compares  func(v map[string]int64) []common.TxnCompare
+		ops       []common.TxnOp
+		succeeded bool
+		want      map[string]string // contenuto dopo la txn ("" = assente)
+	}{
+		{"no compares writes every op", nil,
+			[]common.TxnOp{{Op: common.KVOpPut, Key: "a", Value: "2"}, {Op: common.KVOpPut, Key: "c", Value: "3"}, {Op: common.KVOpDelete, Key: "b"}},
+			true, map[string]string{"a": "2", "b": "", "c": "3"}},
+		{"failed compare applies no op", func(v map[string]int64) []common.TxnCompare {
+			return []common.TxnCompare{{Key: "a", Version: v["a"]}, {Key: "b", Version: v["b"] + 1}}
+		}, []common.TxnOp{{Op: common.KVOpPut, Key: "a", Value: "2"}, {Op: common.KVOpDelete, Key: "b"}, {Op: common.KVOpPut, Key: "c", Value: "3"}},
+			false, map[string]string{"a": "1", "b": "1", "c": ""}},
+		{"compare on absent key fails when it exists", func(map[string]int64) []common.TxnCompare {
+			return []common.TxnCompare{{Key: "a", Version: 0}}
+		}, []common.TxnOp{{Op: common.KVOpPut, Key: "a", Value: "2"}},
+			false, map[string]string{"a": "1"}},
+		{"compare on absent key", func(map[string]int64) []common.TxnCompare {
+			return []common.TxnCompare{{Key: "c", Version: 0}}
+		}, []common.TxnOp{{Op: common.KVOpPut, Key: "c", Value: "3"}},
+			true, map[string]string{"c": "3"}},
+		{"compare on a key the txn writes", func(v map[string]int64) []common.TxnCompare {
+			return []common.TxnCompare{{Key: "a", Version: v["a"]}}
+		}, []common.TxnOp{{Op: common.KVOpPut, Key: "a", Value: "2"}, {Op: common.KVOpPut, Key: "b", Value: "2"}},
+			true, map[string]string{"a": "2", "b": "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestPrimary(t)
+			before := map[string]int64{}
+			for _, k := range []string{"a", "b"} {
+				var pr common.PutReply
+				if err := s.Put(&common.PutArgs{Key: k, Value: "1"}, &pr); err != nil || !pr.OK {
+					t.Fatalf("put %s: %+v %v", k, pr, err)
+				}
+				before[k] = pr.Version
+			}
+			args := common.TxnArgs{Ops: tt.ops}
+			if tt.compares != nil {
+				args.Compares = tt.compares(before)
+			}
+			var rep common.TxnReply
+			if err := s.Txn(&args, &rep); err != nil || !rep.OK {
+				t.Fatalf("Txn: %+v %v", rep, err)
+			}
+			if rep.Succeeded != tt.succeeded {
+				t.Fatalf("succeeded=%v, want %v", rep.Succeeded, tt.succeeded)
+			}
+			for k, want := range tt.want {
+				if got := value(s, k); got != want {
+					t.Fatalf("%s = %q, want %q", k, got, want)
+				}
+			}
+
+			if !tt.succeeded {
+				// i conflitti riportano la versione corrente; niente versioni assegnate
+				if len(rep.Conflicts) == 0 || rep.Versions != nil {
+					t.Fatalf("conflicts=%v versions=%v", rep.Conflicts, rep.Versions)
+				}
+				for _, c := range rep.Conflicts {
+					if c.Version != before[c.Key] {
+						t.Fatalf("conflict on %s reports version %d, current %d", c.Key, c.Version, before[c.Key])
+					}
+				}
+				if s.lastApply != 2 {
+					t.Fatalf("failed txn used a seq: lastApply=%d", s.lastApply)
+				}
+				return
+			}
+			// tutte le put condividono una versione, nuova; le delete riportano 0
+			var shared int64
+			for i, op := range tt.ops {
+				v := rep.Versions[i]
+				if op.Op == common.KVOpDelete {
+					if v != 0 {
+						t.Fatalf("delete of %s reports version %d", op.Key, v)
+					}
+					continue
+				}
+				if shared == 0 {
+					shared = v
+				}
+				if v != shared || v <= max(before["a"], before["b"]) {
+					t.Fatalf("put of %s got version %d (shared %d, previous %v)", op.Key, v, shared, before)
+				}
+				if got := version(t, s, op.Key); got != v {
+					t.Fatalf("%s stored with version %d, reply says %d", op.Key, got, v)
+				}
+			}
+			if s.lastApply != 3 || rep.Seq != 3 {
+				t.Fatalf("txn seq %d lastApply %d, want a single batch 3", rep.Seq, s.lastApply)
+			}
+		})
+	}
+}
+
+func TestTxnRejectsInvalidOps(t *testing.T) {
+	s, _ := newTestPrimary(t)
+	tests := []struct {
+		name string
+		ops  []common.TxnOp
+	}{
+		{"empty", nil},
+		{"missing key", []common.TxnOp{{Op: common.KVOpPut}}},
+		{"unknown op", []common.TxnOp{{Op: "incr", Key: "a"}}},
+		{"same key twice", []common.TxnOp{{Op: common.KVOpPut, Key: "a"}, {Op: common.KVOpDelete, Key: "a"}}},
+	}
+	for _, tt := range tests {
+		var rep common.TxnReply
+		if err := s.Txn(&common.TxnArgs{Ops: tt.ops}, &rep); err == nil {
+			t.Errorf("%s: accepted", tt.name)
+		}
+	}
+	if s.lastApply != 0 {
+		t.Fatalf("rejected txns applied: lastApply=%d", s.lastApply)
+	}
+}
+
+func TestReadsSkipUnreplicatedWrites(t *testing.T) {
+	s, reg := newTestPrimary(t)
+	for _, kv := range [][2]string{{"k", "a"}, {"other", "x"}} {
+		var pr common.PutReply
+		if err := s.Put(&common.PutArgs{Key: kv[0], Value: kv[1]}, &pr); err != nil || !pr.OK {
+			t.Fatalf("put %s: %+v %v", kv[0], pr, err)
+		}
+	}
+
+	// un backup irraggiungibile: la scrittura resta applicata solo sul primary
+	dead := common.Instance{ID: "dead", Addr: "127.0.0.1:1", Meta: map[string]string{"group": common.DefaultGroup}}
+	var rr common.RegisterReply
+	if err := reg.Register(&common.RegisterArgs{Service: "kv", Instance: dead}, &rr); err != nil {
+		t.Fatal(err)
+	}
+	var pr common.PutReply
+	if err := s.Put(&common.PutArgs{Key: "k", Value: "b"}, &pr); err == nil {
+		t.Fatal("put acked without its backup")
+	}
+	if s.lastApply != 3 || s.committed != 2 {
+		t.Fatalf("lastApply=%d committed=%d, want 3 2", s.lastApply, s.committed)
+	}
+
+	var ri common.ReadIndexReply
+	if err := s.ReadIndex(&common.ReadIndexArgs{}, &ri); err != nil || ri.Seq != 2 {
+		t.Fatalf("ReadIndex = %d %v, want the committed seq 2", ri.Seq, err)
+	}
+	tests := []struct {
+		name    string
+		args    common.GetArgs
+		want    string
+		wantErr bool
+	}{
+		{"linearizable on the unreplicated key", common.GetArgs{Key: "k", Consistency: common.ReadLinearizable}, "", true},
+		{"bounded on the unreplicated key", common.GetArgs{Key: "k", Consistency: common.ReadBounded}, "", true},
+		{"linearizable on another key", common.GetArgs{Key: "other", Consistency: common.ReadLinearizable}, "x", false},
+		{"session token of the failed write", common.GetArgs{Key: "other", MinSeq: 3}, "", true},
+	}
+	for _, tt := range tests {
+		var rep common.GetReply
+		err := s.Get(&tt.args, &rep)
+		if (err != nil) != tt.wantErr || rep.Value != tt.want {
+			t.Errorf("%s: %q %v, want %q (error %v)", tt.name, rep.Value, err, tt.want, tt.wantErr)
+		}
+		if err == nil && rep.Seq != 2 {
+			t.Errorf("%s: reply seq %d, want the committed seq 2", tt.name, rep.Seq)
+		}
+	}
+
+	// il backup sparisce: un batch vuoto conferma la scrittura rimasta indietro
+	var dr common.DeregisterReply
+	if err := reg.Deregister(&common.DeregisterArgs{Service: "kv", ID: "dead"}, &dr); err != nil {
+		t.Fatal(err)
+	}
+	s.commitPending()
+	if s.committed != 4 || len(s.pending) != 0 {
+		t.Fatalf("committed=%d pending=%v after commitPending", s.committed, s.pending)
+	}
+	var rep common.GetReply
+	if err := s.Get(&common.GetArgs{Key: "k", Consistency: common.ReadLinearizable, MinSeq: 3}, &rep); err != nil || rep.Value != "b" {
+		t.Fatalf("Get after the commit: %q %v", rep.Value, err)
+	}
+}
+
+func TestNewPrimaryCommitsInheritedState(t *testing.T) {
+	s, _ := newTestPrimary(t)
+	// stato ricevuto dal primary precedente, senza sapere se tutti i backup lo hanno
+	applyBatch(s, put("k", "a", 0))
+	s.termStart = s.lastApply + 1
+
+	var ri common.ReadIndexReply
+	if err := s.ReadIndex(&common.ReadIndexArgs{}, &ri); err == nil {
+		t.Fatalf("ReadIndex %d before the first commit of the epoch", ri.Seq)
+	}
+	var rep common.GetReply
+	if err := s.Get(&common.GetArgs{Key: "k", Consistency: common.ReadLinearizable}, &rep); err == nil {
+		t.Fatal("linearizable read of inherited state before the first commit")
+	}
+	s.commitPending()
+	if err := s.ReadIndex(&common.ReadIndexArgs{}, &ri); err != nil || ri.Seq != 2 {
+		t.Fatalf("ReadIndex = %d %v, want 2", ri.Seq, err)
+	}
+	if err := s.Get(&common.GetArgs{Key: "k", Consistency: common.ReadLinearizable}, &rep); err != nil || rep.Value != "a" {
+		t.Fatalf("Get: %q %v", rep.Value, err)
+	}
+}
+
+func TestSessionTokenAcrossEpochs(t *testing.T) {
+	const epoch, applied = 3, 10
+	tests := []struct {
+		name     string
+		primary  bool
+		minEpoch int64
+		minSeq   int64
+		want     int64 // seq da raggiungere; -1 = redirect
+		wantErr  bool
+	}{
+		{"no token", false, 0, 0, 0, false},
+		{"token without epoch", false, 0, 7, 7, false},
+		{"same epoch", false, epoch, 12, 12, false},
+		{"older epoch, seq ahead", false, epoch - 1, 50, 0, false},
+		{"older epoch on the primary", true, epoch - 1, 50, 0, false},
+		{"newer epoch on a backup", false, epoch + 1, 2, -1, false},
+		{"newer epoch on the primary", true, epoch + 1, 2, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService()
+			s.epoch, s.lastApply = epoch, applied
+			got, err := s.sessionSeq(&common.GetArgs{MinEpoch: tt.minEpoch, MinSeq: tt.minSeq}, tt.primary)
+			if (err != nil) != tt.wantErr || !tt.wantErr && got != tt.want {
+				t.Fatalf("sessionSeq = %d, %v; want %d (error %v)", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadWithTokenFromPreviousPrimary(t *testing.T) {
+	// il primary precedente (epoch 1) era arrivato a seq 40; il nuovo riparte da uno snapshot più corto
+	s, _ := newTestPrimary(t)
+	s.epoch = 2
+	applyBatch(s, put("k", "a", 0))
+	s.commitPending()
+
+	tests := []struct {
+		name     string
+		minEpoch int64
+		minSeq   int64
+		wantErr  bool
+	}{
+		{"token of the old epoch", 1, 40, false},
+		{"token of the current epoch", 2, s.committed, false},
+		{"token ahead in the current epoch", 2, 40, true},
+		{"token of a newer epoch", 3, 1, true},
+	}
+	for _, tt := range tests {
+		var rep common.GetReply
+		err := s.Get(&common.GetArgs{Key: "k", MinEpoch: tt.minEpoch, MinSeq: tt.minSeq}, &rep)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err=%v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (rep.Value != "a" || rep.Epoch != 2) {
+			t.Errorf("%s: %q epoch %d", tt.name, rep.Value, rep.Epoch)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"example.com/service-registry-lb/common"
+	"example.com/service-registry-lb/internal/rpcctx"
+)
+
+// minMapRefresh limits how often a miss on shard ownership re-reads the registry.
+const minMapRefresh = 200 * time.Millisecond
+
+// Attesa di una mappa ripubblicata prima di crearne una nuova (vedi ensureShardMap).
+const (
+	mapWaitAttempts = 10
+	mapWaitInterval = 500 * time.Millisecond
+)
+
+// loadShardMap refreshes the local copy of the "kv" shard map from the registry.
+// If the registry has an older map, or none (it restarted), the local one is
+// published back with its version, so every group converges on it again.
+func (s *KVService) loadShardMap() error {
+	if s.registry == nil {
+		return errors.New("registry not connected yet")
+	}
+	var rep common.GetShardMapReply
+	if err := s.registry.CallRegistry("Registry.GetShardMap", &common.GetShardMapArgs{Service: "kv"}, &rep); err != nil {
+		return err
+	}
+	s.shardMu.Lock()
+	s.mapLoadedAt = time.Now()
+	if rep.Found && rep.Map.Version > s.shardMap.Version {
+		s.shardMap = rep.Map
+	}
+	local := s.shardMap
+	s.shardMu.Unlock()
+	if local.Version <= rep.Map.Version {
+		return nil
+	}
+
+	var prep common.PublishShardMapReply
+	if err := s.registry.CallRegistry("Registry.PublishShardMap", &common.PublishShardMapArgs{Service: "kv", Map: local}, &prep); err != nil {
+		return err
+	}
+	if prep.OK {
+		log.Printf("[kv %s] registry had shard map v%d: published v%d again", s.id, rep.Map.Version, local.Version)
+	}
+	return nil
+}
+
+// ensureShardMap loads the shard map, creating it with n shards all owned by
+// this instance's group if nobody did yet. With no map in the registry but
+// other kv instances registered, the registry has probably lost it: they
+// publish it back (loadShardMap), so that is awaited before creating a v1
+// that would assign every shard to this group.
+func (s *KVService) ensureShardMap(n int) error {
+	for attempt := 0; ; attempt++ {
+		if err := s.loadShardMap(); err != nil {
+			return err
+		}
+		if s.mapVersion() > 0 || n <= 0 {
+			return nil
+		}
+		if attempt == mapWaitAttempts || !s.othersRegistered() {
+			break
+		}
+		time.Sleep(mapWaitInterval)
+	}
+	groups := make([]string, n)
+	for i := range groups {
+		groups[i] = s.group
+	}
+	var rep common.SetShardMapReply
+	if err := s.registry.CallRegistry("Registry.SetShardMap", &common.SetShardMapArgs{Service: "kv", ExpectedVersion: 0, Groups: groups}, &rep); err != nil {
+		return err
+	}
+	// se un'altra istanza l'ha creata (o ripubblicata) prima, rep.Map è la sua
+	s.shardMu.Lock()
+	s.shardMap = rep.Map
+	s.shardMu.Unlock()
+	return nil
+}
+
+// othersRegistered reports whether kv instances other than this one are registered.
+func (s *KVService) othersRegistered() bool {
+	var rep common.LookupReply
+	if err := s.registry.CallRegistry("Registry.Lookup", &common.LookupArgs{Service: "kv"}, &rep); err != nil {
+		return false
+	}
+	for _, in := range rep.Instances {
+		if in.ID != s.id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *KVService) mapVersion() int64 {
+	s.shardMu.RLock()
+	defer s.shardMu.RUnlock()
+	return s.shardMap.Version
+}
+
+// ownsCached checks key against the local shard map only (safe under s.mu).
+// Without a map every key is owned.
+func (s *KVService) ownsCached(key string) bool {
+	s.shardMu.RLock()
+	defer s.shardMu.RUnlock()
+	g := s.shardMap.GroupOf(key)
+	return g == "" || g == s.group
+}
+
+// checkOwner fails with ErrWrongShard unless this group owns every key.
+// A miss re-reads the registry first: the map may have just been switched to us.
+func (s *KVService) checkOwner(keys ...string) error {
+	for _, k := range keys {
+		if s.ownsCached(k) {
+			continue
+		}
+		s.shardMu.RLock()
+		stale := time.Since(s.mapLoadedAt) > minMapRefresh
+		s.shardMu.RUnlock()
+		if stale {
+			_ = s.loadShardMap()
+			if s.ownsCached(k) {
+				continue
+			}
+		}
+		s.shardMu.RLock()
+		m := s.shardMap
+		s.shardMu.RUnlock()
+		return fmt.Errorf("%s: key %q belongs to group %s (map v%d)", common.ErrWrongShard, k, m.GroupOf(k), m.Version)
+	}
+	return nil
+}
+
+// shardCount returns the number of shards (0 = unsharded).
+func (s *KVService) shardCount() int {
+	s.shardMu.RLock()
+	defer s.shardMu.RUnlock()
+	return len(s.shardMap.Groups)
+}
+
+// checkWritableLocked is the last ownership check of the write path, done under
+// s.mu so it cannot interleave with ExportShard/DropShard. Caller holds s.mu.
+func (s *KVService) checkWritableLocked(ops []common.KVMutation) error {
+	n := s.shardCount()
+	for _, m := range ops {
+		if n > 0 && s.frozen[common.ShardOf(m.Key, n)] {
+			return fmt.Errorf("%s: shard %d of key %q is being moved, retry", common.ErrShardMoving, common.ShardOf(m.Key, n), m.Key)
+		}
+		if !s.ownsCached(m.Key) {
+			return fmt.Errorf("%s: key %q is not owned by group %s", common.ErrWrongShard, m.Key, s.group)
+		}
+	}
+	return nil
+}
+
+func (s *KVService) validShard(shard int) error {
+	n := s.shardCount()
+	if n == 0 {
+		return errors.New("no shard map")
+	}
+	if shard < 0 || shard >= n {
+		return fmt.Errorf("invalid shard %d (have %d)", shard, n)
+	}
+	return nil
+}
+
+// shardItemsLocked returns the live entries of a shard. Caller holds s.mu.
+func (s *KVService) shardItemsLocked(shard, n int) map[string]common.KVEntry {
+	now := time.Now()
+	items := make(map[string]common.KVEntry)
+	s.store.Ascend("", "", func(k string, e common.KVEntry) bool {
+		if common.ShardOf(k, n) == shard && !e.Expired(now) {
+			items[k] = e
+		}
+		return true
+	})
+	return items
+}
+
+// frozenLocked lists the frozen shards, as sent to the backups. Caller holds s.mu.
+func (s *KVService) frozenLocked() []int {
+	out := make([]int, 0, len(s.frozen))
+	for shard := range s.frozen {
+		out = append(out, shard)
+	}
+	sort.Ints(out)
+	return out
+}
+
+// setFrozenLocked replaces the frozen shards with the primary's. Caller holds s.mu.
+func (s *KVService) setFrozenLocked(shards []int) {
+	s.frozen = make(map[int]bool, len(shards))
+	for _, shard := range shards {
+		s.frozen[shard] = true
+	}
+}
+
+// -------- RPC: ExportShard (solo primary del gruppo sorgente) --------
+func (s *KVService) ExportShard(args *common.ShardArgs, reply *common.ShardReply) error {
+	if args == nil {
+		args = &common.ShardArgs{}
+	}
+	if err := s.validShard(args.Shard); err != nil {
+		return err
+	}
+	if !s.isPrimary() {
+		reply.From, reply.RedirectTo, _ = s.redirect()
+		return nil
+	}
+	s.shardMu.RLock()
+	owner := s.shardMap.Groups[args.Shard]
+	s.shardMu.RUnlock()
+	if owner != s.group {
+		return fmt.Errorf("%s: shard %d belongs to group %s", common.ErrWrongShard, args.Shard, owner)
+	}
+
+	// congelo e copio sotto lo stesso lock: nessuna scrittura può sfuggire all'export.
+	// Il batch (vuoto) porta il congelamento ai backup prima della risposta, così
+	// un failover durante lo spostamento non riapre le scritture sullo shard.
+	ctx, cancel := rpcctx.Context(args)
+	defer cancel()
+	a, _, err := s.commit(ctx, func() ([]common.KVMutation, bool) {
+		s.frozen[args.Shard] = true
+		reply.Items = s.shardItemsLocked(args.Shard, s.shardCount())
+		return nil, true
+	}, true)
+	if err != nil {
+		return err
+	}
+	reply.Seq = a.Seq
+
+	log.Printf("[kv %s] shard %d frozen for export (%d keys)", s.id, args.Shard, len(reply.Items))
+	reply.OK = true
+	reply.Count = len(reply.Items)
+	reply.From = s.id
+	return nil
+}
+
+// -------- RPC: ImportShard (solo primary del gruppo destinazione) --------
+func (s *KVService) ImportShard(args *common.ImportShardArgs, reply *common.ShardReply) error {
+	if args == nil {
+		args = &common.ImportShardArgs{}
+	}
+	if err := s.validShard(args.Shard); err != nil {
+		return err
+	}
+	if !s.isPrimary() {
+		reply.From, reply.RedirectTo, _ = s.redirect()
+		return nil
+	}
+	n := s.shardCount()
+	ops := make([]common.KVMutation, 0, len(args.Items))
+	for k, e := range args.Items {
+		if common.ShardOf(k, n) != args.Shard {
+			return fmt.Errorf("key %q is not in shard %d", k, args.Shard)
+		}
+		// versioni e scadenze restano quelle del gruppo sorgente
+		ops = append(ops, common.KVMutation{Op: common.KVOpPut, Key: k, Value: e.Value, Version: e.Version, ExpiresAt: e.ExpiresAt})
+	}
+
+	reply.OK = true
+	reply.From = s.id
+	if len(ops) == 0 {
+		return nil
+	}
+	// lo shard non è ancora nostro nella mappa: salto il controllo di ownership
+	ctx, cancel := rpcctx.Context(args)
+	defer cancel()
+	a, _, err := s.commit(ctx, func() ([]common.KVMutation, bool) { return ops, true }, true)
+	if err != nil {
+		return err
+	}
+	reply.Count = len(ops)
+	reply.Seq = a.Seq
+	return nil
+}
+
+// -------- RPC: DropShard (solo primary del gruppo sorgente) --------
+func (s *KVService) DropShard(args *common.ShardArgs, reply *common.ShardReply) error {
+	if args == nil {
+		args = &common.ShardArgs{}
+	}
+	if err := s.validShard(args.Shard); err != nil {
+		return err
+	}
+	if !s.isPrimary() {
+		reply.From, reply.RedirectTo, _ = s.redirect()
+		return nil
+	}
+	// la mappa aggiornata deve già assegnare lo shard altrove, altrimenti perderei i dati
+	if err := s.loadShardMap(); err != nil {
+		return err
+	}
+	s.shardMu.RLock()
+	owner := s.shardMap.Groups[args.Shard]
+	s.shardMu.RUnlock()
+	if owner == s.group {
+		return fmt.Errorf("shard %d is still assigned to group %s", args.Shard, s.group)
+	}
+
+	var count int
+	ctx, cancel := rpcctx.Context(args)
+	defer cancel()
+	a, _, err := s.commit(ctx, func() ([]common.KVMutation, bool) {
+		// anche le chiavi scadute: il loop di expire non tocca più shard non nostri
+		var ops []common.KVMutation
+		n := s.shardCount()
+		s.store.Ascend("", "", func(k string, _ common.KVEntry) bool {
+			if common.ShardOf(k, n) == args.Shard {
+				ops = append(ops, common.KVMutation{Op: common.KVOpDelete, Key: k})
+			}
+			return true
+		})
+		count = len(ops)
+		// lo sblocco viaggia nello stesso batch, anche se lo shard era vuoto
+		delete(s.frozen, args.Shard)
+		return ops, true
+	}, true)
+	if err != nil {
+		return err
+	}
+	log.Printf("[kv %s] shard %d dropped (%d keys), now owned by %s", s.id, args.Shard, count, owner)
+
+	reply.OK = true
+	reply.Count = count
+	reply.Seq = a.Seq
+	reply.From = s.id
+	return nil
+}
+
+// -------- RPC: UnfreezeShard (annulla uno spostamento) --------
+func (s *KVService) UnfreezeShard(args *common.ShardArgs, reply *common.ShardReply) error {
+	if args == nil {
+		args = &common.ShardArgs{}
+	}
+	if !s.isPrimary() {
+		reply.From, reply.RedirectTo, _ = s.redirect()
+		return nil
+	}
+	ctx, cancel := rpcctx.Context(args)
+	defer cancel()
+	if _, _, err := s.commit(ctx, func() ([]common.KVMutation, bool) {
+		delete(s.frozen, args.Shard)
+		return nil, true
+	}, true); err != nil {
+		return err
+	}
+	reply.OK = true
+	reply.From = s.id
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"example.com/service-registry-lb/common"
+)
+
+const (
+	maxLogEvents    = 4096 // eventi trattenuti per Watch su ogni replica
+	maxWatchEvents  = 1000 // eventi massimi per risposta
+	defaultWatchTTL = 30 * time.Second
+	maxWatchTTL     = 2 * time.Minute
+)
+
+// changeLog is the per-replica history served by KV.Watch. It is guarded by KVService.mu.
+type changeLog struct {
+	events []common.KVEvent
+	start  int64         // tutti gli eventi con Seq > start sono presenti
+	notify chan struct{} // chiuso (e sostituito) ad ogni commit
+}
+
+func newChangeLog() *changeLog {
+	return &changeLog{notify: make(chan struct{})}
+}
+
+// append records the mutations of one applied batch and wakes up watchers.
+func (l *changeLog) append(a *common.ApplyArgs) {
+	for _, m := range a.Ops {
+		l.events = append(l.events, common.KVEvent{Seq: a.Seq, Op: m.Op, Key: m.Key, Value: m.Value, Version: m.Version})
+	}
+	if len(l.events) > maxLogEvents+maxLogEvents/4 {
+		// scarto batch interi: un Seq è presente tutto o niente
+		drop := len(l.events) - maxLogEvents
+		for drop < len(l.events) && l.events[drop].Seq == l.events[drop-1].Seq {
+			drop++
+		}
+		l.start = l.events[drop-1].Seq
+		l.events = append([]common.KVEvent(nil), l.events[drop:]...)
+	}
+	l.wake()
+}
+
+// reset drops the history after the state was replaced by a snapshot at seq.
+func (l *changeLog) reset(seq int64) {
+	l.events = nil
+	l.start = seq
+	l.wake()
+}
+
+func (l *changeLog) wake() {
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// since returns the matching events with Seq > from (whole batches, at most maxWatchEvents)
+// and the seq to resume from. compacted is true if part of that range was already dropped.
+func (l *changeLog) since(from int64, match func(key string) bool) (evs []common.KVEvent, upTo int64, compacted bool) {
+	if from < l.start {
+		return nil, 0, true
+	}
+	for i, e := range l.events {
+		if e.Seq <= from {
+			continue
+		}
+		if len(evs) >= maxWatchEvents && e.Seq != l.events[i-1].Seq {
+			return evs, l.events[i-1].Seq, false
+		}
+		if match(e.Key) {
+			evs = append(evs, e)
+		}
+	}
+	return evs, -1, false
+}
+
+// -------- RPC: Watch (su primary e backup) --------
+func (s *KVService) Watch(args *common.WatchArgs, reply *common.WatchReply) error {
+	if args == nil {
+		args = &common.WatchArgs{}
+	}
+	match := func(key string) bool { return key == args.Key }
+	if args.Prefix {
+		match = func(key string) bool { return strings.HasPrefix(key, args.Key) }
+	} else if err := s.checkOwner(args.Key); err != nil {
+		return err
+	}
+	wait := args.Timeout
+	if wait <= 0 {
+		wait = defaultWatchTTL
+	}
+	if wait > maxWatchTTL {
+		wait = maxWatchTTL
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	reply.From = s.id
+	from := args.FromSeq
+	for {
+		s.mu.RLock()
+		if from < 0 {
+			from = s.lastApply
+		}
+		evs, upTo, compacted := s.changes.since(from, match)
+		last := s.lastApply
+		notify := s.changes.notify
+		s.mu.RUnlock()
+
+		if upTo < 0 {
+			upTo = last
+		}
+		if compacted || len(evs) > 0 {
+			reply.Events = evs
+			reply.LastSeq = upTo
+			reply.Compacted = compacted
+			if compacted {
+				reply.LastSeq = last
+			}
+			return nil
+		}
+		// niente di nuovo per questa chiave: avanzo il cursore e aspetto
+		from = upTo
+		select {
+		case <-notify:
+		case <-timer.C:
+			reply.LastSeq = from
+			return nil
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"example.com/service-registry-lb/common"
+)
+
+func all(string) bool { return true }
+
+// batch returns the ApplyArgs of seq with n puts on distinct keys.
+func batch(seq int64, n int) *common.ApplyArgs {
+	a := &common.ApplyArgs{Seq: seq}
+	for i := 0; i < n; i++ {
+		a.Ops = append(a.Ops, put(fmt.Sprintf("k%d", i), "v", seq))
+	}
+	return a
+}
+
+func TestChangeLogSince(t *testing.T) {
+	l := newChangeLog()
+	for seq := int64(1); seq <= 3; seq++ {
+		l.append(batch(seq, 2))
+	}
+	tests := []struct {
+		name      string
+		from      int64
+		match     func(string) bool
+		wantSeqs  []int64
+		compacted bool
+	}{
+		{"from start", 0, all, []int64{1, 1, 2, 2, 3, 3}, false},
+		{"from the middle", 2, all, []int64{3, 3}, false},
+		{"up to date", 3, all, nil, false},
+		{"ahead", 10, all, nil, false},
+		{"filtered", 0, func(k string) bool { return k == "k1" }, []int64{1, 2, 3}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			evs, upTo, compacted := l.since(tt.from, tt.match)
+			if compacted != tt.compacted || upTo != -1 {
+				t.Fatalf("upTo=%d compacted=%v", upTo, compacted)
+			}
+			if len(evs) != len(tt.wantSeqs) {
+				t.Fatalf("%d events, want %d", len(evs), len(tt.wantSeqs))
+			}
+			for i, e := range evs {
+				if e.Seq != tt.wantSeqs[i] {
+					t.Fatalf("event %d has seq %d, want %d", i, e.Seq, tt.wantSeqs[i])
+				}
+			}
+		})
+	}
+}
+
+func TestChangeLogCompaction(t *testing.T) {
+	l := newChangeLog()
+	// batch da 3 eventi: la soglia cade a metà di un batch
+	var seq int64
+	for len(l.events) <= maxLogEvents+maxLogEvents/4-3 {
+		seq++
+		l.append(batch(seq, 3))
+	}
+	if l.start != 0 {
+		t.Fatalf("compacted too early: start=%d", l.start)
+	}
+	seq++
+	l.append(batch(seq, 3))
+	if l.start == 0 || len(l.events) > maxLogEvents {
+		t.Fatalf("not compacted: start=%d, %d events", l.start, len(l.events))
+	}
+	if first := l.events[0].Seq; first != l.start+1 || l.events[1].Seq != first || l.events[2].Seq != first {
+		t.Fatalf("first retained batch %d is not whole (start %d)", first, l.start)
+	}
+
+	tests := []struct {
+		name      string
+		from      int64
+		compacted bool
+	}{
+		{"below the window", l.start - 1, true},
+		{"from zero", 0, true},
+		{"at the window start", l.start, false},
+		{"inside the window", seq - 1, false},
+	}
+	for _, tt := range tests {
+		if evs, _, compacted := l.since(tt.from, all); compacted != tt.compacted || compacted && evs != nil {
+			t.Errorf("%s: since(%d) compacted=%v with %d events, want %v", tt.name, tt.from, compacted, len(evs), tt.compacted)
+		}
+	}
+}
+
+func TestChangeLogCutsAtBatchBoundary(t *testing.T) {
+	l := newChangeLog()
+	// 3 batch da 600: il limite cade nel secondo, che esce intero; il terzo va nella risposta dopo
+	for seq := int64(1); seq <= 3; seq++ {
+		l.append(batch(seq, 600))
+	}
+	evs, upTo, _ := l.since(0, all)
+	if len(evs) != 1200 || upTo != 2 {
+		t.Fatalf("first page: %d events up to %d, want 1200 up to 2", len(evs), upTo)
+	}
+	evs, upTo, _ = l.since(upTo, all)
+	if len(evs) != 600 || upTo != -1 {
+		t.Fatalf("second page: %d events up to %d, want 600 and the end", len(evs), upTo)
+	}
+
+	// un batch più grande del limite esce comunque intero
+	l = newChangeLog()
+	l.append(batch(1, maxWatchEvents+10))
+	if evs, upTo, _ := l.since(0, all); len(evs) != maxWatchEvents+10 || upTo != -1 {
+		t.Fatalf("oversized batch: %d events up to %d", len(evs), upTo)
+	}
+}
+
+func TestChangeLogResetAfterSnapshot(t *testing.T) {
+	s := newTestService()
+	for i := 0; i < 3; i++ {
+		applyBatch(s, put("k", "v", 0))
+	}
+	notify := s.changes.notify
+	s.restoreLocked(&common.SnapshotReply{Epoch: 2, Seq: 10, State: map[string]common.KVEntry{"k": {Value: "new", Version: 7}}})
+
+	select {
+	case <-notify:
+	default:
+		t.Fatal("watchers not woken by the snapshot")
+	}
+	if len(s.changes.events) != 0 {
+		t.Fatalf("%d events kept across the snapshot", len(s.changes.events))
+	}
+	// la storia prima dello snapshot non c'è più: chi era indietro deve rileggere lo stato
+	for _, from := range []int64{0, 3, 9} {
+		if _, _, compacted := s.changes.since(from, all); !compacted {
+			t.Errorf("since(%d) after a snapshot at 10 not compacted", from)
+		}
+	}
+	if evs, upTo, compacted := s.changes.since(10, all); compacted || evs != nil || upTo != -1 {
+		t.Fatalf("since(10): %v %d %v", evs, upTo, compacted)
+	}
+	applyBatch(s, put("k", "after", 0))
+	if evs, _, _ := s.changes.since(10, all); len(evs) != 1 || evs[0].Seq != 11 {
+		t.Fatalf("events after the snapshot: %+v", evs)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/service-registry-lb/common"
+	"example.com/service-registry-lb/internal/cliout"
+	"example.com/service-registry-lb/internal/lb"
+)
+
+// instanceInfo is an instance as printed by list and describe.
+type instanceInfo struct {
+	Service      string
+	Instance     common.Instance
+	Healthy      bool
+	Maintenance  bool
+	Version      int64
+	RegisteredAt time.Time
+	LastSeen     time.Time
+}
+
+func (c *ctl) services(args []string) error {
+	if err := need(args, 0); err != nil {
+		return err
+	}
+	var rep common.ListServicesReply
+	if err := c.reg.Call("Registry.ListServices", &common.ListServicesArgs{}, &rep); err != nil {
+		return err
+	}
+	return c.print(rep.Services, func(t *cliout.TableWriter) {
+		t.Header("service", "instances", "healthy", "maintenance", "revision", "tags")
+		for _, s := range rep.Services {
+			t.Row(s.Name, s.Instances, s.Healthy, s.Maintenance, s.Revision, s.Tags)
+		}
+	})
+}
+
+func (c *ctl) list(args []string) error {
+	if err := need(args, 1, "<service>"); err != nil {
+		return err
+	}
+	var rep common.LookupReply
+	if err := c.reg.Call("Registry.Lookup", &common.LookupArgs{Service: args[0]}, &rep); err != nil {
+		return err
+	}
+	infos := make([]instanceInfo, 0, len(rep.Instances))
+	for _, inst := range rep.Instances {
+		info, err := c.get(args[0], inst.ID)
+		if err != nil {
+			return err
+		}
+		infos = append(infos, info)
+	}
+	return c.print(infos, func(t *cliout.TableWriter) {
+		t.Header("id", "addr", "weight", "healthy", "maintenance", "version", "last seen", "load", "meta")
+		for _, in := range infos {
+			t.Row(in.Instance.ID, in.Instance.Addr, in.Instance.Weight, in.Healthy, in.Maintenance,
+				in.Version, ago(in.LastSeen), loadSummary(in.Instance.Load), cliout.Pairs(in.Instance.Meta))
+		}
+	})
+}
+
+func (c *ctl) describe(args []string) error {
+	if err := need(args, 2, "<service>", "<id>"); err != nil {
+		return err
+	}
+	info, err := c.get(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	return c.printInstance(info)
+}
+
+func (c *ctl) deregister(args []string) error {
+	if err := need(args, 2, "<service>", "<id>"); err != nil {
+		return err
+	}
+	info, err := c.get(args[0], args[1])
+	if err != nil {
+		return err
+	}
+	var rep common.DeregisterReply
+	if err := c.reg.Call("Registry.Deregister", &common.DeregisterArgs{Service: args[0], ID: args[1]}, &rep); err != nil {
+		return err
+	}
+	if info.Healthy {
+		// un'istanza viva trova l'assenza al prossimo heartbeat e si registra di nuovo
+		fmt.Fprintf(os.Stderr, "warning: %s/%s is alive and will register again at its next heartbeat; use maintenance to stop its traffic\n",
+			args[0], args[1])
+	}
+	return c.print(rep, func(t *cliout.TableWriter) {
+		t.Row("deregistered", args[0]+"/"+args[1])
+	})
+}
+
+func (c *ctl) setWeight(args []string) error {
+	fs, ifVersion := updateFlags("set-weight")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := need(fs.Args(), 3, "<service>", "<id>", "<weight>"); err != nil {
+		return err
+	}
+	w, err := strconv.Atoi(fs.Arg(2))
+	if err != nil || w < 1 {
+		return fmt.Errorf("invalid weight %q", fs.Arg(2))
+	}
+	return c.update(common.UpdateInstanceArgs{Service: fs.Arg(0), ID: fs.Arg(1), Weight: w, ExpectedVersion: *ifVersion})
+}
+
+func (c *ctl) setMeta(args []string) error {
+	fs, ifVersion := updateFlags("set-meta")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 3 {
+		return fmt.Errorf("want <service> <id> key=value... (key= removes the key)")
+	}
+	meta := map[string]string{}
+	for _, kv := range fs.Args()[2:] {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("invalid metadata %q (want key=value)", kv)
+		}
+		meta[k] = v
+	}
+	return c.update(common.UpdateInstanceArgs{Service: fs.Arg(0), ID: fs.Arg(1), Meta: meta, ExpectedVersion: *ifVersion})
+}
+
+func (c *ctl) maintenance(args []string) error {
+	fs, ifVersion := updateFlags("maintenance")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := need(fs.Args(), 3, "<service>", "<id>", "on|off"); err != nil {
+		return err
+	}
+	u := common.UpdateInstanceArgs{Service: fs.Arg(0), ID: fs.Arg(1), ExpectedVersion: *ifVersion}
+	switch fs.Arg(2) {
+	case "on":
+		u.Meta = map[string]string{common.MetaMaintenance: "true"}
+	case "off":
+		u.Meta = map[string]string{common.MetaMaintenance: ""}
+	default:
+		return fmt.Errorf("want on or off, got %q", fs.Arg(2))
+	}
+	return c.update(u)
+}
+
+// updateFlags are the flags of the commands built on UpdateInstance.
+func updateFlags(name string) (*flag.FlagSet, *int64) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	v := fs.Int64("if-version", 0, "apply only if the instance is at this version (see describe)")
+	return fs, v
+}
+
+// update sends a partial update and prints the instance as it is afterwards.
+func (c *ctl) update(u common.UpdateInstanceArgs) error {
+	var rep common.UpdateInstanceReply
+	if err := c.reg.Call("Registry.UpdateInstance", &u, &rep); err != nil {
+		return err
+	}
+	if !rep.Found {
+		return fmt.Errorf("no instance %s/%s", u.Service, u.ID)
+	}
+	if !rep.OK {
+		return fmt.Errorf("version mismatch: %s/%s is at version %d, not %d", u.Service, u.ID, rep.Version, u.ExpectedVersion)
+	}
+	info, err := c.get(u.Service, u.ID)
+	if err != nil {
+		return err
+	}
+	return c.printInstance(info)
+}
+
+func (c *ctl) get(service, id string) (instanceInfo, error) {
+	var rep common.GetInstanceReply
+	if err := c.reg.Call("Registry.GetInstance", &common.GetInstanceArgs{Service: service, ID: id}, &rep); err != nil {
+		return instanceInfo{}, err
+	}
+	if !rep.Found {
+		return instanceInfo{}, fmt.Errorf("no instance %s/%s", service, id)
+	}
+	return instanceInfo{Service: service, Instance: rep.Instance, Healthy: rep.Healthy,
+		Maintenance: common.InMaintenance(rep.Instance), Version: rep.Version, RegisteredAt: rep.RegisteredAt,
+		LastSeen: rep.LastSeen}, nil
+}
+
+func (c *ctl) printInstance(in instanceInfo) error {
+	return c.print(in, func(t *cliout.TableWriter) {
+		t.Row("service", in.Service)
+		t.Row("id", in.Instance.ID)
+		t.Row("addr", in.Instance.Addr)
+		t.Row("weight", in.Instance.Weight)
+		t.Row("meta", cliout.Pairs(in.Instance.Meta))
+		t.Row("healthy", in.Healthy)
+		t.Row("maintenance", in.Maintenance)
+		t.Row("version", in.Version)
+		t.Row("registered", in.RegisteredAt.Format(time.RFC3339))
+		t.Row("last seen", ago(in.LastSeen))
+		t.Row("load", loadSummary(in.Instance.Load))
+		t.Row("adaptive weight", fmt.Sprintf("%.2f", lb.EffectiveWeight(in.Instance, time.Now())))
+	})
+}
+
+// loadSummary formats the load reported by an instance ("" if it never did).
+func loadSummary(l common.Load) string {
+	if l.ReportedAt.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("cpu=%.0f%% inflight=%.1f queue=%d qps=%.1f (%s)",
+		l.CPU*100, l.InFlight, l.Queue, l.QPS, ago(l.ReportedAt))
+}
+
+func ago(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return time.Since(t).Round(time.Second).String() + " ago"
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"example.com/service-registry-lb/internal/cliout"
+	"example.com/service-registry-lb/internal/rpcctx"
+)
+
+const usage = `usage: regctl [-registry host:port] [-o table|json|yaml] <command> [args]
+
+commands:
+  services                               catalog: instances, healthy, in maintenance, tags
+  list <service>                         instances of a service with their health
+  describe <service> <id>                one instance
+  deregister <service> <id>              force-remove an instance
+  set-weight <service> <id> <weight>     change the weight (pickers follow it on refresh)
+  set-meta <service> <id> key=value...   set metadata keys (key= removes one)
+  maintenance <service> <id> on|off      stop/resume traffic to an instance, keeping it registered
+                                         (set-weight, set-meta and maintenance take -if-version N)
+  dump [file]                            save instances, shard maps and config as JSON (stdout if no file)
+  restore [-replace] <file>              load a dump (merged, or replacing the current state)
+  watch [-interval 1s] [service]         print instance changes as they happen
+`
+
+func main() {
+	registryAddr := flag.String("registry", "localhost:9000", "registry address host:port")
+	output := flag.String("o", "table", "output format: table|json|yaml")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage+"\nflags:\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	format, err := cliout.ParseFormat(*output)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	conn, err := rpcctx.Dial(*registryAddr)
+	if err != nil {
+		log.Fatalf("dial registry: %v", err)
+	}
+	defer conn.Close()
+	c := &ctl{reg: &rpcctx.Client{Client: conn}, format: format}
+
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+	run, ok := commands[cmd]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", cmd)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := run(c, args); err != nil {
+		log.Fatalf("%s: %v", cmd, err)
+	}
+}
+
+var commands = map[string]func(c *ctl, args []string) error{
+	"services":    (*ctl).services,
+	"list":        (*ctl).list,
+	"describe":    (*ctl).describe,
+	"deregister":  (*ctl).deregister,
+	"set-weight":  (*ctl).setWeight,
+	"set-meta":    (*ctl).setMeta,
+	"maintenance": (*ctl).maintenance,
+	"dump":        (*ctl).dump,
+	"restore":     (*ctl).restore,
+	"watch":       (*ctl).watch,
+}
+
+type ctl struct {
+	reg    *rpcctx.Client
+	format cliout.Format
+}
+
+// print writes v in the chosen format; table renders the table form.
+func (c *ctl) print(v any, table func(t *cliout.TableWriter)) error {
+	return cliout.Write(os.Stdout, c.format, v, table)
+}
+
+// need checks the number of positional arguments.
+func need(args []string, n int, names ...string) error {
+	if len(args) != n {
+		return fmt.Errorf("want %d arguments: %s", n, strings.Join(names, " "))
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"example.com/service-registry-lb/common"
+	"example.com/service-registry-lb/internal/cliout"
+)
+
+// dump saves the registry state as JSON: the file format does not depend on -o.
+func (c *ctl) dump(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("want at most 1 argument: [file]")
+	}
+	var rep common.DumpReply
+	if err := c.reg.Call("Registry.Dump", &common.DumpArgs{}, &rep); err != nil {
+		return err
+	}
+	if len(args) == 0 || args[0] == "-" {
+		return cliout.WriteJSON(os.Stdout, rep)
+	}
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	if err := cliout.WriteJSON(f, rep); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	instances := 0
+	for _, insts := range rep.State.Services {
+		instances += len(insts)
+	}
+	fmt.Fprintf(os.Stderr, "saved %d services (%d instances), %d shard maps, %d config entries to %s\n",
+		len(rep.State.Services), instances, len(rep.State.ShardMaps), len(rep.State.Config), args[0])
+	return nil
+}
+
+func (c *ctl) restore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	replace := fs.Bool("replace", false, "remove what the dump does not contain (default: merge)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("want 1 argument: <file> (- for stdin)")
+	}
+	var r io.Reader = os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	var saved common.DumpReply
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&saved); err != nil {
+		return fmt.Errorf("read dump: %w", err)
+	}
+	var rep common.RestoreReply
+	if err := c.reg.Call("Registry.Restore", &common.RestoreArgs{State: saved.State, Replace: *replace}, &rep); err != nil {
+		return err
+	}
+	return c.print(rep, func(t *cliout.TableWriter) {
+		t.Row("restored from", fs.Arg(0))
+		t.Row("taken at", saved.TakenAt.Format("2006-01-02 15:04:05"))
+		t.Row("instances", rep.Instances)
+		t.Row("shard maps", rep.ShardMaps)
+		t.Row("config entries", rep.Config)
+		t.Row("replace", *replace)
+	})
+}
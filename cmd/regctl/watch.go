@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"sort"
+	"time"
+
+	"example.com/service-registry-lb/common"
+	"example.com/service-registry-lb/internal/cliout"
+)
+
+// event is one instance change printed by watch.
+type event struct {
+	Time     time.Time
+	Service  string
+	Change   string // added | removed | updated
+	Instance common.Instance
+	Before   *common.Instance `json:",omitempty"` // solo updated
+}
+
+// watch follows one service with WatchService (changes arrive at once) or, with
+// no service, polls the catalog and looks up the services whose revision moved.
+func (c *ctl) watch(args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	interval := fs.Duration("interval", time.Second, "catalog polling interval when watching every service")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	switch fs.NArg() {
+	case 0:
+		return c.watchAll(*interval)
+	case 1:
+		return c.watchService(fs.Arg(0))
+	}
+	return fmt.Errorf("want at most 1 argument: [service]")
+}
+
+func (c *ctl) watchService(service string) error {
+	var cur common.LookupReply
+	if err := c.reg.Call("Registry.Lookup", &common.LookupArgs{Service: service}, &cur); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "watching %s: %d instances (revision %d)\n", service, len(cur.Instances), cur.Revision)
+	known, rev := cur.Instances, cur.Revision
+	for {
+		var rep common.WatchServiceReply
+		if err := c.reg.Call("Registry.WatchService", &common.WatchServiceArgs{Service: service, AfterRevision: rev}, &rep); err != nil {
+			return err
+		}
+		rev = rep.Revision
+		if !rep.Changed {
+			continue
+		}
+		if err := c.emit(diffInstances(service, known, rep.Instances)); err != nil {
+			return err
+		}
+		known = rep.Instances
+	}
+}
+
+func (c *ctl) watchAll(interval time.Duration) error {
+	known := map[string][]common.Instance{}
+	revs := map[string]int64{}
+	first := true
+	for ; ; time.Sleep(interval) {
+		var cat common.ListServicesReply
+		if err := c.reg.Call("Registry.ListServices", &common.ListServicesArgs{}, &cat); err != nil {
+			return err
+		}
+		listed := map[string]bool{}
+		var events []event
+		for _, s := range cat.Services {
+			listed[s.Name] = true
+			if revs[s.Name] == s.Revision {
+				continue
+			}
+			var rep common.LookupReply
+			if err := c.reg.Call("Registry.Lookup", &common.LookupArgs{Service: s.Name}, &rep); err != nil {
+				return err
+			}
+			if !first {
+				events = append(events, diffInstances(s.Name, known[s.Name], rep.Instances)...)
+			}
+			known[s.Name], revs[s.Name] = rep.Instances, rep.Revision
+		}
+		// servizi spariti dal catalogo: l'ultima istanza è stata rimossa
+		for name, insts := range known {
+			if !listed[name] {
+				events = append(events, diffInstances(name, insts, nil)...)
+				delete(known, name)
+				delete(revs, name)
+			}
+		}
+		if first {
+			fmt.Fprintf(os.Stderr, "watching %d services (polling every %s)\n", len(known), interval)
+			first = false
+		}
+		if err := c.emit(events); err != nil {
+			return err
+		}
+	}
+}
+
+// emit prints events one per line (table), as JSON lines or as YAML documents.
+func (c *ctl) emit(events []event) error {
+	for _, ev := range events {
+		var err error
+		switch c.format {
+		case cliout.JSON:
+			err = json.NewEncoder(os.Stdout).Encode(ev)
+		case cliout.YAML:
+			fmt.Println("---")
+			err = cliout.WriteYAML(os.Stdout, ev)
+		default:
+			fmt.Printf("%s %s %s %s\n", ev.Time.Format("15:04:05"), ev.Service, ev.Change, describeChange(ev))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func describeChange(ev event) string {
+	in := ev.Instance
+	s := fmt.Sprintf("%s addr=%s weight=%d", in.ID, in.Addr, in.Weight)
+	if ev.Before == nil {
+		return s
+	}
+	b := ev.Before
+	if b.Addr != in.Addr {
+		s += fmt.Sprintf(" (addr was %s)", b.Addr)
+	}
+	if b.Weight != in.Weight {
+		s += fmt.Sprintf(" (weight was %d)", b.Weight)
+	}
+	if common.InMaintenance(*b) != common.InMaintenance(in) {
+		s += fmt.Sprintf(" maintenance=%v", common.InMaintenance(in))
+	}
+	return s
+}
+
+func diffInstances(service string, before, after []common.Instance) []event {
+	now := time.Now()
+	old := make(map[string]common.Instance, len(before))
+	for _, in := range before {
+		old[in.ID] = in
+	}
+	var out []event
+	for _, in := range after {
+		prev, ok := old[in.ID]
+		delete(old, in.ID)
+		switch {
+		case !ok:
+			out = append(out, event{Time: now, Service: service, Change: "added", Instance: in})
+		case prev.Addr != in.Addr || prev.Weight != in.Weight || !maps.Equal(prev.Meta, in.Meta):
+			out = append(out, event{Time: now, Service: service, Change: "updated", Instance: in, Before: &prev})
+		}
+	}
+	gone := make([]string, 0, len(old))
+	for id := range old {
+		gone = append(gone, id)
+	}
+	sort.Strings(gone)
+	for _, id := range gone {
+		out = append(out, event{Time: now, Service: service, Change: "removed", Instance: old[id]})
+	}
+	return out
+}
@@ -8,20 +8,23 @@ import (
 	"net/rpc"
 
 	"example.com/service-registry-lb/internal/registry"
+	"example.com/service-registry-lb/internal/rpcctx"
 )
 
 func main() {
 	listen := flag.String("listen", ":9000", "registry listen address")
+	healthTTL := flag.Duration("health-ttl", registry.DefaultHealthTTL, "an instance is healthy if registered or heartbeated within this window")
 	flag.Parse()
 
 	reg := registry.New()
+	reg.SetHealthTTL(*healthTTL)
 
 	rpcServer := rpc.NewServer()
 	if err := rpcServer.RegisterName("Registry", reg); err != nil {
 		log.Fatalf("register rpc: %v", err)
 	}
-	// NOTE: HandleHTTP registers on DefaultServeMux, so we use ListenAndServe(..., nil).
-	rpcServer.HandleHTTP(rpc.DefaultRPCPath, rpc.DefaultDebugPath)
+	// NOTE: registers on DefaultServeMux (plain net/rpc and the path with deadlines), so we use ListenAndServe(..., nil).
+	rpcctx.Handle(http.DefaultServeMux, rpcServer, nil)
 
 	fmt.Printf("Service Registry listening on %s (RPC path %s)\n", *listen, rpc.DefaultRPCPath)
 	log.Fatal(http.ListenAndServe(*listen, nil))
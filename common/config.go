@@ -0,0 +1,73 @@
+package common
+
+import "time"
+
+// ConfigEntry is a configuration value stored in the registry.
+// Keys are hierarchical, "/"-separated paths (e.g. "echo/prefix", "echo/echo1/delay").
+type ConfigEntry struct {
+	Key      string
+	Value    string
+	Version  int64 // 1 alla creazione, +1 ad ogni modifica della chiave
+	Revision int64 // revisione globale del config store all'ultima modifica
+}
+
+// ConfigPut writes Key. With CAS set the write happens only if the current
+// version equals ExpectedVersion (0 = the key must not exist).
+type ConfigPutArgs struct {
+	Key             string
+	Value           string
+	CAS             bool
+	ExpectedVersion int64
+}
+
+type ConfigPutReply struct {
+	OK    bool        // false: versione diversa da ExpectedVersion
+	Entry ConfigEntry // entry scritta, o quella corrente se !OK
+}
+
+type ConfigGetArgs struct {
+	Key string
+}
+
+type ConfigGetReply struct {
+	Found bool
+	Entry ConfigEntry
+}
+
+// ConfigList returns the entries whose key starts with Prefix, sorted by key.
+type ConfigListArgs struct {
+	Prefix string
+}
+
+type ConfigListReply struct {
+	Entries  []ConfigEntry
+	Revision int64 // revisione del config store al momento della lettura
+}
+
+// ConfigDelete removes Key, with the same CAS rules as ConfigPut.
+type ConfigDeleteArgs struct {
+	Key             string
+	CAS             bool
+	ExpectedVersion int64
+}
+
+type ConfigDeleteReply struct {
+	OK      bool // false: versione diversa da ExpectedVersion
+	Deleted bool // false se la chiave non esisteva
+	Entry   ConfigEntry
+}
+
+// ConfigWatch long-polls the keys under Prefix: it returns as soon as one of them
+// is written or deleted after AfterRevision, or when Timeout (server default if 0)
+// expires. Pass the returned Revision as the next AfterRevision.
+type ConfigWatchArgs struct {
+	Prefix        string
+	AfterRevision int64
+	Timeout       time.Duration
+}
+
+type ConfigWatchReply struct {
+	Changed  bool
+	Entries  []ConfigEntry // stato corrente sotto Prefix (solo se Changed)
+	Revision int64
+}
@@ -1,43 +1,291 @@
 package common
 
+import "time"
+
+// Write kinds carried by KVMutation.Op and TxnOp.Op.
+const (
+	KVOpPut    = "put"
+	KVOpDelete = "delete"
+)
+
+// KVEntry is a stored value with its per-key version.
+// Versions grow on every write but are not consecutive: they come from a counter
+// of the replica group, so a key deleted (or expired) and created again gets a
+// version it never had and a CompareAndSwap based on an old read fails.
+type KVEntry struct {
+	Value     string
+	Version   int64
+	ExpiresAt int64 // unix nanos (clock del primary), 0 = nessuna scadenza
+}
+
+// Expired reports whether the entry's TTL has elapsed at time now.
+func (e KVEntry) Expired(now time.Time) bool {
+	return e.ExpiresAt != 0 && now.UnixNano() >= e.ExpiresAt
+}
+
 // Put writes/overwrites a key.
+// TTL > 0 makes the key expire: the primary deletes it (replicated) once the TTL elapses.
 type PutArgs struct {
 	Key   string
 	Value string
+	TTL   time.Duration
 }
 
 type PutReply struct {
 	OK         bool
+	Version    int64  // versione della chiave dopo la scrittura
 	From       string // instance id che ha risposto
 	RedirectTo string // se non-primary: host:port del primary (best effort)
+	Epoch      int64  // epoch del primary noto a chi ha risposto
+	Seq        int64  // seq del commit: token di sessione (con Epoch) da passare in GetArgs.MinSeq/MinEpoch
 }
 
+// Read consistency levels for GetArgs.Consistency.
+const (
+	ReadAny          = "any"          // stato locale della replica (default)
+	ReadBounded      = "bounded"      // al massimo MaxLag seq dietro al primary
+	ReadLinearizable = "linearizable" // read-index sul primary: vede ogni scrittura già confermata
+)
+
 // Get reads a key.
 type GetArgs struct {
-	Key string
+	Key         string
+	Consistency string // ReadAny ("" = any) | ReadBounded | ReadLinearizable
+	MaxLag      int64  // solo ReadBounded
+	// MinSeq gives read-your-writes: the replica must have applied at least this seq
+	// (the Seq of the session's last write). A replica still behind after a short
+	// wait sets RedirectTo instead of answering.
+	MinSeq int64
+	// MinEpoch is the epoch of the write that produced MinSeq: seqs are compared
+	// only within one epoch. A token from an older epoch is always satisfied (its
+	// committed writes were inherited by the new primary); 0 means the replica's epoch.
+	MinEpoch int64
 }
 
 type GetReply struct {
-	Found bool
+	Found   bool
+	Value   string
+	Version int64
+	Seq     int64  // seq applicato dalla replica al momento della lettura
+	Epoch   int64  // epoch della replica: con Seq forma il token di sessione
+	From    string // instance id che ha risposto
+	// RedirectTo is set (and the read not served) when this replica cannot meet
+	// the requested consistency: retry on the primary.
+	RedirectTo string
+}
+
+// ReadIndex returns the primary's current seq; a backup that has applied it
+// can serve a linearizable read.
+type ReadIndexArgs struct{}
+
+type ReadIndexReply struct {
+	Seq   int64
+	Epoch int64
+}
+
+// Scan returns keys in [StartKey, EndKey) in lexicographic order (EndKey "" = no upper bound).
+// At most Limit items are returned; NextCursor != "" means there is another page:
+// pass it back as Cursor to continue after the last returned key.
+type ScanArgs struct {
+	StartKey string
+	EndKey   string
+	Limit    int
+	Cursor   string
+}
+
+// KVItem is a key with its live entry, as returned by Scan.
+type KVItem struct {
+	Key     string
+	Value   string
+	Version int64
+}
+
+type ScanReply struct {
+	Items      []KVItem
+	NextCursor string
+	From       string
+}
+
+// List returns the keys starting with Prefix, paginated like Scan.
+type ListArgs struct {
+	Prefix string
+	Limit  int
+	Cursor string
+}
+
+type ListReply struct {
+	Keys       []string
+	NextCursor string
+	From       string
+}
+
+// Delete removes a key (solo primary).
+type DeleteArgs struct {
+	Key string
+}
+
+type DeleteReply struct {
+	OK         bool
+	Deleted    bool // false se la chiave non esisteva
+	From       string
+	RedirectTo string
+	Epoch      int64
+	Seq        int64 // seq del commit (o dello stato letto se la condizione è fallita)
+}
+
+// CompareAndSwap writes Value only if the current version of Key equals ExpectedVersion.
+// ExpectedVersion 0 means "the key must not exist".
+type CASArgs struct {
+	Key             string
+	ExpectedVersion int64
+	Value           string
+	TTL             time.Duration
+}
+
+type CASReply struct {
+	OK         bool
+	Swapped    bool
+	Version    int64 // versione corrente (nuova se Swapped, altrimenti quella che ha fatto fallire il confronto)
+	From       string
+	RedirectTo string
+	Epoch      int64
+	Seq        int64 // seq del commit (o dello stato letto se la condizione è fallita)
+}
+
+// PutIfAbsent writes a key only if it does not exist yet.
+type PutIfAbsentReply struct {
+	OK         bool
+	Stored     bool
+	Value      string // valore corrente se la chiave esisteva già
+	Version    int64
+	From       string
+	RedirectTo string
+	Epoch      int64
+	Seq        int64 // seq del commit (o dello stato letto se la condizione è fallita)
+}
+
+// Txn applies Ops atomically on the primary if every compare holds.
+// Readers on any replica never observe a partial transaction.
+type TxnArgs struct {
+	Compares []TxnCompare
+	Ops      []TxnOp
+}
+
+// TxnCompare requires the current version of Key to equal Version (0 = key absent).
+type TxnCompare struct {
+	Key     string
+	Version int64
+}
+
+// TxnOp is a single write of a transaction; every key may appear at most once.
+type TxnOp struct {
+	Op    string // KVOpPut | KVOpDelete
+	Key   string
 	Value string
-	From  string // instance id che ha risposto
+	TTL   time.Duration
+}
+
+type TxnReply struct {
+	OK         bool
+	Succeeded  bool
+	Versions   []int64      // versione di ogni op dopo il commit (0 per delete)
+	Conflicts  []TxnCompare // se !Succeeded: i confronti falliti con la versione corrente
+	From       string
+	RedirectTo string
+	Epoch      int64
+	Seq        int64 // seq del commit (o dello stato letto se la condizione è fallita)
+}
+
+// Watch long-polls the change log of a replica (primary or backup).
+// Key selects one key, or every key starting with it if Prefix is set (Key "" + Prefix = all keys).
+// Events with Seq > FromSeq are returned; FromSeq < 0 means "from the replica's current seq".
+// The call blocks up to Timeout (server default if 0) when there is nothing to return.
+type WatchArgs struct {
+	Key     string
+	Prefix  bool
+	FromSeq int64
+	Timeout time.Duration
+}
+
+// KVEvent is a committed change; events of the same Txn share Seq.
+type KVEvent struct {
+	Seq     int64
+	Op      string // KVOpPut | KVOpDelete
+	Key     string
+	Value   string
+	Version int64
+}
+
+type WatchReply struct {
+	Events []KVEvent
+	// LastSeq is the replica's applied seq when replying: pass it as the next FromSeq.
+	LastSeq int64
+	// Compacted means events after FromSeq are no longer retained: re-read the state
+	// (Get/Scan) and resume watching from LastSeq.
+	Compacted bool
+	From      string
+}
+
+// KVMutation is one replicated write, with version/expiry already decided by the primary.
+type KVMutation struct {
+	Op        string // KVOpPut | KVOpDelete
+	Key       string
+	Value     string
+	Version   int64 // versione assegnata dal primary (solo put)
+	ExpiresAt int64 // scadenza assoluta decisa dal primary (solo put)
 }
 
 // Apply è la replica (primary -> backup).
+// Epoch is the fencing token of the sending primary: backups reject stale epochs.
+// All Ops share the same Seq and are applied all-or-nothing.
 type ApplyArgs struct {
+	Epoch int64
 	Seq   int64
-	Key   string
-	Value string
+	Ops   []KVMutation
+	// MapVersion is the shard map version known by the primary: a backup with an
+	// older map refreshes it before applying, so both agree on shard ownership.
+	MapVersion int64
+	// Frozen are the shards the primary is moving out after this batch: a backup
+	// that takes over keeps refusing their writes until DropShard/UnfreezeShard.
+	Frozen []int
 }
 
 type ApplyReply struct {
-	OK bool
+	OK    bool
+	Epoch int64 // epoch corrente del backup (se > Args.Epoch il mittente è stato destituito)
 }
 
 // Snapshot: bootstrap dello stato (backup -> primary) all'avvio.
 type SnapshotArgs struct{}
 
 type SnapshotReply struct {
-	Seq   int64
-	State map[string]string
+	Epoch  int64
+	Seq    int64
+	State  map[string]KVEntry
+	Frozen []int // shard congelati dal primary (vedi ApplyArgs.Frozen)
+	// MaxVersion is the highest key version assigned so far, deleted keys included.
+	MaxVersion int64
+}
+
+// Shard movement (rebalancing), all served by the primary of a group:
+//   - ExportShard freezes writes to Shard on the source group and returns its entries;
+//   - ImportShard writes them on the destination group (replicated like any write);
+//   - after the registry shard map is switched, DropShard deletes the shard from
+//     the source and lifts the freeze (UnfreezeShard lifts it without deleting, to abort).
+type ShardArgs struct {
+	Shard int
+}
+
+type ImportShardArgs struct {
+	Shard int
+	Items map[string]KVEntry
+}
+
+type ShardReply struct {
+	OK         bool
+	Items      map[string]KVEntry // solo ExportShard
+	Count      int                // chiavi esportate/importate/cancellate
+	Seq        int64
+	From       string
+	RedirectTo string
 }
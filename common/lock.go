@@ -0,0 +1,114 @@
+package common
+
+import "time"
+
+// DefaultLockTTL is the lease duration the registry grants when TTL is 0.
+const DefaultLockTTL = 10 * time.Second
+
+// AcquireLock takes the named lease for Owner if it is free, expired or already
+// held by Owner (in which case it is just extended). The lease lasts TTL unless renewed.
+// Value is published to the other contenders (e.g. the holder's address).
+type AcquireLockArgs struct {
+	Name  string
+	Owner string
+	Value string
+	TTL   time.Duration
+	// MinToken makes the granted token greater than a fencing token the caller has
+	// already seen (e.g. after a registry restart lost the counters); a holder whose
+	// token is not greater gets a new one.
+	MinToken int64
+}
+
+type AcquireLockReply struct {
+	Acquired bool
+	// Token is the fencing token of the current holding: it grows every time the
+	// lock changes owner, never on renewals.
+	Token  int64
+	Holder string // owner corrente (se !Acquired: chi lo tiene)
+	Value  string
+	TTL    time.Duration // durata residua del lease
+}
+
+// RenewLock extends a lease still held by Owner with the given Token.
+type RenewLockArgs struct {
+	Name  string
+	Owner string
+	Token int64
+	TTL   time.Duration
+}
+
+type RenewLockReply struct {
+	OK     bool // false: lease scaduto o preso da un altro owner
+	Holder string
+	Token  int64
+}
+
+// GetLock reads the current holder of a lease without taking it.
+type GetLockArgs struct {
+	Name string
+}
+
+type GetLockReply struct {
+	Held   bool
+	Holder string
+	Value  string
+	Token  int64
+	TTL    time.Duration
+}
+
+// ReleaseLock frees a lease held by Owner with Token (no-op if already lost).
+type ReleaseLockArgs struct {
+	Name  string
+	Owner string
+	Token int64
+}
+
+type ReleaseLockReply struct {
+	OK bool // false: il lease non era (più) di Owner
+}
+
+// WatchLock blocks until the holding of Name differs from (Holder, Token), i.e.
+// the lock was taken, released, expired or changed owner, or until Timeout
+// (server default if 0). Pass the last seen holder and token; "" and 0 mean free.
+type WatchLockArgs struct {
+	Name    string
+	Holder  string
+	Token   int64
+	Timeout time.Duration
+}
+
+type WatchLockReply struct {
+	Changed bool // false: timeout senza cambi
+	Held    bool
+	Holder  string
+	Value   string
+	Token   int64
+	TTL     time.Duration
+}
+
+// AcquireSemaphore takes one of Limit slots of Name for Owner (or extends the
+// slot Owner already holds). Limit is fixed by the first acquirer; every slot is
+// a lease lasting TTL unless renewed.
+type AcquireSemaphoreArgs struct {
+	Name  string
+	Owner string
+	Limit int
+	TTL   time.Duration
+}
+
+type AcquireSemaphoreReply struct {
+	Acquired bool
+	Limit    int
+	Holders  []string // owner dei posti occupati, in ordine di acquisizione
+}
+
+// RenewSemaphore extends the slot of Owner; ReleaseSemaphore frees it.
+type SemaphoreArgs struct {
+	Name  string
+	Owner string
+	TTL   time.Duration // solo RenewSemaphore
+}
+
+type SemaphoreReply struct {
+	OK bool // false: Owner non aveva (più) un posto
+}
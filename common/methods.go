@@ -0,0 +1,89 @@
+package common
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// methodTypes maps "Service.Method" to the argument and reply types of the
+// user-facing RPCs (internal replication and migration calls are left out),
+// so that generic tools (cmd/client -method) can build them from JSON.
+// A new service only needs RegisterMethod next to its Args/Reply types.
+var methodTypes = map[string][2]reflect.Type{}
+
+// RegisterMethod records the types of an RPC; args and reply are zero values
+// of the structs (e.g. RegisterMethod("Echo.Echo", EchoArgs{}, EchoReply{})).
+func RegisterMethod(name string, args, reply any) {
+	methodTypes[name] = [2]reflect.Type{reflect.TypeOf(args), reflect.TypeOf(reply)}
+}
+
+// NewMethodValues returns new pointers to the argument and reply of method.
+func NewMethodValues(method string) (args, reply any, err error) {
+	t, ok := methodTypes[method]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown method %q", method)
+	}
+	return reflect.New(t[0]).Interface(), reflect.New(t[1]).Interface(), nil
+}
+
+// MethodService is the registry service of "Service.Method" (e.g. Math.Add -> math).
+func MethodService(method string) string {
+	svc, _, _ := strings.Cut(method, ".")
+	return strings.ToLower(svc)
+}
+
+// Methods returns the registered method names, sorted.
+func Methods() []string {
+	out := make([]string, 0, len(methodTypes))
+	for m := range methodTypes {
+		out = append(out, m)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func init() {
+	RegisterMethod("Echo.Echo", EchoArgs{}, EchoReply{})
+	RegisterMethod("Math.Add", AddArgs{}, AddReply{})
+
+	RegisterMethod("KV.Get", GetArgs{}, GetReply{})
+	RegisterMethod("KV.Put", PutArgs{}, PutReply{})
+	RegisterMethod("KV.Delete", DeleteArgs{}, DeleteReply{})
+	RegisterMethod("KV.CompareAndSwap", CASArgs{}, CASReply{})
+	RegisterMethod("KV.PutIfAbsent", PutArgs{}, PutIfAbsentReply{})
+	RegisterMethod("KV.Scan", ScanArgs{}, ScanReply{})
+	RegisterMethod("KV.List", ListArgs{}, ListReply{})
+	RegisterMethod("KV.Txn", TxnArgs{}, TxnReply{})
+	RegisterMethod("KV.Watch", WatchArgs{}, WatchReply{})
+	RegisterMethod("KV.ReadIndex", ReadIndexArgs{}, ReadIndexReply{})
+	// niente KV.Apply/Snapshot (replica) né Export/Import/Drop/UnfreezeShard
+	// (spostamento shard): una chiamata a mano rompe la sequenza di un backup o cancella dati
+
+	RegisterMethod("Registry.Register", RegisterArgs{}, RegisterReply{})
+	RegisterMethod("Registry.Deregister", DeregisterArgs{}, DeregisterReply{})
+	RegisterMethod("Registry.Lookup", LookupArgs{}, LookupReply{})
+	RegisterMethod("Registry.WatchService", WatchServiceArgs{}, WatchServiceReply{})
+	RegisterMethod("Registry.Heartbeat", HeartbeatArgs{}, HeartbeatReply{})
+	RegisterMethod("Registry.ListServices", ListServicesArgs{}, ListServicesReply{})
+	RegisterMethod("Registry.GetInstance", GetInstanceArgs{}, GetInstanceReply{})
+	RegisterMethod("Registry.UpdateInstance", UpdateInstanceArgs{}, UpdateInstanceReply{})
+	RegisterMethod("Registry.Dump", DumpArgs{}, DumpReply{})
+	RegisterMethod("Registry.Restore", RestoreArgs{}, RestoreReply{})
+	RegisterMethod("Registry.GetShardMap", GetShardMapArgs{}, GetShardMapReply{})
+	RegisterMethod("Registry.SetShardMap", SetShardMapArgs{}, SetShardMapReply{})
+	RegisterMethod("Registry.AcquireLock", AcquireLockArgs{}, AcquireLockReply{})
+	RegisterMethod("Registry.RenewLock", RenewLockArgs{}, RenewLockReply{})
+	RegisterMethod("Registry.GetLock", GetLockArgs{}, GetLockReply{})
+	RegisterMethod("Registry.ReleaseLock", ReleaseLockArgs{}, ReleaseLockReply{})
+	RegisterMethod("Registry.WatchLock", WatchLockArgs{}, WatchLockReply{})
+	RegisterMethod("Registry.AcquireSemaphore", AcquireSemaphoreArgs{}, AcquireSemaphoreReply{})
+	RegisterMethod("Registry.RenewSemaphore", SemaphoreArgs{}, SemaphoreReply{})
+	RegisterMethod("Registry.ReleaseSemaphore", SemaphoreArgs{}, SemaphoreReply{})
+	RegisterMethod("Registry.ConfigPut", ConfigPutArgs{}, ConfigPutReply{})
+	RegisterMethod("Registry.ConfigGet", ConfigGetArgs{}, ConfigGetReply{})
+	RegisterMethod("Registry.ConfigList", ConfigListArgs{}, ConfigListReply{})
+	RegisterMethod("Registry.ConfigDelete", ConfigDeleteArgs{}, ConfigDeleteReply{})
+	RegisterMethod("Registry.ConfigWatch", ConfigWatchArgs{}, ConfigWatchReply{})
+}
@@ -1,5 +1,7 @@
 package common
 
+import "time"
+
 // Instance describes a running server instance of a service.
 // Addr should be reachable by clients (e.g. "echo1:9101" inside docker-compose network).
 type Instance struct {
@@ -7,6 +9,26 @@ type Instance struct {
 	Addr   string            // host:port
 	Weight int               // used by stateful/weighted load balancing
 	Meta   map[string]string // optional metadata (e.g. {"zone":"A"})
+	Load   Load              // ultimo carico dagli heartbeat: non cambia la revisione del servizio
+}
+
+// Load is what an instance reports about its load with each heartbeat; the
+// adaptive picker (internal/lb) turns it into an effective weight.
+type Load struct {
+	CPU        float64   // frazione di CPU usata dal processo, 0..1 su tutti i core
+	InFlight   float64   // richieste in corso, in media sull'ultimo intervallo
+	Queue      int       // richieste in attesa di essere servite (se il servizio ha una coda)
+	QPS        float64   // richieste completate al secondo nell'ultimo intervallo
+	ReportedAt time.Time // ricezione nel registry (zero = mai riportato)
+}
+
+// MetaMaintenance marks an instance in maintenance (Meta["maintenance"] = "true"):
+// it stays registered but the pickers send it no traffic.
+const MetaMaintenance = "maintenance"
+
+// InMaintenance reports whether inst is in maintenance.
+func InMaintenance(inst Instance) bool {
+	return inst.Meta[MetaMaintenance] == "true"
 }
 
 type RegisterArgs struct {
@@ -33,4 +55,151 @@ type LookupArgs struct {
 
 type LookupReply struct {
 	Instances []Instance
+	Revision  int64 // ultima modifica del servizio: da passare a WatchService
+}
+
+// WatchService long-polls the instances of Service: it returns as soon as the set
+// changes after AfterRevision (an instance registered, deregistered or updated)
+// or when Timeout (server default if 0) expires. Pass the returned Revision as
+// the next AfterRevision.
+type WatchServiceArgs struct {
+	Service       string
+	AfterRevision int64
+	Timeout       time.Duration
+}
+
+type WatchServiceReply struct {
+	Changed   bool
+	Instances []Instance // lista corrente (solo se Changed)
+	Revision  int64
+}
+
+// GetShardMap reads the shard map of a sharded service (e.g. "kv").
+type GetShardMapArgs struct {
+	Service string
+}
+
+type GetShardMapReply struct {
+	Found bool
+	Map   ShardMap
+}
+
+// SetShardMap replaces the shard map only if the stored version equals
+// ExpectedVersion (0 = no map yet); the stored version becomes ExpectedVersion+1.
+type SetShardMapArgs struct {
+	Service         string
+	ExpectedVersion int64
+	Groups          []string
+}
+
+type SetShardMapReply struct {
+	OK  bool // false: versione diversa, Map contiene quella corrente
+	Map ShardMap
+}
+
+// PublishShardMap stores Map as it is (version included) if it is newer than
+// the stored one. kv instances use it to put back the map they know after the
+// registry lost it (e.g. a restart); changes go through SetShardMap.
+type PublishShardMapArgs struct {
+	Service string
+	Map     ShardMap
+}
+
+type PublishShardMapReply struct {
+	OK  bool // false: il registry ha già una versione uguale o più recente (in Map)
+	Map ShardMap
+}
+
+// Heartbeat tells the registry that an instance is alive, optionally with its
+// current Load. Found is false when the registry does not know the instance
+// (e.g. it restarted): register it again.
+type HeartbeatArgs struct {
+	Service string
+	ID      string
+	Load    *Load // nil = nessun dato di carico
+}
+
+type HeartbeatReply struct {
+	Found bool
+}
+
+// ListServices returns the catalog of the registry, sorted by name.
+type ListServicesArgs struct{}
+
+type ListServicesReply struct {
+	Services []ServiceInfo
+}
+
+// ServiceInfo summarises one service of the catalog.
+type ServiceInfo struct {
+	Name        string
+	Instances   int
+	Healthy     int      // istanze con un heartbeat (o registrazione) recente
+	Maintenance int      // istanze in manutenzione (escluse dai picker)
+	Tags        []string // coppie "key=value" dei Meta delle istanze, ordinate e senza duplicati
+	Revision    int64
+}
+
+// GetInstance reads one instance with its health.
+type GetInstanceArgs struct {
+	Service string
+	ID      string
+}
+
+type GetInstanceReply struct {
+	Found        bool
+	Instance     Instance
+	Healthy      bool
+	RegisteredAt time.Time // prima registrazione
+	LastSeen     time.Time // ultima registrazione o heartbeat
+	Version      int64     // 1 alla registrazione, +1 ad ogni modifica: per UpdateInstance
+}
+
+// UpdateInstance changes some fields of a registered instance, leaving the
+// others alone: Weight if > 0, and the Meta keys listed (an empty value removes
+// the key). With ExpectedVersion != 0 the update is applied only if the
+// instance is still at that version (see GetInstanceReply.Version).
+type UpdateInstanceArgs struct {
+	Service         string
+	ID              string
+	Weight          int
+	Meta            map[string]string
+	ExpectedVersion int64
+}
+
+type UpdateInstanceReply struct {
+	Found    bool
+	OK       bool     // false: versione diversa, Instance e Version sono quelli correnti
+	Instance Instance // istanza dopo la modifica
+	Version  int64
+}
+
+// RegistryState is the durable part of the registry (instances, shard maps and
+// config store) as saved by Dump and loaded by Restore. Locks and semaphores
+// are leases of live sessions and are not included.
+type RegistryState struct {
+	Services  map[string][]Instance
+	ShardMaps map[string]ShardMap
+	Config    []ConfigEntry
+}
+
+type DumpArgs struct{}
+
+type DumpReply struct {
+	State   RegistryState
+	TakenAt time.Time
+}
+
+// Restore loads State. With Replace the current instances, shard maps and config
+// entries missing from State are removed; otherwise State is merged over them.
+// Restored instances count as healthy only after their next heartbeat.
+type RestoreArgs struct {
+	State   RegistryState
+	Replace bool
+}
+
+type RestoreReply struct {
+	Instances int
+	ShardMaps int
+	Config    int
 }
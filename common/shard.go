@@ -0,0 +1,74 @@
+package common
+
+import (
+	"errors"
+	"hash/fnv"
+	"net/rpc"
+	"strings"
+	"time"
+)
+
+// DefaultGroup is the replica group of kv instances registered without Meta["group"].
+const DefaultGroup = "g0"
+
+// ShardMap assigns every hash slot of a sharded service to a replica group.
+// Groups[i] is the group (Instance.Meta["group"]) owning shard i.
+type ShardMap struct {
+	Version int64
+	Groups  []string
+}
+
+// ShardOf maps a key to one of n shards (fnv-1a).
+func ShardOf(key string, n int) int {
+	if n <= 0 {
+		return 0
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
+
+// GroupOf returns the group owning key ("" if the map is empty).
+func (m ShardMap) GroupOf(key string) string {
+	if len(m.Groups) == 0 {
+		return ""
+	}
+	return m.Groups[ShardOf(key, len(m.Groups))]
+}
+
+// GroupOfInstance returns the replica group an instance belongs to.
+func GroupOfInstance(inst Instance) string {
+	if g := inst.Meta["group"]; g != "" {
+		return g
+	}
+	return DefaultGroup
+}
+
+// Error prefixes returned by kv instances for keys they cannot serve right now:
+// the client should refresh the shard map and retry.
+const (
+	ErrWrongShard  = "wrong shard"
+	ErrShardMoving = "shard moving"
+)
+
+// Retries of a kv request rejected with one of the errors above, while a shard moves.
+const (
+	ShardRetries      = 5
+	ShardRetryBackoff = 300 * time.Millisecond
+)
+
+// IsShardRetryable reports whether err is one of the errors above, also when
+// the caller wrapped it ("KV.Get rpc call: wrong shard: ..."): net/rpc
+// flattens server errors to a string, so the prefix is matched on the
+// rpc.ServerError in the chain (or on the whole message if there is none).
+func IsShardRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	var se rpc.ServerError
+	if errors.As(err, &se) {
+		msg = string(se)
+	}
+	return strings.HasPrefix(msg, ErrWrongShard) || strings.HasPrefix(msg, ErrShardMoving)
+}
@@ -0,0 +1,49 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"testing"
+)
+
+func TestIsShardRetryable(t *testing.T) {
+	wrong := rpc.ServerError(ErrWrongShard + `: key "a" belongs to group g1 (map v3)`)
+	moving := rpc.ServerError(ErrShardMoving + ": shard 2 of key \"a\" is being moved, retry")
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"server error", wrong, true},
+		{"wrapped wrong shard", fmt.Errorf("KV.Get rpc call: %w", wrong), true},
+		{"wrapped twice", fmt.Errorf("KV.Put on kv1: %w", fmt.Errorf("%s on primary rpc call: %w", "KV.Put", moving)), true},
+		{"plain error", errors.New(ErrShardMoving + ": retry"), true},
+		{"other server error", fmt.Errorf("KV.Get rpc call: %w", rpc.ServerError("not primary")), false},
+		{"prefix not at start of server error", fmt.Errorf("x: %w", rpc.ServerError("copy failed: "+ErrWrongShard)), false},
+		{"transport error", fmt.Errorf("KV.Get rpc call: %w", rpc.ErrShutdown), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsShardRetryable(tt.err); got != tt.want {
+				t.Errorf("IsShardRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShardMapGroupOf(t *testing.T) {
+	m := ShardMap{Version: 1, Groups: []string{"g0", "g1", "g2", "g3"}}
+	for _, key := range []string{"", "a", "user:42", "ciao"} {
+		if got, want := m.GroupOf(key), m.Groups[ShardOf(key, 4)]; got != want {
+			t.Errorf("GroupOf(%q) = %q, want %q", key, got, want)
+		}
+	}
+	if g := (ShardMap{}).GroupOf("a"); g != "" {
+		t.Errorf("empty map: GroupOf = %q, want \"\"", g)
+	}
+	if s := ShardOf("a", 0); s != 0 {
+		t.Errorf("ShardOf(n=0) = %d, want 0", s)
+	}
+}
@@ -0,0 +1,114 @@
+// Package cliout renders the output of the command line tools (ctl, regctl)
+// as an aligned table for people or as JSON/YAML for scripts.
+package cliout
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+type Format string
+
+const (
+	Table Format = "table"
+	JSON  Format = "json"
+	YAML  Format = "yaml"
+)
+
+// Formats lists the accepted values of ParseFormat.
+var Formats = []string{string(Table), string(JSON), string(YAML)}
+
+// ParseFormat validates a format name ("" = table).
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case "", Table:
+		return Table, nil
+	case JSON, YAML:
+		return f, nil
+	case "yml":
+		return YAML, nil
+	}
+	return "", fmt.Errorf("unknown output format %q (use %s)", s, strings.Join(Formats, "|"))
+}
+
+// Write prints v in format f; table renders the table form.
+func Write(w io.Writer, f Format, v any, table func(t *TableWriter)) error {
+	switch f {
+	case JSON:
+		return WriteJSON(w, v)
+	case YAML:
+		return WriteYAML(w, v)
+	default:
+		t := NewTable(w)
+		table(t)
+		return t.Flush()
+	}
+}
+
+// WriteJSON prints v as indented JSON.
+func WriteJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// TableWriter aligns rows in columns separated by two spaces.
+type TableWriter struct {
+	tw *tabwriter.Writer
+}
+
+func NewTable(w io.Writer, header ...string) *TableWriter {
+	t := &TableWriter{tw: tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)}
+	if len(header) > 0 {
+		t.Header(header...)
+	}
+	return t
+}
+
+// Header writes the column names, upper case.
+func (t *TableWriter) Header(cols ...string) {
+	up := make([]any, len(cols))
+	for i, c := range cols {
+		up[i] = strings.ToUpper(c)
+	}
+	t.Row(up...)
+}
+
+// Row writes one line; values are printed with %v (empty slices as "-").
+func (t *TableWriter) Row(cols ...any) {
+	for i, c := range cols {
+		if i > 0 {
+			fmt.Fprint(t.tw, "\t")
+		}
+		switch v := c.(type) {
+		case []string:
+			if len(v) == 0 {
+				fmt.Fprint(t.tw, "-")
+			} else {
+				fmt.Fprint(t.tw, strings.Join(v, ","))
+			}
+		default:
+			fmt.Fprintf(t.tw, "%v", v)
+		}
+	}
+	fmt.Fprintln(t.tw)
+}
+
+func (t *TableWriter) Flush() error {
+	return t.tw.Flush()
+}
+
+// Pairs returns m as sorted "key=value" pairs, e.g. for a metadata column.
+func Pairs(m map[string]string) []string {
+	out := make([]string, 0, len(m))
+	for k, v := range m {
+		out = append(out, k+"="+v)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,190 @@
+package cliout
+
+import (
+	"encoding"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WriteYAML prints v as a YAML block document. It covers what the tools print
+// (structs, maps, slices, scalars, time values): struct fields keep their order
+// and their json name, map keys are sorted.
+func WriteYAML(w io.Writer, v any) error {
+	var b strings.Builder
+	rv := reflect.ValueOf(v)
+	if s, ok := yamlScalar(rv); ok {
+		b.WriteString(s + "\n")
+	} else if empty, ok := yamlEmpty(rv); ok {
+		b.WriteString(empty + "\n")
+	} else {
+		yamlBlock(&b, rv, 0)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var (
+	durationType      = reflect.TypeOf(time.Duration(0))
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// yamlBlock writes a non-empty struct, map or slice at the given indentation.
+func yamlBlock(b *strings.Builder, v reflect.Value, indent int) {
+	v = yamlDeref(v)
+	pad := strings.Repeat(" ", indent)
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, omitEmpty, ok := yamlFieldName(f)
+			if !ok || (omitEmpty && v.Field(i).IsZero()) {
+				continue
+			}
+			yamlEntry(b, pad, yamlQuote(name), v.Field(i), indent)
+		}
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+		for _, k := range keys {
+			yamlEntry(b, pad, yamlQuote(fmt.Sprint(k)), v.MapIndex(k), indent)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			e := v.Index(i)
+			if s, ok := yamlScalar(e); ok {
+				b.WriteString(pad + "- " + s + "\n")
+				continue
+			}
+			if empty, ok := yamlEmpty(e); ok {
+				b.WriteString(pad + "- " + empty + "\n")
+				continue
+			}
+			// il primo rigo dell'elemento va sulla stessa riga del trattino
+			var item strings.Builder
+			yamlBlock(&item, e, indent+2)
+			b.WriteString(pad + "- " + item.String()[indent+2:])
+		}
+	}
+}
+
+func yamlEntry(b *strings.Builder, pad, key string, v reflect.Value, indent int) {
+	if s, ok := yamlScalar(v); ok {
+		b.WriteString(pad + key + ": " + s + "\n")
+		return
+	}
+	if empty, ok := yamlEmpty(v); ok {
+		b.WriteString(pad + key + ": " + empty + "\n")
+		return
+	}
+	b.WriteString(pad + key + ":\n")
+	yamlBlock(b, v, indent+2)
+}
+
+func yamlDeref(v reflect.Value) reflect.Value {
+	for (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) && !v.IsNil() {
+		v = v.Elem()
+	}
+	return v
+}
+
+// yamlScalar renders v if it is not a collection.
+func yamlScalar(v reflect.Value) (string, bool) {
+	if !v.IsValid() {
+		return "null", true
+	}
+	if (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) && v.IsNil() {
+		return "null", true
+	}
+	v = yamlDeref(v)
+	if v.Type() == durationType {
+		return v.Interface().(time.Duration).String(), true
+	}
+	if v.Type().Implements(textMarshalerType) {
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return yamlQuote(err.Error()), true
+		}
+		return yamlQuote(string(text)), true
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return yamlQuote(v.String()), true
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), true
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64), true
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+		return "", false
+	}
+	return yamlQuote(fmt.Sprint(v.Interface())), true
+}
+
+// yamlEmpty renders empty collections in flow style.
+func yamlEmpty(v reflect.Value) (string, bool) {
+	v = yamlDeref(v)
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Len() == 0 {
+			return "{}", true
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Len() == 0 {
+			return "[]", true
+		}
+	case reflect.Struct:
+		// vuota anche quando tutti i campi sarebbero omessi (omitempty)
+		for i := 0; i < v.NumField(); i++ {
+			if _, omitEmpty, ok := yamlFieldName(v.Type().Field(i)); ok && !(omitEmpty && v.Field(i).IsZero()) {
+				return "", false
+			}
+		}
+		return "{}", true
+	}
+	return "", false
+}
+
+func yamlFieldName(f reflect.StructField) (name string, omitEmpty, ok bool) {
+	if !f.IsExported() {
+		return "", false, false
+	}
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return "", false, false
+	}
+	name, opts, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = f.Name
+	}
+	return name, strings.Contains(opts, "omitempty"), true
+}
+
+// yamlQuote quotes s when the plain form would be read back as something else
+// (number, bool, null) or would break the syntax.
+func yamlQuote(s string) string {
+	if s == "" || strings.TrimSpace(s) != s || strings.ContainsAny(s, ":#{}[],&*!|>'\"%@`\n\t\\") ||
+		strings.ContainsAny(s[:1], "-?") {
+		return strconv.Quote(s)
+	}
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "y", "n", "on", "off", "null", "~", ".inf", ".nan":
+		return strconv.Quote(s)
+	}
+	// numeri anche in base 16/8/2 o con separatori (0x1f, 0o17, 1_000)
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return strconv.Quote(s)
+	}
+	if _, err := strconv.ParseInt(s, 0, 64); err == nil {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,144 @@
+package cliout
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+type inner struct {
+	Name string `json:"name"`
+	N    int    `json:"count,omitempty"`
+}
+
+type outer struct {
+	ID      string            `json:"id"`
+	Tags    []string          `json:"tags"`
+	Meta    map[string]string `json:"meta"`
+	Items   []inner           `json:"items"`
+	Next    *inner            `json:"next"`
+	Hidden  string            `json:"-"`
+	private int
+}
+
+func TestWriteYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		v    any
+		want string
+	}{
+		{"scalar", 42, "42\n"},
+		{"nil", nil, "null\n"},
+		{"empty map", map[string]int{}, "{}\n"},
+		{"empty list", []string{}, "[]\n"},
+		{"empty struct", struct{}{}, "{}\n"},
+		{"struct with every field omitted", inner{}, "name: \"\"\n"},
+		{"only omitempty fields all zero", struct {
+			A int `json:"a,omitempty"`
+		}{}, "{}\n"},
+		{"struct", outer{ID: "a1", Hidden: "x", private: 1}, "" +
+			"id: a1\n" +
+			"tags: []\n" +
+			"meta: {}\n" +
+			"items: []\n" +
+			"next: null\n"},
+		{"nested maps and lists", outer{
+			ID:    "a1",
+			Tags:  []string{"x", "z"},
+			Meta:  map[string]string{"zone": "eu", "group": "g0"},
+			Items: []inner{{Name: "p", N: 1}, {Name: "q"}},
+			Next:  &inner{Name: "r"},
+		}, "" +
+			"id: a1\n" +
+			"tags:\n" +
+			"  - x\n" +
+			"  - z\n" +
+			"meta:\n" +
+			"  group: g0\n" +
+			"  zone: eu\n" +
+			"items:\n" +
+			"  - name: p\n" +
+			"    count: 1\n" +
+			"  - name: q\n" +
+			"next:\n" +
+			"  name: r\n"},
+		{"list of lists", [][]int{{1, 2}, {}, {3}}, "" +
+			"- - 1\n" +
+			"  - 2\n" +
+			"- []\n" +
+			"- - 3\n"},
+		{"list of maps of lists", []map[string][]string{{"a": {"x"}, "b": nil}}, "" +
+			"- a:\n" +
+			"    - x\n" +
+			"  b: []\n"},
+		{"list item with every field omitted", []struct {
+			A int `json:"a,omitempty"`
+		}{{}, {A: 1}}, "" +
+			"- {}\n" +
+			"- a: 1\n"},
+		{"durations and times", map[string]any{
+			"ttl": 1500 * time.Millisecond,
+			"at":  time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+		}, "" +
+			"at: \"2024-05-01T10:00:00Z\"\n" +
+			"ttl: 1.5s\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			if err := WriteYAML(&b, tt.v); err != nil {
+				t.Fatal(err)
+			}
+			if b.String() != tt.want {
+				t.Fatalf("got:\n%s\nwant:\n%s", b.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestYAMLQuote(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"plain", "plain"},
+		{"with space", "with space"},
+		{"", `""`},
+		{" lead", `" lead"`},
+		{"trail ", `"trail "`},
+		{"a: b", `"a: b"`},
+		{"#comment", `"#comment"`},
+		{"- item", `"- item"`},
+		{"?key", `"?key"`},
+		{"[x]", `"[x]"`},
+		{"multi\nline", `"multi\nline"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{"true", `"true"`},
+		{"No", `"No"`},
+		{"y", `"y"`},
+		{"null", `"null"`},
+		{"~", `"~"`},
+		{"42", `"42"`},
+		{"1.5e3", `"1.5e3"`},
+		{"0x1f", `"0x1f"`},
+		{"0o17", `"0o17"`},
+		{"1_000", `"1_000"`},
+		{".inf", `".inf"`},
+		{"v1.2", "v1.2"},
+		{"g0", "g0"},
+		{"localhost:9000", `"localhost:9000"`},
+	}
+	for _, tt := range tests {
+		if got := yamlQuote(tt.in); got != tt.want {
+			t.Errorf("yamlQuote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPairs(t *testing.T) {
+	if got := strings.Join(Pairs(map[string]string{"zone": "eu", "group": "g0", "empty": ""}), ","); got != "empty=,group=g0,zone=eu" {
+		t.Fatalf("Pairs = %s", got)
+	}
+	if got := Pairs(nil); len(got) != 0 {
+		t.Fatalf("Pairs(nil) = %v", got)
+	}
+}
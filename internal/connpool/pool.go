@@ -0,0 +1,212 @@
+// Package connpool keeps net/rpc connections open per instance address, so a
+// client does not pay a TCP + HTTP CONNECT handshake (and an ephemeral port)
+// for every request.
+package connpool
+
+import (
+	"context"
+	"errors"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"example.com/service-registry-lb/internal/rpcctx"
+)
+
+// Caller is what request code needs from a connection; *rpc.Client implements it.
+type Caller interface {
+	Call(serviceMethod string, args any, reply any) error
+}
+
+type Options struct {
+	MaxIdle     int           // connessioni inattive tenute per indirizzo (0 = nessun pooling)
+	MinIdle     int           // connessioni aperte in anticipo al primo uso di un indirizzo
+	MaxIdleTime time.Duration // oltre viene chiusa (default 1m)
+	// Timeout bounds every Call (0 = rpcctx default of the method).
+	Timeout time.Duration
+	// Dial opens a connection (default rpcctx.Dial: net/rpc with deadlines).
+	Dial func(addr string) (*rpc.Client, error)
+}
+
+// Stats counts what the pool did since it was created.
+type Stats struct {
+	Dials     int64 // connessioni aperte
+	Reuses    int64 // richieste servite da una connessione già aperta
+	Evictions int64 // connessioni scartate per errore o inattività
+}
+
+type Pool struct {
+	opts Options
+
+	mu     sync.Mutex
+	idle   map[string][]*conn // addr -> connessioni libere (la più recente in fondo)
+	stats  Stats
+	closed bool
+}
+
+type conn struct {
+	c        *rpc.Client
+	lastUsed time.Time
+}
+
+func New(opts Options) *Pool {
+	if opts.MaxIdleTime <= 0 {
+		opts.MaxIdleTime = time.Minute
+	}
+	if opts.MinIdle > opts.MaxIdle {
+		opts.MinIdle = opts.MaxIdle
+	}
+	if opts.Dial == nil {
+		opts.Dial = rpcctx.Dial
+	}
+	return &Pool{opts: opts, idle: make(map[string][]*conn)}
+}
+
+// Caller returns a Caller that sends every call through the pool to addr.
+func (p *Pool) Caller(addr string) Caller {
+	return addrCaller{p: p, addr: addr}
+}
+
+type addrCaller struct {
+	p    *Pool
+	addr string
+}
+
+func (a addrCaller) Call(method string, args, reply any) error {
+	return a.p.Call(a.addr, method, args, reply)
+}
+
+// Call performs one RPC on addr with a pooled connection, bounded by
+// Options.Timeout. A pooled connection found already shut down is evicted and
+// the call retried once on a new one; any other transport error (a timeout
+// included) evicts the connection and is returned.
+func (p *Pool) Call(addr, method string, args, reply any) error {
+	ctx := context.Background()
+	if p.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.opts.Timeout)
+		defer cancel()
+	}
+	return p.CallContext(ctx, addr, method, args, reply)
+}
+
+// CallContext is Call bounded by ctx instead of Options.Timeout.
+func (p *Pool) CallContext(ctx context.Context, addr, method string, args, reply any) error {
+	for attempt := 0; ; attempt++ {
+		c, reused, err := p.get(addr)
+		if err != nil {
+			return err
+		}
+		err = rpcctx.Call(ctx, c.c, method, args, reply)
+		p.put(addr, c, err)
+		// ErrShutdown: la richiesta non è partita, quindi ritentare è sicuro
+		if errors.Is(err, rpc.ErrShutdown) && reused && attempt == 0 {
+			continue
+		}
+		return err
+	}
+}
+
+func (p *Pool) get(addr string) (*conn, bool, error) {
+	now := time.Now()
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, false, errors.New("connpool: closed")
+	}
+	_, known := p.idle[addr]
+	list := p.idle[addr]
+	for len(list) > 0 {
+		c := list[len(list)-1]
+		list = list[:len(list)-1]
+		if now.Sub(c.lastUsed) > p.opts.MaxIdleTime {
+			_ = c.c.Close()
+			p.stats.Evictions++
+			continue
+		}
+		p.idle[addr] = list
+		p.stats.Reuses++
+		p.mu.Unlock()
+		return c, true, nil
+	}
+	p.idle[addr] = list
+	p.mu.Unlock()
+
+	if !known && p.opts.MinIdle > 0 {
+		// primo uso dell'indirizzo: apro MinIdle connessioni e ne uso una
+		p.warm(addr)
+		return p.get(addr)
+	}
+	rc, err := p.opts.Dial(addr)
+	if err != nil {
+		return nil, false, err
+	}
+	p.mu.Lock()
+	p.stats.Dials++
+	p.mu.Unlock()
+	return &conn{c: rc}, false, nil
+}
+
+// warm opens MinIdle connections for an address seen for the first time.
+func (p *Pool) warm(addr string) {
+	for i := 0; i < p.opts.MinIdle; i++ {
+		rc, err := p.opts.Dial(addr)
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		p.stats.Dials++
+		p.mu.Unlock()
+		p.put(addr, &conn{c: rc}, nil)
+	}
+}
+
+// put gives c back to the pool, or closes it if the call failed at the
+// transport level or the pool is full.
+func (p *Pool) put(addr string, c *conn, callErr error) {
+	var se rpc.ServerError
+	broken := callErr != nil && !errors.As(callErr, &se)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if broken {
+		p.stats.Evictions++
+	}
+	if broken || p.closed || len(p.idle[addr]) >= p.opts.MaxIdle {
+		_ = c.c.Close()
+		return
+	}
+	c.lastUsed = time.Now()
+	p.idle[addr] = append(p.idle[addr], c)
+}
+
+// Drop closes the idle connections to addr (e.g. the instance left the registry).
+func (p *Pool) Drop(addr string) {
+	p.mu.Lock()
+	list := p.idle[addr]
+	delete(p.idle, addr)
+	p.mu.Unlock()
+	for _, c := range list {
+		_ = c.c.Close()
+	}
+}
+
+func (p *Pool) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// Close closes every idle connection; connections in use are closed when returned.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = make(map[string][]*conn)
+	p.closed = true
+	p.mu.Unlock()
+	for _, list := range idle {
+		for _, c := range list {
+			_ = c.c.Close()
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package connpool
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/rpc"
+	"testing"
+
+	"example.com/service-registry-lb/internal/rpcctx"
+)
+
+type Echo struct{}
+
+type EchoArgs struct{ Msg string }
+type EchoReply struct{ Msg string }
+
+func (Echo) Echo(args *EchoArgs, reply *EchoReply) error {
+	reply.Msg = args.Msg
+	return nil
+}
+
+// startServer serves Echo in-process the way servicekit does (rpcctx.Handle
+// on an HTTP mux) and returns its address.
+func startServer(tb testing.TB) string {
+	tb.Helper()
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Echo", Echo{}); err != nil {
+		tb.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	rpcctx.Handle(mux, srv, nil)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	hs := &http.Server{Handler: mux}
+	go func() { _ = hs.Serve(ln) }()
+	tb.Cleanup(func() { _ = hs.Close() })
+	return ln.Addr().String()
+}
+
+func TestPoolReusesConnections(t *testing.T) {
+	addr := startServer(t)
+	p := New(Options{MaxIdle: 2})
+	defer p.Close()
+	for i := 0; i < 10; i++ {
+		var rep EchoReply
+		if err := p.Call(addr, "Echo.Echo", &EchoArgs{Msg: "ciao"}, &rep); err != nil {
+			t.Fatal(err)
+		}
+		if rep.Msg != "ciao" {
+			t.Fatalf("reply %q, want %q", rep.Msg, "ciao")
+		}
+	}
+	st := p.Stats()
+	if st.Dials != 1 || st.Reuses != 9 {
+		t.Errorf("stats = %+v, want 1 dial and 9 reuses", st)
+	}
+}
+
+func TestPoolKeepsConnectionOnServerError(t *testing.T) {
+	addr := startServer(t)
+	p := New(Options{MaxIdle: 1})
+	defer p.Close()
+	var rep EchoReply
+	if err := p.Call(addr, "Echo.Missing", &EchoArgs{}, &rep); err == nil {
+		t.Fatal("want an error for an unknown method")
+	}
+	if err := p.Call(addr, "Echo.Echo", &EchoArgs{Msg: "x"}, &rep); err != nil {
+		t.Fatal(err)
+	}
+	if st := p.Stats(); st.Dials != 1 || st.Evictions != 0 {
+		t.Errorf("stats = %+v, want 1 dial and no evictions", st)
+	}
+}
+
+// go test -bench . ./internal/connpool
+func BenchmarkPooledCall(b *testing.B) {
+	addr := startServer(b)
+	p := New(Options{MaxIdle: 4})
+	defer p.Close()
+	args := &EchoArgs{Msg: "ciao"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var rep EchoReply
+		if err := p.Call(addr, "Echo.Echo", args, &rep); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDialPerCall(b *testing.B) {
+	addr := startServer(b)
+	args := &EchoArgs{Msg: "ciao"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c, err := rpcctx.Dial(addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var rep EchoReply
+		err = rpcctx.Call(context.Background(), c, "Echo.Echo", args, &rep)
+		_ = c.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package coord
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"example.com/service-registry-lb/common"
+	"example.com/service-registry-lb/internal/registry"
+)
+
+// shortTTL is the shortest lease the registry grants.
+const shortTTL = 500 * time.Millisecond
+
+// newRegistry serves an in-process registry and returns it with a dialer of
+// client connections to it.
+func newRegistry(t *testing.T) (*registry.Registry, func() *rpc.Client) {
+	t.Helper()
+	reg := registry.New()
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Registry", reg); err != nil {
+		t.Fatal(err)
+	}
+	dial := func() *rpc.Client {
+		sc, cc := net.Pipe()
+		go srv.ServeConn(sc)
+		c := rpc.NewClient(cc)
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	return reg, dial
+}
+
+func holder(t *testing.T, reg *registry.Registry, name string) common.GetLockReply {
+	t.Helper()
+	var rep common.GetLockReply
+	if err := reg.GetLock(&common.GetLockArgs{Name: name}, &rep); err != nil {
+		t.Fatal(err)
+	}
+	return rep
+}
+
+func TestNewSessionDefaultTTL(t *testing.T) {
+	_, dial := newRegistry(t)
+	s := NewSession(dial(), "a", 0)
+	defer s.Close()
+	if s.ttl != common.DefaultLockTTL {
+		t.Fatalf("ttl %v, want the registry default %v", s.ttl, common.DefaultLockTTL)
+	}
+	if _, err := s.Lock(context.Background(), "job", ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionKeepAlive(t *testing.T) {
+	reg, dial := newRegistry(t)
+	s := NewSession(dial(), "a", shortTTL)
+	defer s.Close()
+	token, err := s.Lock(context.Background(), "job", "v")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tre TTL: senza i rinnovi il lease sarebbe scaduto
+	time.Sleep(3 * shortTTL)
+	if h := holder(t, reg, "job"); !h.Held || h.Holder != "a" || h.Token != token {
+		t.Fatalf("after 3 TTLs: %+v, want held by a with token %d", h, token)
+	}
+	if err := s.Err(); err != nil {
+		t.Fatalf("session ended: %v", err)
+	}
+}
+
+func TestSessionExpiresWhenLeaseIsLost(t *testing.T) {
+	reg, dial := newRegistry(t)
+	s := NewSession(dial(), "a", shortTTL)
+	defer s.Close()
+	token, err := s.Lock(context.Background(), "job", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// il lease sparisce alle spalle della sessione: il rinnovo successivo la chiude
+	var rel common.ReleaseLockReply
+	if err := reg.ReleaseLock(&common.ReleaseLockArgs{Name: "job", Owner: "a", Token: token}, &rel); err != nil || !rel.OK {
+		t.Fatalf("release: ok=%v err=%v", rel.OK, err)
+	}
+	select {
+	case <-s.Done():
+	case <-time.After(2 * shortTTL):
+		t.Fatal("session still alive after losing its lease")
+	}
+	if !errors.Is(s.Err(), ErrSessionExpired) {
+		t.Fatalf("Err() = %v, want ErrSessionExpired", s.Err())
+	}
+	if _, err := s.Lock(context.Background(), "other", ""); !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("Lock on an expired session: %v", err)
+	}
+}
+
+func TestSemaphoreAcquireRelease(t *testing.T) {
+	_, dial := newRegistry(t)
+	a := NewSession(dial(), "a", shortTTL)
+	defer a.Close()
+	b := NewSession(dial(), "b", shortTTL)
+	defer b.Close()
+
+	tests := []struct {
+		name    string
+		s       *Session
+		wait    time.Duration
+		wantErr error
+		before  func()
+	}{
+		{"first slot", a, time.Second, nil, nil},
+		{"limit reached", b, 300 * time.Millisecond, context.DeadlineExceeded, nil},
+		{"slot freed by release", b, time.Second, nil, func() {
+			if err := a.Release("sem"); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		if tt.before != nil {
+			tt.before()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), tt.wait)
+		err := tt.s.Acquire(ctx, "sem", 1)
+		cancel()
+		if !errors.Is(err, tt.wantErr) {
+			t.Fatalf("%s: Acquire = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+	// il rilascio di uno slot non posseduto non fa niente
+	if err := a.Release("sem"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestElectionHandover(t *testing.T) {
+	reg, dial := newRegistry(t)
+	s1 := NewSession(dial(), "n1", shortTTL)
+	s2 := NewSession(dial(), "n2", shortTTL)
+	defer s2.Close()
+	e1, e2 := NewElection(s1, "svc"), NewElection(s2, "svc")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	t1, err := e1.Campaign(ctx, "addr1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	observed := e2.Observe(ctx)
+	if l := <-observed; l.Owner != "n1" || l.Token != t1 {
+		t.Fatalf("first observed leader %+v", l)
+	}
+
+	won := make(chan int64, 1)
+	go func() {
+		t2, err := e2.Campaign(ctx, "addr2")
+		if err != nil {
+			t.Error(err)
+		}
+		won <- t2
+	}()
+	select {
+	case <-won:
+		t.Fatal("n2 elected while n1 leads")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// la sessione del leader finisce: il mandato passa all'altro candidato
+	if err := s1.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var t2 int64
+	select {
+	case t2 = <-won:
+	case <-ctx.Done():
+		t.Fatal("n2 never elected")
+	}
+	if t2 <= t1 {
+		t.Fatalf("new term token %d, want > %d", t2, t1)
+	}
+	l, err := e2.Leader()
+	if err != nil || l.Owner != "n2" || l.Value != "addr2" || l.Token != t2 {
+		t.Fatalf("Leader() = %+v, %v", l, err)
+	}
+	if h := holder(t, reg, "election/svc"); h.Holder != "n2" {
+		t.Fatalf("registry holder %q", h.Holder)
+	}
+	// Observe vede il cambio (eventualmente passando da "nessun leader")
+	for l := range observed {
+		if l.Owner == "n2" {
+			return
+		}
+	}
+	t.Fatal("Observe never reported n2")
+}
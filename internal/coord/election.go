@@ -0,0 +1,83 @@
+package coord
+
+import (
+	"context"
+	"time"
+
+	"example.com/service-registry-lb/common"
+)
+
+// Leader is the current holder of an election (Owner "" = no leader).
+type Leader struct {
+	Owner string
+	Value string // es. indirizzo del leader
+	Token int64  // fencing token del mandato
+}
+
+// Election is a leader election over the lock "election/<name>".
+type Election struct {
+	s    *Session
+	lock string
+}
+
+func NewElection(s *Session, name string) *Election {
+	return &Election{s: s, lock: "election/" + name}
+}
+
+// Campaign blocks until this session is the leader or ctx ends, and returns the
+// fencing token of the term. Leadership lasts until Resign or until the session
+// expires (watch Session.Done).
+func (e *Election) Campaign(ctx context.Context, value string) (int64, error) {
+	return e.s.Lock(ctx, e.lock, value)
+}
+
+// Resign gives up leadership so that another candidate can win right away.
+func (e *Election) Resign() error {
+	return e.s.Unlock(e.lock)
+}
+
+// Leader returns the current leader.
+func (e *Election) Leader() (Leader, error) {
+	var rep common.GetLockReply
+	if err := e.s.reg.Call("Registry.GetLock", &common.GetLockArgs{Name: e.lock}, &rep); err != nil {
+		return Leader{}, err
+	}
+	return Leader{Owner: rep.Holder, Value: rep.Value, Token: rep.Token}, nil
+}
+
+// Observe sends the current leader and then every change of leader (including
+// "no leader") until ctx ends; the channel is closed afterwards.
+func (e *Election) Observe(ctx context.Context) <-chan Leader {
+	ch := make(chan Leader, 1)
+	go func() {
+		defer close(ch)
+		// sentinella: forza l'invio dello stato iniziale
+		last := Leader{Token: -1}
+		for {
+			var rep common.WatchLockReply
+			err := e.s.reg.CallContext(ctx, "Registry.WatchLock", &common.WatchLockArgs{Name: e.lock, Holder: last.Owner, Token: last.Token}, &rep)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				// registry non raggiungibile: riprovo senza perdere l'ultimo leader visto
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Second):
+				}
+				continue
+			}
+			if !rep.Changed {
+				continue
+			}
+			last = Leader{Owner: rep.Holder, Value: rep.Value, Token: rep.Token}
+			select {
+			case ch <- last:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,275 @@
+// Package coord builds locks, semaphores and leader election on top of the
+// registry lease RPCs (Registry.AcquireLock, Registry.AcquireSemaphore, ...).
+package coord
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"example.com/service-registry-lb/common"
+	"example.com/service-registry-lb/internal/rpcctx"
+)
+
+// ErrSessionExpired is returned once a Session has lost one of its leases
+// (or was closed): everything it held must be considered gone.
+var ErrSessionExpired = errors.New("coord: session expired")
+
+// Session is an owner identity in the registry. Every lock and semaphore slot it
+// acquires is a lease of the same TTL, renewed in background every TTL/3.
+type Session struct {
+	reg   *rpcctx.Client // chiamate con timeout per metodo
+	owner string
+	ttl   time.Duration
+
+	mu    sync.Mutex
+	locks map[string]int64 // lock -> token
+	sems  map[string]bool
+	done  chan struct{}
+	err   error
+}
+
+// NewSession starts a session for owner; owner must be unique among the
+// contenders (e.g. instance id + pid). A ttl <= 0 means the registry default.
+func NewSession(reg *rpc.Client, owner string, ttl time.Duration) *Session {
+	if ttl <= 0 {
+		ttl = common.DefaultLockTTL
+	}
+	s := &Session{
+		reg:   &rpcctx.Client{Client: reg},
+		owner: owner,
+		ttl:   ttl,
+		locks: make(map[string]int64),
+		sems:  make(map[string]bool),
+		done:  make(chan struct{}),
+	}
+	go s.keepAlive()
+	return s
+}
+
+func (s *Session) Owner() string { return s.owner }
+
+// Done is closed when the session expires or is closed.
+func (s *Session) Done() <-chan struct{} { return s.done }
+
+// Err returns why the session ended (nil while alive).
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Close releases every lease of the session and stops the renewals.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	locks, sems := s.locks, s.sems
+	s.locks, s.sems = map[string]int64{}, map[string]bool{}
+	s.mu.Unlock()
+
+	var firstErr error
+	for name, token := range locks {
+		var rep common.ReleaseLockReply
+		if err := s.reg.Call("Registry.ReleaseLock", &common.ReleaseLockArgs{Name: name, Owner: s.owner, Token: token}, &rep); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for name := range sems {
+		var rep common.SemaphoreReply
+		if err := s.reg.Call("Registry.ReleaseSemaphore", &common.SemaphoreArgs{Name: name, Owner: s.owner}, &rep); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.expire(ErrSessionExpired)
+	return firstErr
+}
+
+func (s *Session) expire(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	close(s.done)
+}
+
+// keepAlive renews every lease; a lease refused by the registry, or no
+// successful round for a whole TTL, ends the session.
+func (s *Session) keepAlive() {
+	ticker := time.NewTicker(s.ttl / 3)
+	defer ticker.Stop()
+	lastOK := time.Now()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		start := time.Now()
+		lost, err := s.renewAll()
+		switch {
+		case lost != "":
+			s.expire(fmt.Errorf("%w: lost %s", ErrSessionExpired, lost))
+		case err == nil:
+			lastOK = start
+		case time.Since(lastOK) > s.ttl:
+			s.expire(fmt.Errorf("%w: registry unreachable: %v", ErrSessionExpired, err))
+		}
+	}
+}
+
+func (s *Session) renewAll() (lost string, err error) {
+	s.mu.Lock()
+	locks := make(map[string]int64, len(s.locks))
+	for k, v := range s.locks {
+		locks[k] = v
+	}
+	sems := make([]string, 0, len(s.sems))
+	for k := range s.sems {
+		sems = append(sems, k)
+	}
+	s.mu.Unlock()
+
+	for name, token := range locks {
+		var rep common.RenewLockReply
+		if err := s.reg.Call("Registry.RenewLock", &common.RenewLockArgs{Name: name, Owner: s.owner, Token: token, TTL: s.ttl}, &rep); err != nil {
+			return "", err
+		}
+		if !rep.OK {
+			return "lock " + name, nil
+		}
+	}
+	for _, name := range sems {
+		var rep common.SemaphoreReply
+		if err := s.reg.Call("Registry.RenewSemaphore", &common.SemaphoreArgs{Name: name, Owner: s.owner, TTL: s.ttl}, &rep); err != nil {
+			return "", err
+		}
+		if !rep.OK {
+			return "semaphore " + name, nil
+		}
+	}
+	return "", nil
+}
+
+func (s *Session) alive() error {
+	select {
+	case <-s.done:
+		return s.Err()
+	default:
+		return nil
+	}
+}
+
+// call is a net/rpc call that gives up when ctx ends or the session expires
+// (the request itself is not cancelled); ctx's deadline reaches the registry.
+func (s *Session) call(ctx context.Context, method string, args, reply any) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	err := s.reg.CallContext(ctx, method, args, reply)
+	if err != nil && s.alive() != nil {
+		return s.Err()
+	}
+	return err
+}
+
+// -------- lock --------
+
+// TryLock takes lock name once, publishing value to the other contenders.
+// It returns the fencing token when acquired, otherwise the current holder.
+func (s *Session) TryLock(name, value string) (acquired bool, rep common.AcquireLockReply, err error) {
+	if err := s.alive(); err != nil {
+		return false, rep, err
+	}
+	if err := s.reg.Call("Registry.AcquireLock", &common.AcquireLockArgs{Name: name, Owner: s.owner, Value: value, TTL: s.ttl}, &rep); err != nil {
+		return false, rep, err
+	}
+	if rep.Acquired {
+		s.mu.Lock()
+		s.locks[name] = rep.Token
+		s.mu.Unlock()
+	}
+	return rep.Acquired, rep, nil
+}
+
+// Lock blocks until lock name is acquired (returning its fencing token) or ctx ends.
+// Between attempts it waits for the holder to change instead of polling.
+func (s *Session) Lock(ctx context.Context, name, value string) (int64, error) {
+	for {
+		ok, rep, err := s.TryLock(name, value)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return rep.Token, nil
+		}
+		var w common.WatchLockReply
+		if err := s.call(ctx, "Registry.WatchLock", &common.WatchLockArgs{Name: name, Holder: rep.Holder, Token: rep.Token}, &w); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Unlock releases lock name if the session still holds it.
+func (s *Session) Unlock(name string) error {
+	s.mu.Lock()
+	token, ok := s.locks[name]
+	delete(s.locks, name)
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	var rep common.ReleaseLockReply
+	return s.reg.Call("Registry.ReleaseLock", &common.ReleaseLockArgs{Name: name, Owner: s.owner, Token: token}, &rep)
+}
+
+// -------- semaphore --------
+
+// Acquire blocks until the session holds one of the limit slots of semaphore name
+// or ctx ends. Slots have no holder-change notification: it retries every TTL/3.
+func (s *Session) Acquire(ctx context.Context, name string, limit int) error {
+	ticker := time.NewTicker(s.ttl / 3)
+	defer ticker.Stop()
+	for {
+		if err := s.alive(); err != nil {
+			return err
+		}
+		var rep common.AcquireSemaphoreReply
+		if err := s.call(ctx, "Registry.AcquireSemaphore", &common.AcquireSemaphoreArgs{Name: name, Owner: s.owner, Limit: limit, TTL: s.ttl}, &rep); err != nil {
+			return err
+		}
+		if rep.Acquired {
+			s.mu.Lock()
+			s.sems[name] = true
+			s.mu.Unlock()
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Release frees the session's slot of semaphore name.
+func (s *Session) Release(name string) error {
+	s.mu.Lock()
+	_, ok := s.sems[name]
+	delete(s.sems, name)
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	var rep common.SemaphoreReply
+	return s.reg.Call("Registry.ReleaseSemaphore", &common.SemaphoreArgs{Name: name, Owner: s.owner}, &rep)
+}
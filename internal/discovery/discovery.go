@@ -0,0 +1,488 @@
+// Package discovery is the long-lived registry client shared by services and
+// clients: it registers instances (and re-registers them after a registry
+// restart), caches the instance list of the services it is asked about, kept
+// current with Registry.WatchService (Lookup polling while the watch fails),
+// and load-balances RPC calls among them.
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"math/rand"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"example.com/service-registry-lb/common"
+	"example.com/service-registry-lb/internal/connpool"
+	"example.com/service-registry-lb/internal/lb"
+	"example.com/service-registry-lb/internal/rpcctx"
+	"example.com/service-registry-lb/internal/util"
+)
+
+const (
+	defaultRefresh = 2 * time.Second
+	minRedial      = 200 * time.Millisecond
+	maxRedial      = 5 * time.Second
+	watchTimeout   = 30 * time.Second // attesa massima di un long-poll WatchService
+)
+
+type Options struct {
+	// Refresh is how often registered instances send a heartbeat and watched
+	// services are re-read with Lookup while their watch fails (default 2s).
+	Refresh time.Duration
+	// PollLoads re-reads watched services every Refresh even while the watch
+	// works: the loads reported with heartbeats do not wake WatchService, so a
+	// load-aware picker (lb.Adaptive) needs polling to see them.
+	PollLoads bool
+	// NewPicker builds the picker of a service (default round-robin).
+	NewPicker func([]common.Instance) lb.Picker
+	// Load, if set, is sampled at every heartbeat and reported to the registry
+	// with it (see lb.Adaptive).
+	Load func() common.Load
+	// MaxIdle is how many connections per instance Call keeps open (default 2).
+	MaxIdle int
+}
+
+type Client struct {
+	addr string
+	opts Options
+
+	connMu   sync.Mutex
+	conn     *rpc.Client
+	lost     bool          // la connessione è caduta: alla prossima registro di nuovo le istanze
+	backoff  time.Duration // attesa fra due tentativi di dial falliti (esponenziale)
+	nextDial time.Time
+
+	mu         sync.Mutex
+	registered map[string]common.RegisterArgs // "service/id" -> registrazione
+	watched    map[string]*watched
+	conns      *connpool.Pool // connessioni verso le istanze (Call)
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// watched is the cached view of one service; its picker is guarded by mu.
+type watched struct {
+	mu        sync.Mutex
+	instances []common.Instance
+	picker    lb.Picker
+	revision  int64 // revisione della lista in cache (AfterRevision del prossimo watch)
+	live      bool  // il long-poll funziona: niente polling con Lookup
+}
+
+// set updates the cached list; the picker only if the instances changed.
+func (w *watched) set(insts []common.Instance, revision int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.revision = revision
+	if !sameInstances(w.instances, insts) {
+		w.instances = insts
+		w.picker.Update(insts)
+	}
+}
+
+// Dial connects to the registry at addr and starts the background refresh.
+// Later connection failures are retried transparently by every call.
+func Dial(addr string, opts Options) (*Client, error) {
+	if opts.Refresh <= 0 {
+		opts.Refresh = defaultRefresh
+	}
+	if opts.NewPicker == nil {
+		opts.NewPicker = func(insts []common.Instance) lb.Picker { return lb.NewRoundRobin(insts) }
+	}
+	if opts.MaxIdle <= 0 {
+		opts.MaxIdle = 2
+	}
+	c := &Client{
+		addr:       addr,
+		opts:       opts,
+		registered: make(map[string]common.RegisterArgs),
+		watched:    make(map[string]*watched),
+		conns:      connpool.New(connpool.Options{MaxIdle: opts.MaxIdle}),
+		done:       make(chan struct{}),
+	}
+	if _, err := c.client(); err != nil {
+		return nil, err
+	}
+	go c.loop()
+	return c, nil
+}
+
+// Addr returns the registry address.
+func (c *Client) Addr() string { return c.addr }
+
+// BuildInstance resolves the usual service flags with their env fallbacks:
+// id (INSTANCE_ID, else "<service>-<unix>"), public address (PUBLIC_ADDR, else
+// listen) and weight (WEIGHT when the flag is left at 1). Meta["kind"] defaults to service.
+func BuildInstance(service, id, public, listen string, weight int, meta map[string]string) common.Instance {
+	if id == "" {
+		id = util.Env("INSTANCE_ID", "")
+	}
+	if id == "" {
+		id = fmt.Sprintf("%s-%d", service, time.Now().Unix())
+	}
+	if public == "" {
+		public = util.Env("PUBLIC_ADDR", "")
+	}
+	if public == "" {
+		public = listen
+	}
+	if weight == 1 {
+		weight = util.EnvInt("WEIGHT", 1)
+	}
+	m := map[string]string{"kind": service}
+	for k, v := range meta {
+		m[k] = v
+	}
+	return common.Instance{ID: id, Addr: public, Weight: weight, Meta: m}
+}
+
+// -------- connessione al registry --------
+
+func (c *Client) client() (*rpc.Client, error) {
+	select {
+	case <-c.done:
+		return nil, errors.New("discovery client closed")
+	default:
+	}
+	c.connMu.Lock()
+	if c.conn != nil {
+		conn := c.conn
+		c.connMu.Unlock()
+		return conn, nil
+	}
+	// registry giù: non ritento il dial ad ogni chiamata, ma con backoff esponenziale
+	if wait := time.Until(c.nextDial); wait > 0 {
+		c.connMu.Unlock()
+		return nil, fmt.Errorf("registry %s unavailable (next dial in %s)", c.addr, wait.Round(time.Millisecond))
+	}
+	conn, err := rpcctx.Dial(c.addr)
+	if err != nil {
+		c.backoff = min(max(2*c.backoff, minRedial), maxRedial)
+		// jitter: le istanze non si ripresentano tutte nello stesso istante
+		c.nextDial = time.Now().Add(c.backoff/2 + time.Duration(rand.Int63n(int64(c.backoff/2)+1)))
+		c.connMu.Unlock()
+		return nil, fmt.Errorf("dial registry %s: %w", c.addr, err)
+	}
+	c.conn = conn
+	c.backoff = 0
+	reconnected := c.lost
+	c.lost = false
+	c.connMu.Unlock()
+
+	if reconnected {
+		// il registry può essere ripartito vuoto: ripubblico con i dati originali le istanze
+		// che non conosce più; le altre restano come sono (es. peso cambiato con UpdateInstance)
+		log.Printf("[discovery] reconnected to registry %s", c.addr)
+		c.verify()
+	}
+	return conn, nil
+}
+
+func (c *Client) drop(conn *rpc.Client, cause error) {
+	c.connMu.Lock()
+	if c.conn == conn {
+		_ = conn.Close()
+		c.conn = nil
+		if !c.lost {
+			log.Printf("[discovery] lost connection to registry %s: %v", c.addr, cause)
+		}
+		c.lost = true
+	}
+	c.connMu.Unlock()
+}
+
+// isConnError tells transport failures from errors returned by the registry itself.
+func isConnError(err error) bool {
+	var se rpc.ServerError
+	return err != nil && !errors.As(err, &se)
+}
+
+// CallRegistry calls a Registry RPC, reconnecting once if the connection broke;
+// the call is bounded by the method's default timeout (rpcctx.Timeout).
+func (c *Client) CallRegistry(method string, args, reply any) error {
+	return c.CallRegistryContext(context.Background(), method, args, reply)
+}
+
+// CallRegistryContext is CallRegistry bounded by ctx.
+func (c *Client) CallRegistryContext(ctx context.Context, method string, args, reply any) error {
+	for attempt := 0; ; attempt++ {
+		conn, err := c.client()
+		if err != nil {
+			return err
+		}
+		err = rpcctx.Call(ctx, conn, method, args, reply)
+		// scaduto il ctx del chiamante: non ritento e non chiudo la connessione,
+		// condivisa con le altre chiamate (es. long-poll)
+		if ctx.Err() != nil {
+			return err
+		}
+		if !isConnError(err) || attempt == 1 {
+			return err
+		}
+		c.drop(conn, err)
+	}
+}
+
+// -------- registrazione --------
+
+// Register publishes inst under service; it is re-published automatically
+// whenever the registry loses it, until Deregister or Close.
+func (c *Client) Register(service string, inst common.Instance) error {
+	args := common.RegisterArgs{Service: service, Instance: inst}
+	var rep common.RegisterReply
+	if err := c.CallRegistry("Registry.Register", &args, &rep); err != nil {
+		return err
+	}
+	if !rep.OK {
+		return errors.New("registry refused the registration")
+	}
+	c.mu.Lock()
+	c.registered[service+"/"+inst.ID] = args
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Client) Deregister(service, id string) error {
+	c.mu.Lock()
+	delete(c.registered, service+"/"+id)
+	c.mu.Unlock()
+	var rep common.DeregisterReply
+	return c.CallRegistry("Registry.Deregister", &common.DeregisterArgs{Service: service, ID: id}, &rep)
+}
+
+func (c *Client) registrations() []common.RegisterArgs {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]common.RegisterArgs, 0, len(c.registered))
+	for _, a := range c.registered {
+		out = append(out, a)
+	}
+	return out
+}
+
+// verify sends a heartbeat for every registered instance (it keeps them healthy
+// in the registry catalog) and registers again those the registry no longer
+// knows (e.g. it restarted without the connection noticing).
+func (c *Client) verify() {
+	var load *common.Load
+	if c.opts.Load != nil {
+		l := c.opts.Load()
+		load = &l
+	}
+	for _, a := range c.registrations() {
+		var hb common.HeartbeatReply
+		if err := c.CallRegistry("Registry.Heartbeat", &common.HeartbeatArgs{Service: a.Service, ID: a.Instance.ID, Load: load}, &hb); err != nil {
+			return
+		}
+		if hb.Found {
+			continue
+		}
+		var rrep common.RegisterReply
+		if err := c.CallRegistry("Registry.Register", &a, &rrep); err == nil {
+			log.Printf("[discovery] %s/%s was missing from the registry: registered again", a.Service, a.Instance.ID)
+		}
+	}
+}
+
+// -------- lookup e bilanciamento --------
+
+// Instances returns the cached instances of service, looking it up (and
+// starting to watch it) on first use.
+func (c *Client) Instances(service string) ([]common.Instance, error) {
+	w, err := c.watch(service)
+	if err != nil {
+		return nil, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]common.Instance(nil), w.instances...), nil
+}
+
+// Pick chooses an instance of service with its picker.
+func (c *Client) Pick(service string) (common.Instance, error) {
+	w, err := c.watch(service)
+	if err != nil {
+		return common.Instance{}, err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.instances) == 0 {
+		return common.Instance{}, fmt.Errorf("no instances for service %q", service)
+	}
+	return w.picker.Pick()
+}
+
+// Call invokes method on an instance of service chosen by the picker.
+func (c *Client) Call(service, method string, args, reply any) error {
+	_, err := c.CallPicked(service, method, args, reply)
+	return err
+}
+
+// CallPicked is Call that also returns the instance that served the request.
+func (c *Client) CallPicked(service, method string, args, reply any) (common.Instance, error) {
+	return c.CallPickedContext(context.Background(), service, method, args, reply)
+}
+
+// CallPickedContext is CallPicked bounded by ctx (whose deadline reaches the server).
+func (c *Client) CallPickedContext(ctx context.Context, service, method string, args, reply any) (common.Instance, error) {
+	inst, err := c.Pick(service)
+	if err != nil {
+		return inst, err
+	}
+	return inst, c.conns.CallContext(ctx, inst.Addr, method, args, reply)
+}
+
+func (c *Client) watch(service string) (*watched, error) {
+	c.mu.Lock()
+	w, ok := c.watched[service]
+	c.mu.Unlock()
+	if ok {
+		return w, nil
+	}
+	rep, err := c.lookup(service)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if w, ok := c.watched[service]; ok {
+		return w, nil
+	}
+	// live finché il primo long-poll non fallisce: un registry senza WatchService risponde subito
+	w = &watched{instances: rep.Instances, picker: c.opts.NewPicker(rep.Instances), revision: rep.Revision, live: true}
+	c.watched[service] = w
+	go c.watchLoop(service, w)
+	return w, nil
+}
+
+func (c *Client) lookup(service string) (common.LookupReply, error) {
+	var rep common.LookupReply
+	if err := c.CallRegistry("Registry.Lookup", &common.LookupArgs{Service: service}, &rep); err != nil {
+		return rep, fmt.Errorf("lookup %s: %w", service, err)
+	}
+	return rep, nil
+}
+
+// watchLoop follows service with Registry.WatchService until Close. While the
+// long-poll fails (registry down, or too old to have it) the service is marked
+// not live and refresh falls back to polling it with Lookup.
+func (c *Client) watchLoop(service string, w *watched) {
+	for {
+		w.mu.Lock()
+		args := common.WatchServiceArgs{Service: service, AfterRevision: w.revision, Timeout: watchTimeout}
+		w.mu.Unlock()
+		var rep common.WatchServiceReply
+		err := c.CallRegistry("Registry.WatchService", &args, &rep)
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+
+		w.mu.Lock()
+		wasLive := w.live
+		w.live = err == nil
+		w.mu.Unlock()
+		if err != nil {
+			if wasLive {
+				log.Printf("[discovery] watch %s: %v (polling every %s)", service, err, c.opts.Refresh)
+			}
+			select {
+			case <-c.done:
+				return
+			case <-time.After(c.opts.Refresh):
+			}
+			continue
+		}
+		if rep.Changed {
+			w.set(rep.Instances, rep.Revision)
+		}
+	}
+}
+
+// refresh re-reads with Lookup the watched services whose watch is not working
+// (all of them with PollLoads); on changes the picker is updated in place.
+// A failed lookup does not stop the others: the errors are returned together.
+func (c *Client) refresh() error {
+	c.mu.Lock()
+	services := make(map[string]*watched, len(c.watched))
+	for s, w := range c.watched {
+		services[s] = w
+	}
+	c.mu.Unlock()
+
+	var errs []error
+	for service, w := range services {
+		w.mu.Lock()
+		live := w.live
+		w.mu.Unlock()
+		if live && !c.opts.PollLoads {
+			continue
+		}
+		rep, err := c.lookup(service)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		w.set(rep.Instances, rep.Revision)
+	}
+	return errors.Join(errs...)
+}
+
+func sameInstances(a, b []common.Instance) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		// anche i Meta: la manutenzione (Meta["maintenance"]) cambia il picker;
+		// un nuovo carico riportato serve al picker adaptive
+		if a[i].ID != b[i].ID || a[i].Addr != b[i].Addr || a[i].Weight != b[i].Weight || !maps.Equal(a[i].Meta, b[i].Meta) ||
+			!a[i].Load.ReportedAt.Equal(b[i].Load.ReportedAt) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Client) loop() {
+	t := time.NewTicker(c.opts.Refresh)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+		c.verify()
+		if err := c.refresh(); err != nil {
+			log.Printf("[discovery] refresh: %v", err)
+		}
+	}
+}
+
+// Close deregisters every instance registered through c and closes the connections.
+func (c *Client) Close() error {
+	var firstErr error
+	c.closeOnce.Do(func() {
+		for _, a := range c.registrations() {
+			if err := c.Deregister(a.Service, a.Instance.ID); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		close(c.done)
+		c.conns.Close()
+		c.connMu.Lock()
+		if c.conn != nil {
+			_ = c.conn.Close()
+			c.conn = nil
+		}
+		c.connMu.Unlock()
+	})
+	return firstErr
+}
@@ -0,0 +1,98 @@
+package discovery
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"example.com/service-registry-lb/common"
+	"example.com/service-registry-lb/internal/registry"
+	"example.com/service-registry-lb/internal/rpcctx"
+)
+
+// lookupOnly is a registry without WatchService (an older version).
+type lookupOnly struct{ r *registry.Registry }
+
+func (l *lookupOnly) Lookup(args *common.LookupArgs, reply *common.LookupReply) error {
+	return l.r.Lookup(args, reply)
+}
+
+// serve exposes rcvr as "Registry" and returns its address.
+func serve(t *testing.T, rcvr any) string {
+	t.Helper()
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Registry", rcvr); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	rpcctx.Handle(mux, srv, nil)
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return ts.Listener.Addr().String()
+}
+
+func register(t *testing.T, r *registry.Registry, id string) {
+	t.Helper()
+	var rep common.RegisterReply
+	if err := r.Register(&common.RegisterArgs{Service: "svc", Instance: common.Instance{ID: id, Addr: id, Weight: 1}}, &rep); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitInstances waits until the cached list of svc has n instances.
+func waitInstances(t *testing.T, c *Client, n int, within time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(within)
+	for {
+		insts, err := c.Instances("svc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(insts) == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d instances after %v, want %d", len(insts), within, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchFollowsChanges(t *testing.T) {
+	reg := registry.New()
+	register(t, reg, "a")
+	// polling di fatto spento: gli aggiornamenti arrivano solo dal watch
+	c, err := Dial(serve(t, reg), Options{Refresh: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	waitInstances(t, c, 1, 0)
+
+	register(t, reg, "b")
+	waitInstances(t, c, 2, time.Second)
+	var rep common.DeregisterReply
+	if err := reg.Deregister(&common.DeregisterArgs{Service: "svc", ID: "a"}, &rep); err != nil {
+		t.Fatal(err)
+	}
+	waitInstances(t, c, 1, time.Second)
+	if in, err := c.Pick("svc"); err != nil || in.ID != "b" {
+		t.Fatalf("Pick = %v, %v", in.ID, err)
+	}
+}
+
+func TestPollingWithoutWatch(t *testing.T) {
+	reg := registry.New()
+	register(t, reg, "a")
+	c, err := Dial(serve(t, &lookupOnly{reg}), Options{Refresh: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	waitInstances(t, c, 1, 0)
+
+	register(t, reg, "b")
+	waitInstances(t, c, 2, time.Second)
+}
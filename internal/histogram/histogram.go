@@ -0,0 +1,109 @@
+// Package histogram records latencies in log-linear buckets, in the style of
+// HdrHistogram: every power of two is split in 64 sub-buckets, so any recorded
+// value is reported with an error below 1/64 (~1.6%) whatever its magnitude,
+// with a few KB of memory and O(1) recording.
+package histogram
+
+import (
+	"math/bits"
+	"time"
+)
+
+const (
+	subBits  = 7 // valori < 2^subBits hanno un bucket ciascuno
+	subHalf  = 1 << (subBits - 1)
+	subCount = 1 << subBits
+)
+
+// Histogram is not safe for concurrent use: give each goroutine its own and Merge them.
+type Histogram struct {
+	counts []int64
+	total  int64
+	sum    float64
+	min    int64
+	max    int64
+}
+
+func New() *Histogram { return &Histogram{} }
+
+func bucketOf(v int64) int {
+	if v < subCount {
+		return int(v)
+	}
+	shift := bits.Len64(uint64(v)) - subBits
+	return (shift+1)*subHalf + int(v>>shift) - subHalf
+}
+
+// highestOf is the largest value that falls in bucket i.
+func highestOf(i int) int64 {
+	if i < subCount {
+		return int64(i)
+	}
+	shift := i/subHalf - 1
+	top := int64(i%subHalf + subHalf)
+	return (top+1)<<shift - 1
+}
+
+// Record adds one observation (negative durations count as 0).
+func (h *Histogram) Record(d time.Duration) {
+	v := max(int64(d), 0)
+	i := bucketOf(v)
+	if i >= len(h.counts) {
+		h.counts = append(h.counts, make([]int64, i+1-len(h.counts))...)
+	}
+	h.counts[i]++
+	if h.total == 0 || v < h.min {
+		h.min = v
+	}
+	h.max = max(h.max, v)
+	h.total++
+	h.sum += float64(v)
+}
+
+// Merge adds the observations of o to h.
+func (h *Histogram) Merge(o *Histogram) {
+	if o.total == 0 {
+		return
+	}
+	if len(o.counts) > len(h.counts) {
+		h.counts = append(h.counts, make([]int64, len(o.counts)-len(h.counts))...)
+	}
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	if h.total == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	h.max = max(h.max, o.max)
+	h.total += o.total
+	h.sum += o.sum
+}
+
+func (h *Histogram) Count() int64       { return h.total }
+func (h *Histogram) Min() time.Duration { return time.Duration(h.min) }
+func (h *Histogram) Max() time.Duration { return time.Duration(h.max) }
+
+func (h *Histogram) Mean() time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	return time.Duration(h.sum / float64(h.total))
+}
+
+// Quantile returns the value below which a fraction q (0..1) of the observations
+// fall, e.g. Quantile(0.99) is p99; it never exceeds Max.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := int64(q*float64(h.total) + 0.5)
+	rank = min(max(rank, 1), h.total)
+	var seen int64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			return time.Duration(min(highestOf(i), h.max))
+		}
+	}
+	return time.Duration(h.max)
+}
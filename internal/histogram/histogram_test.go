@@ -0,0 +1,120 @@
+package histogram
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketBoundaries(t *testing.T) {
+	tests := []struct {
+		v      int64
+		bucket int
+		high   int64 // highestOf(bucket)
+	}{
+		{0, 0, 0},
+		{1, 1, 1},
+		{subCount - 1, subCount - 1, subCount - 1}, // ultimo valore esatto
+		{subCount, subCount, subCount + 1},         // da qui bucket larghi 2
+		{subCount + 1, subCount, subCount + 1},
+		{subCount + 2, subCount + 1, subCount + 3},
+		{2*subCount - 1, subCount + subHalf - 1, 2*subCount - 1},
+		{2 * subCount, subCount + subHalf, 2*subCount + 3}, // larghi 4
+		{1 << 20, 15 * subHalf, 1<<20 + 1<<14 - 1},
+	}
+	for _, tt := range tests {
+		b := bucketOf(tt.v)
+		if b != tt.bucket {
+			t.Errorf("bucketOf(%d) = %d want %d", tt.v, b, tt.bucket)
+			continue
+		}
+		if h := highestOf(b); h != tt.high {
+			t.Errorf("highestOf(%d) = %d want %d", b, h, tt.high)
+		}
+	}
+}
+
+// TestBucketsCoverValues checks that consecutive buckets tile the values with no
+// gap or overlap and that every bucket is narrower than 1/64 of its values.
+func TestBucketsCoverValues(t *testing.T) {
+	for _, v := range []int64{0, 5, 127, 128, 1000, 4095, 4096, 123456, int64(time.Second), int64(time.Hour), 1<<62 + 12345} {
+		b := bucketOf(v)
+		high := highestOf(b)
+		low := int64(0)
+		if b > 0 {
+			low = highestOf(b-1) + 1
+		}
+		if v < low || v > high {
+			t.Errorf("%d in bucket %d = [%d, %d]", v, b, low, high)
+		}
+		if bucketOf(low) != b || bucketOf(high) != b {
+			t.Errorf("bucket %d: bounds [%d, %d] map to %d, %d", b, low, high, bucketOf(low), bucketOf(high))
+		}
+		if float64(high-low) > float64(low)/subHalf {
+			t.Errorf("bucket %d = [%d, %d] wider than 1/%d", b, low, high, subHalf)
+		}
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	uniform := New()
+	for i := 1; i <= 100; i++ {
+		uniform.Record(time.Duration(i))
+	}
+	tail := New()
+	for i := 0; i < 990; i++ {
+		tail.Record(time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		tail.Record(100 * time.Millisecond)
+	}
+	maxErr := func(d time.Duration) time.Duration { return d / subHalf }
+
+	tests := []struct {
+		name string
+		h    *Histogram
+		q    float64
+		want time.Duration
+	}{
+		{"empty", New(), 0.5, 0},
+		{"uniform p0 is min", uniform, 0, 1},
+		{"uniform p50", uniform, 0.5, 50},
+		{"uniform p99", uniform, 0.99, 99},
+		{"uniform p100 is max", uniform, 1, 100},
+		{"tail p50", tail, 0.5, time.Millisecond},
+		{"tail p99 last of the fast ones", tail, 0.99, time.Millisecond},
+		{"tail p99.1 first of the slow ones", tail, 0.991, 100 * time.Millisecond},
+		{"tail p100 capped at max", tail, 1, 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.h.Quantile(tt.q)
+			// il valore riportato è il massimo del bucket: mai sotto, al più 1/64 sopra
+			if got < tt.want || got > tt.want+maxErr(tt.want) {
+				t.Fatalf("Quantile(%v) = %v want %v (+%v)", tt.q, got, tt.want, maxErr(tt.want))
+			}
+			if got > tt.h.Max() {
+				t.Fatalf("Quantile(%v) = %v above max %v", tt.q, got, tt.h.Max())
+			}
+		})
+	}
+}
+
+func TestRecordAndMerge(t *testing.T) {
+	a, b := New(), New()
+	a.Record(-time.Second) // conta come 0
+	a.Record(10 * time.Millisecond)
+	b.Record(time.Millisecond)
+	b.Record(30 * time.Millisecond)
+	a.Merge(b)
+	a.Merge(New())
+
+	if a.Count() != 4 || a.Min() != 0 || a.Max() != 30*time.Millisecond {
+		t.Fatalf("count=%d min=%v max=%v", a.Count(), a.Min(), a.Max())
+	}
+	if a.Mean() != 41*time.Millisecond/4 {
+		t.Fatalf("mean %v", a.Mean())
+	}
+	if got := a.Quantile(0.75); got < 10*time.Millisecond || got > 10*time.Millisecond+10*time.Millisecond/subHalf {
+		t.Fatalf("p75 after merge = %v", got)
+	}
+}
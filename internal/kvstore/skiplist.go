@@ -0,0 +1,139 @@
+package kvstore
+
+import (
+	"math/rand"
+	"time"
+
+	"example.com/service-registry-lb/common"
+)
+
+const (
+	maxLevel = 24
+	pLevel   = 4 // 1/pLevel probability of promoting a node to the next level
+)
+
+type node struct {
+	key   string
+	entry common.KVEntry
+	next  []*node
+}
+
+// Store is a skiplist keyed by string, iterated in lexicographic order.
+// It is NOT safe for concurrent use: the kv service guards it with its own lock.
+type Store struct {
+	head   *node
+	level  int
+	length int
+	rnd    *rand.Rand
+}
+
+func New() *Store {
+	return &Store{
+		head:  &node{next: make([]*node, maxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (s *Store) Len() int { return s.length }
+
+func (s *Store) randomLevel() int {
+	lvl := 1
+	for lvl < maxLevel && s.rnd.Intn(pLevel) == 0 {
+		lvl++
+	}
+	return lvl
+}
+
+// seek fills update with the rightmost node < key at every level and
+// returns the first node >= key (or nil).
+func (s *Store) seek(key string, update []*node) *node {
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		if update != nil {
+			update[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+func (s *Store) Get(key string) (common.KVEntry, bool) {
+	n := s.seek(key, nil)
+	if n == nil || n.key != key {
+		return common.KVEntry{}, false
+	}
+	return n.entry, true
+}
+
+// Set inserts or replaces the entry for key.
+func (s *Store) Set(key string, e common.KVEntry) {
+	update := make([]*node, maxLevel)
+	n := s.seek(key, update)
+	if n != nil && n.key == key {
+		n.entry = e
+		return
+	}
+
+	lvl := s.randomLevel()
+	if lvl > s.level {
+		for i := s.level; i < lvl; i++ {
+			update[i] = s.head
+		}
+		s.level = lvl
+	}
+	n = &node{key: key, entry: e, next: make([]*node, lvl)}
+	for i := 0; i < lvl; i++ {
+		n.next[i] = update[i].next[i]
+		update[i].next[i] = n
+	}
+	s.length++
+}
+
+// Delete removes key and reports whether it was present.
+func (s *Store) Delete(key string) bool {
+	update := make([]*node, maxLevel)
+	n := s.seek(key, update)
+	if n == nil || n.key != key {
+		return false
+	}
+	for i := 0; i < s.level; i++ {
+		if update[i].next[i] != n {
+			break
+		}
+		update[i].next[i] = n.next[i]
+	}
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+	s.length--
+	return true
+}
+
+// Ascend calls fn for every key in [from, to) in order, until fn returns false.
+// An empty to means "up to the last key".
+func (s *Store) Ascend(from, to string, fn func(key string, e common.KVEntry) bool) {
+	for n := s.seek(from, nil); n != nil; n = n.next[0] {
+		if to != "" && n.key >= to {
+			return
+		}
+		if !fn(n.key, n.entry) {
+			return
+		}
+	}
+}
+
+// PrefixEnd returns the smallest key greater than every key starting with prefix,
+// or "" when no such bound exists (prefix empty or made only of 0xff bytes).
+func PrefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,154 @@
+package kvstore
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
+	"testing"
+
+	"example.com/service-registry-lb/common"
+)
+
+func entry(v string) common.KVEntry { return common.KVEntry{Value: v} }
+
+// keys returns the keys visited by Ascend(from, to).
+func keys(s *Store, from, to string) []string {
+	var out []string
+	s.Ascend(from, to, func(k string, _ common.KVEntry) bool {
+		out = append(out, k)
+		return true
+	})
+	return out
+}
+
+func TestSetGetDelete(t *testing.T) {
+	s := New()
+	steps := []struct {
+		op, key, value string
+		wantOK         bool // Get trova la chiave / Delete la rimuove
+		wantLen        int
+	}{
+		{"get", "a", "", false, 0},
+		{"set", "b", "1", true, 1},
+		{"set", "a", "2", true, 2},
+		{"set", "c", "3", true, 3},
+		{"get", "b", "1", true, 3},
+		{"set", "b", "4", true, 3}, // sostituisce
+		{"get", "b", "4", true, 3},
+		{"del", "x", "", false, 3},
+		{"del", "b", "", true, 2},
+		{"get", "b", "", false, 2},
+		{"del", "b", "", false, 2},
+		{"get", "", "", false, 2},
+		{"set", "", "empty", true, 3}, // la chiave vuota è una chiave come le altre
+		{"get", "", "empty", true, 3},
+	}
+	for i, st := range steps {
+		switch st.op {
+		case "set":
+			s.Set(st.key, entry(st.value))
+		case "get":
+			e, ok := s.Get(st.key)
+			if ok != st.wantOK || e.Value != st.value {
+				t.Fatalf("step %d: Get(%q) = %q,%v want %q,%v", i, st.key, e.Value, ok, st.value, st.wantOK)
+			}
+		case "del":
+			if ok := s.Delete(st.key); ok != st.wantOK {
+				t.Fatalf("step %d: Delete(%q) = %v want %v", i, st.key, ok, st.wantOK)
+			}
+		}
+		if s.Len() != st.wantLen {
+			t.Fatalf("step %d: Len = %d want %d", i, s.Len(), st.wantLen)
+		}
+	}
+}
+
+func TestAscend(t *testing.T) {
+	s := New()
+	for _, k := range []string{"b/2", "a", "b/1", "c", "b/10", "b"} {
+		s.Set(k, entry(k))
+	}
+	tests := []struct {
+		name     string
+		from, to string
+		want     []string
+	}{
+		{"all", "", "", []string{"a", "b", "b/1", "b/10", "b/2", "c"}},
+		{"from included", "b/1", "", []string{"b/1", "b/10", "b/2", "c"}},
+		{"to excluded", "", "b/1", []string{"a", "b"}},
+		{"prefix", "b/", PrefixEnd("b/"), []string{"b/1", "b/10", "b/2"}},
+		{"from between keys", "b/0", "b/2", []string{"b/1", "b/10"}},
+		{"empty range", "d", "", nil},
+		{"from after to", "c", "a", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := keys(s, tt.from, tt.to); !slices.Equal(got, tt.want) {
+				t.Fatalf("Ascend(%q, %q) = %v want %v", tt.from, tt.to, got, tt.want)
+			}
+		})
+	}
+
+	var n int
+	s.Ascend("", "", func(string, common.KVEntry) bool { n++; return n < 2 })
+	if n != 2 {
+		t.Fatalf("Ascend went on after fn returned false: %d calls", n)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tests := []struct {
+		prefix, want string
+	}{
+		{"", ""},
+		{"a", "b"},
+		{"ab", "ac"},
+		{"a\xff", "b"},
+		{"\xff\xff", ""},
+		{"user/", "user0"},
+	}
+	for _, tt := range tests {
+		if got := PrefixEnd(tt.prefix); got != tt.want {
+			t.Errorf("PrefixEnd(%q) = %q want %q", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+// TestMatchesMap applies random operations to the skiplist and to a map and
+// checks that contents and order agree.
+func TestMatchesMap(t *testing.T) {
+	s := New()
+	ref := map[string]string{}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		k := fmt.Sprintf("k%03d", rnd.Intn(300))
+		if rnd.Intn(3) == 0 {
+			_, had := ref[k]
+			if got := s.Delete(k); got != had {
+				t.Fatalf("Delete(%q) = %v want %v", k, got, had)
+			}
+			delete(ref, k)
+		} else {
+			v := fmt.Sprint(i)
+			s.Set(k, entry(v))
+			ref[k] = v
+		}
+	}
+	want := make([]string, 0, len(ref))
+	for k := range ref {
+		want = append(want, k)
+	}
+	sort.Strings(want)
+	if got := keys(s, "", ""); !slices.Equal(got, want) {
+		t.Fatalf("keys differ: %d in the skiplist, %d in the map", len(got), len(want))
+	}
+	if s.Len() != len(ref) {
+		t.Fatalf("Len = %d want %d", s.Len(), len(ref))
+	}
+	for k, v := range ref {
+		if e, ok := s.Get(k); !ok || e.Value != v {
+			t.Fatalf("Get(%q) = %q,%v want %q", k, e.Value, ok, v)
+		}
+	}
+}
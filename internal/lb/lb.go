@@ -2,7 +2,9 @@ package lb
 
 import (
 	"errors"
+	"fmt"
 	"math/rand"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -12,6 +14,40 @@ import (
 type Picker interface {
 	Pick() (common.Instance, error)
 	Name() string
+	// Update replaces the instance list keeping the picker state (rotation,
+	// current weights) for the instances that are still there.
+	Update(instances []common.Instance)
+}
+
+// Algos are the algorithm names accepted by New.
+var Algos = []string{"random", "rr", "wrr", "adaptive"}
+
+// New returns the picker of algorithm algo over instances.
+func New(algo string, instances []common.Instance) (Picker, error) {
+	switch algo {
+	case "random":
+		return NewRandom(instances), nil
+	case "rr":
+		return NewRoundRobin(instances), nil
+	case "wrr":
+		return NewSmoothWeightedRR(instances), nil
+	case "adaptive":
+		return NewAdaptive(instances), nil
+	default:
+		return nil, fmt.Errorf("unknown algo %q (use %s)", algo, strings.Join(Algos, "|"))
+	}
+}
+
+// routable drops the instances in maintenance: they stay registered (a kv
+// backup keeps replicating) but receive no new requests.
+func routable(instances []common.Instance) []common.Instance {
+	out := make([]common.Instance, 0, len(instances))
+	for _, inst := range instances {
+		if !common.InMaintenance(inst) {
+			out = append(out, inst)
+		}
+	}
+	return out
 }
 
 // -------- Random (stateless) --------
@@ -23,13 +59,17 @@ type RandomPicker struct {
 
 func NewRandom(instances []common.Instance) *RandomPicker {
 	return &RandomPicker{
-		instances: append([]common.Instance(nil), instances...),
+		instances: routable(instances),
 		rnd:       rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 }
 
 func (p *RandomPicker) Name() string { return "random" }
 
+func (p *RandomPicker) Update(instances []common.Instance) {
+	p.instances = routable(instances)
+}
+
 func (p *RandomPicker) Pick() (common.Instance, error) {
 	if len(p.instances) == 0 {
 		return common.Instance{}, errors.New("no instances")
@@ -46,12 +86,17 @@ type RoundRobinPicker struct {
 
 func NewRoundRobin(instances []common.Instance) *RoundRobinPicker {
 	return &RoundRobinPicker{
-		instances: append([]common.Instance(nil), instances...),
+		instances: routable(instances),
 	}
 }
 
 func (p *RoundRobinPicker) Name() string { return "round_robin" }
 
+// Update keeps the counter: the rotation goes on from where it was.
+func (p *RoundRobinPicker) Update(instances []common.Instance) {
+	p.instances = routable(instances)
+}
+
 func (p *RoundRobinPicker) Pick() (common.Instance, error) {
 	if len(p.instances) == 0 {
 		return common.Instance{}, errors.New("no instances")
@@ -72,11 +117,24 @@ type SmoothWeightedRR struct {
 }
 
 func NewSmoothWeightedRR(instances []common.Instance) *SmoothWeightedRR {
-	p := &SmoothWeightedRR{
-		instances: append([]common.Instance(nil), instances...),
-		current:   make([]int, len(instances)),
+	p := &SmoothWeightedRR{}
+	p.Update(instances)
+	return p
+}
+
+// Update keeps the current weight of the instances (by ID) that are still listed;
+// new instances start from 0.
+func (p *SmoothWeightedRR) Update(instances []common.Instance) {
+	prev := make(map[string]int, len(p.instances))
+	for i, inst := range p.instances {
+		prev[inst.ID] = p.current[i]
 	}
-	for _, inst := range instances {
+	instances = routable(instances)
+	p.instances = instances
+	p.current = make([]int, len(instances))
+	p.totalW = 0
+	for i, inst := range instances {
+		p.current[i] = prev[inst.ID]
 		w := inst.Weight
 		if w <= 0 {
 			w = 1
@@ -86,7 +144,6 @@ func NewSmoothWeightedRR(instances []common.Instance) *SmoothWeightedRR {
 	if p.totalW == 0 {
 		p.totalW = 1
 	}
-	return p
 }
 
 func (p *SmoothWeightedRR) Name() string { return "smooth_weighted_rr" }
@@ -114,3 +171,99 @@ func (p *SmoothWeightedRR) Pick() (common.Instance, error) {
 	p.current[best] -= p.totalW
 	return p.instances[best], nil
 }
+
+// -------- Adaptive (load-aware weighted) --------
+//
+// Smooth weighted round-robin over effective weights derived from the load the
+// instances report with their heartbeats (common.Load): an instance gets
+// Weight × CPU headroom / (1 + in-flight + queue), so faster backends, which
+// keep both low, get proportionally more traffic. The load factor never drops
+// below minShare, so a busy instance still gets some traffic and can report a
+// lower load again. Loads older than LoadMaxAge are ignored and the plain
+// Weight is used. Weights are recomputed by Update, and by Pick once one of
+// the loads they use ages out: callers that skip Update when no load changed
+// never keep weighting picks with a stale load.
+
+// LoadMaxAge is how long a reported load is trusted.
+const LoadMaxAge = 10 * time.Second
+
+// minShare is the lowest fraction of its Weight an instance gets, however loaded.
+const minShare = 0.05
+
+type Adaptive struct {
+	instances []common.Instance
+	weights   []float64
+	current   []float64
+	totalW    float64
+	staleAt   time.Time // il primo load usato nei pesi scade qui (zero = nessuno)
+}
+
+func NewAdaptive(instances []common.Instance) *Adaptive {
+	p := &Adaptive{}
+	p.Update(instances)
+	return p
+}
+
+func (p *Adaptive) Name() string { return "adaptive" }
+
+// Update recomputes the effective weights, keeping the current ones by ID.
+func (p *Adaptive) Update(instances []common.Instance) {
+	prev := make(map[string]float64, len(p.instances))
+	for i, inst := range p.instances {
+		prev[inst.ID] = p.current[i]
+	}
+	instances = routable(instances)
+	p.instances = instances
+	p.weights = make([]float64, len(instances))
+	p.current = make([]float64, len(instances))
+	for i, inst := range instances {
+		p.current[i] = prev[inst.ID]
+	}
+	p.reweight(time.Now())
+}
+
+// reweight computes the effective weights at now and when the first trusted load expires.
+func (p *Adaptive) reweight(now time.Time) {
+	p.totalW = 0
+	p.staleAt = time.Time{}
+	for i, inst := range p.instances {
+		p.weights[i] = EffectiveWeight(inst, now)
+		p.totalW += p.weights[i]
+		if at := inst.Load.ReportedAt.Add(LoadMaxAge); trusted(inst.Load, now) && (p.staleAt.IsZero() || at.Before(p.staleAt)) {
+			p.staleAt = at
+		}
+	}
+}
+
+func trusted(l common.Load, now time.Time) bool {
+	return !l.ReportedAt.IsZero() && now.Sub(l.ReportedAt) <= LoadMaxAge
+}
+
+// EffectiveWeight is the weight the adaptive picker gives inst at time now.
+func EffectiveWeight(inst common.Instance, now time.Time) float64 {
+	w := float64(max(inst.Weight, 1))
+	l := inst.Load
+	if !trusted(l, now) {
+		return w
+	}
+	headroom := max(1-l.CPU, 0)
+	return w * max(headroom/(1+max(l.InFlight, 0)+float64(max(l.Queue, 0))), minShare)
+}
+
+func (p *Adaptive) Pick() (common.Instance, error) {
+	if len(p.instances) == 0 {
+		return common.Instance{}, errors.New("no instances")
+	}
+	if now := time.Now(); !p.staleAt.IsZero() && now.After(p.staleAt) {
+		p.reweight(now)
+	}
+	best := 0
+	for i := range p.instances {
+		p.current[i] += p.weights[i]
+		if p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+	p.current[best] -= p.totalW
+	return p.instances[best], nil
+}
@@ -0,0 +1,203 @@
+package lb
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"example.com/service-registry-lb/common"
+)
+
+func inst(id string, weight int, load common.Load) common.Instance {
+	return common.Instance{ID: id, Addr: id, Weight: weight, Load: load}
+}
+
+// counts picks n times and returns the picks per instance ID.
+func counts(t *testing.T, p Picker, n int) map[string]int {
+	t.Helper()
+	out := map[string]int{}
+	for i := 0; i < n; i++ {
+		in, err := p.Pick()
+		if err != nil {
+			t.Fatalf("pick: %v", err)
+		}
+		out[in.ID]++
+	}
+	return out
+}
+
+func TestEffectiveWeight(t *testing.T) {
+	now := time.Now()
+	fresh := now.Add(-time.Second)
+	tests := []struct {
+		name string
+		inst common.Instance
+		want float64
+	}{
+		{"never reported", inst("a", 3, common.Load{InFlight: 50}), 3},
+		{"stale", inst("a", 3, common.Load{InFlight: 50, ReportedAt: now.Add(-LoadMaxAge - time.Second)}), 3},
+		{"zero weight counts as 1", inst("a", 0, common.Load{}), 1},
+		{"idle", inst("a", 2, common.Load{ReportedAt: fresh}), 2},
+		{"half cpu", inst("a", 2, common.Load{CPU: 0.5, ReportedAt: fresh}), 1},
+		{"in flight and queue", inst("a", 4, common.Load{InFlight: 1, Queue: 2, ReportedAt: fresh}), 1},
+		{"full cpu keeps min share", inst("a", 2, common.Load{CPU: 1, ReportedAt: fresh}), 2 * minShare},
+		{"many in flight keeps min share", inst("a", 1, common.Load{InFlight: 1000, ReportedAt: fresh}), minShare},
+		{"negative values ignored", inst("a", 1, common.Load{InFlight: -3, Queue: -1, ReportedAt: fresh}), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := EffectiveWeight(tt.inst, now); math.Abs(got-tt.want) > 1e-9 {
+				t.Fatalf("EffectiveWeight = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdaptiveDistribution(t *testing.T) {
+	fresh := time.Now()
+	tests := []struct {
+		name      string
+		instances []common.Instance
+		want      map[string]float64 // quota attesa per ID
+	}{
+		{
+			name: "no load reported: plain weights",
+			instances: []common.Instance{
+				inst("a", 1, common.Load{}), inst("b", 3, common.Load{}),
+			},
+			want: map[string]float64{"a": 0.25, "b": 0.75},
+		},
+		{
+			name: "skewed in flight",
+			instances: []common.Instance{
+				inst("fast", 1, common.Load{ReportedAt: fresh}),
+				inst("slow", 1, common.Load{InFlight: 3, ReportedAt: fresh}),
+			},
+			want: map[string]float64{"fast": 0.8, "slow": 0.2},
+		},
+		{
+			name: "saturated instance is not starved",
+			instances: []common.Instance{
+				inst("idle", 1, common.Load{ReportedAt: fresh}),
+				inst("busy", 1, common.Load{CPU: 1, InFlight: 500, ReportedAt: fresh}),
+			},
+			want: map[string]float64{"idle": 1 / (1 + minShare), "busy": minShare / (1 + minShare)},
+		},
+		{
+			name: "stale load falls back to weight",
+			instances: []common.Instance{
+				inst("a", 1, common.Load{ReportedAt: fresh}),
+				inst("b", 1, common.Load{InFlight: 9, ReportedAt: fresh.Add(-time.Minute)}),
+			},
+			want: map[string]float64{"a": 0.5, "b": 0.5},
+		},
+	}
+	const n = 2000
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := counts(t, NewAdaptive(tt.instances), n)
+			for id, share := range tt.want {
+				// lo smooth WRR è deterministico: al massimo una scelta di scarto
+				if d := math.Abs(float64(got[id]) - share*n); d > 2 {
+					t.Errorf("%s: %d picks, want %.0f", id, got[id], share*n)
+				}
+			}
+		})
+	}
+}
+
+func TestAdaptiveSmooth(t *testing.T) {
+	// pesi 2:1: mai due scelte consecutive dell'istanza più leggera
+	p := NewAdaptive([]common.Instance{inst("a", 2, common.Load{}), inst("b", 1, common.Load{})})
+	prev := ""
+	for i := 0; i < 30; i++ {
+		in, _ := p.Pick()
+		if in.ID == "b" && prev == "b" {
+			t.Fatalf("b picked twice in a row at %d", i)
+		}
+		prev = in.ID
+	}
+}
+
+func TestAdaptiveLoadAgesOutWithoutUpdate(t *testing.T) {
+	// il load di "busy" scade fra 50ms e nessuno richiama Update (ReportedAt invariato)
+	busy := inst("busy", 1, common.Load{CPU: 1, ReportedAt: time.Now().Add(-LoadMaxAge + 50*time.Millisecond)})
+	p := NewAdaptive([]common.Instance{busy, inst("idle", 1, common.Load{})})
+	const n = 1000
+	if got := counts(t, p, n); got["busy"] > n/10 {
+		t.Fatalf("busy got %d of %d picks with a fresh load", got["busy"], n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got := counts(t, p, n); math.Abs(float64(got["busy"]-got["idle"])) > 2 {
+		t.Fatalf("after the load aged out: %v, want an even split", got)
+	}
+}
+
+func TestPickersSkipMaintenance(t *testing.T) {
+	down := inst("down", 1, common.Load{})
+	down.Meta = map[string]string{common.MetaMaintenance: "true"}
+	instances := []common.Instance{inst("up", 1, common.Load{}), down}
+	for _, p := range []Picker{NewRandom(instances), NewRoundRobin(instances), NewSmoothWeightedRR(instances), NewAdaptive(instances)} {
+		if got := counts(t, p, 20); got["down"] != 0 || got["up"] != 20 {
+			t.Errorf("%s: picks %v", p.Name(), got)
+		}
+	}
+}
+
+func TestPickersNoInstances(t *testing.T) {
+	for _, p := range []Picker{NewRandom(nil), NewRoundRobin(nil), NewSmoothWeightedRR(nil), NewAdaptive(nil)} {
+		if _, err := p.Pick(); err == nil {
+			t.Errorf("%s: picked from an empty list", p.Name())
+		}
+	}
+}
+
+func TestSmoothWeightedRRSequence(t *testing.T) {
+	p := NewSmoothWeightedRR([]common.Instance{inst("a", 5, common.Load{}), inst("b", 1, common.Load{}), inst("c", 1, common.Load{})})
+	want := "aabacaa"
+	got := ""
+	for range want {
+		in, _ := p.Pick()
+		got += in.ID
+	}
+	if got != want {
+		t.Fatalf("sequence %q, want %q", got, want)
+	}
+}
+
+func TestUpdateKeepsState(t *testing.T) {
+	a, b, c := inst("a", 1, common.Load{}), inst("b", 1, common.Load{}), inst("c", 1, common.Load{})
+	tests := []struct {
+		name string
+		p    Picker
+	}{
+		{"rr", NewRoundRobin([]common.Instance{a, b})},
+		{"wrr", NewSmoothWeightedRR([]common.Instance{a, b})},
+		{"adaptive", NewAdaptive([]common.Instance{a, b})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, _ := tt.p.Pick()
+			// stessa lista rinfrescata (es. nuovi carichi): la rotazione non riparte da capo
+			tt.p.Update([]common.Instance{a, b, c})
+			second, _ := tt.p.Pick()
+			if second.ID == first.ID {
+				t.Fatalf("picked %s again after Update", first.ID)
+			}
+			if got := counts(t, tt.p, 30); got["c"] == 0 {
+				t.Fatalf("new instance never picked: %v", got)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, algo := range Algos {
+		if p, err := New(algo, []common.Instance{inst("a", 1, common.Load{})}); err != nil || p == nil {
+			t.Errorf("New(%q) = %v, %v", algo, p, err)
+		}
+	}
+	if _, err := New("fastest", nil); err == nil {
+		t.Error("unknown algo accepted")
+	}
+}
@@ -0,0 +1,178 @@
+package registry
+
+import (
+	"errors"
+	"maps"
+	"sort"
+	"time"
+
+	"example.com/service-registry-lb/common"
+)
+
+// DefaultHealthTTL is how long an instance stays healthy after its last
+// registration or heartbeat (the discovery client beats every 2s by default).
+const DefaultHealthTTL = 10 * time.Second
+
+// instanceState is what the registry knows about an instance besides its data.
+type instanceState struct {
+	registeredAt time.Time
+	lastSeen     time.Time
+	version      int64 // 1 alla registrazione, +1 ad ogni modifica (per UpdateInstance)
+}
+
+// SetHealthTTL changes the window of DefaultHealthTTL.
+func (r *Registry) SetHealthTTL(d time.Duration) {
+	if d <= 0 {
+		d = DefaultHealthTTL
+	}
+	r.mu.Lock()
+	r.healthTTL = d
+	r.mu.Unlock()
+}
+
+// stateLocked returns the state of service/id, starting a new one if the
+// instance was not registered (existed false). Caller holds r.mu.
+func (r *Registry) stateLocked(service, id string, existed bool) *instanceState {
+	st := r.states[service+"/"+id]
+	if st == nil || !existed {
+		st = &instanceState{registeredAt: time.Now()}
+		r.states[service+"/"+id] = st
+	}
+	return st
+}
+
+// healthyLocked reports whether service/id has been seen within the TTL. Caller holds r.mu.
+func (r *Registry) healthyLocked(service, id string, now time.Time) bool {
+	st := r.states[service+"/"+id]
+	return st != nil && now.Sub(st.lastSeen) <= r.healthTTL
+}
+
+// Heartbeat refreshes the last-seen time (and the load) of an instance; it never wakes the watchers.
+func (r *Registry) Heartbeat(args *common.HeartbeatArgs, reply *common.HeartbeatReply) error {
+	if args == nil || args.Service == "" || args.ID == "" {
+		return errors.New("invalid heartbeat args")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	inst, ok := r.services[args.Service][args.ID]
+	if !ok {
+		reply.Found = false
+		return nil
+	}
+	now := time.Now()
+	r.stateLocked(args.Service, args.ID, true).lastSeen = now
+	if args.Load != nil {
+		// il carico cambia ad ogni heartbeat: niente bump, chi lo usa rilegge con Lookup
+		inst.Load = *args.Load
+		inst.Load.ReportedAt = now
+		r.services[args.Service][args.ID] = inst
+	}
+	reply.Found = true
+	return nil
+}
+
+// ListServices returns every service with its instance and healthy counts and tags.
+func (r *Registry) ListServices(args *common.ListServicesArgs, reply *common.ListServicesReply) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	now := time.Now()
+	reply.Services = make([]common.ServiceInfo, 0, len(r.services))
+	for name, m := range r.services {
+		info := common.ServiceInfo{Name: name, Instances: len(m), Revision: r.revisions[name]}
+		tags := map[string]bool{}
+		for id, inst := range m {
+			if r.healthyLocked(name, id, now) {
+				info.Healthy++
+			}
+			if common.InMaintenance(inst) {
+				info.Maintenance++
+			}
+			for k, v := range inst.Meta {
+				tags[k+"="+v] = true
+			}
+		}
+		for t := range tags {
+			info.Tags = append(info.Tags, t)
+		}
+		sort.Strings(info.Tags)
+		reply.Services = append(reply.Services, info)
+	}
+	sort.Slice(reply.Services, func(i, j int) bool { return reply.Services[i].Name < reply.Services[j].Name })
+	return nil
+}
+
+// GetInstance returns one instance with its registration and last-seen times.
+func (r *Registry) GetInstance(args *common.GetInstanceArgs, reply *common.GetInstanceReply) error {
+	if args == nil || args.Service == "" || args.ID == "" {
+		return errors.New("invalid get instance args")
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	inst, ok := r.services[args.Service][args.ID]
+	if !ok {
+		reply.Found = false
+		return nil
+	}
+	reply.Found = true
+	reply.Instance = inst
+	reply.Healthy = r.healthyLocked(args.Service, args.ID, time.Now())
+	if st := r.states[args.Service+"/"+args.ID]; st != nil {
+		reply.RegisteredAt = st.registeredAt
+		reply.LastSeen = st.lastSeen
+		reply.Version = st.version
+	}
+	return nil
+}
+
+// UpdateInstance applies a partial update (weight, metadata keys) to an
+// instance, optionally only at the expected version.
+func (r *Registry) UpdateInstance(args *common.UpdateInstanceArgs, reply *common.UpdateInstanceReply) error {
+	if args == nil || args.Service == "" || args.ID == "" || args.Weight < 0 {
+		return errors.New("invalid update instance args")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	inst, ok := r.services[args.Service][args.ID]
+	if !ok {
+		reply.Found = false
+		return nil
+	}
+	st := r.stateLocked(args.Service, args.ID, true)
+	reply.Found = true
+	if args.ExpectedVersion != 0 && args.ExpectedVersion != st.version {
+		reply.Instance = inst
+		reply.Version = st.version
+		return nil
+	}
+
+	next := inst
+	if args.Weight > 0 {
+		next.Weight = args.Weight
+	}
+	if len(args.Meta) > 0 {
+		next.Meta = maps.Clone(inst.Meta)
+		if next.Meta == nil {
+			next.Meta = make(map[string]string)
+		}
+		for k, v := range args.Meta {
+			if v == "" {
+				delete(next.Meta, k)
+			} else {
+				next.Meta[k] = v
+			}
+		}
+	}
+	if !sameInstance(inst, next) {
+		r.services[args.Service][args.ID] = next
+		st.version++
+		r.bumpLocked(args.Service)
+	}
+	reply.OK = true
+	reply.Instance = next
+	reply.Version = st.version
+	return nil
+}
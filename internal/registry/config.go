@@ -0,0 +1,191 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"example.com/service-registry-lb/common"
+)
+
+// maxTombstones bounds the deletions remembered for ConfigWatch.
+const maxTombstones = 1024
+
+// configStore holds the configuration entries; it is guarded by Registry.mu.
+type configStore struct {
+	entries map[string]common.ConfigEntry
+	deleted map[string]int64 // chiave -> revisione della cancellazione (per ConfigWatch)
+	floor   int64            // cancellazioni fino a questa revisione dimenticate
+	rev     int64
+	changed chan struct{} // chiuso (e sostituito) ad ogni modifica
+}
+
+func newConfigStore() *configStore {
+	return &configStore{
+		entries: make(map[string]common.ConfigEntry),
+		deleted: make(map[string]int64),
+		changed: make(chan struct{}),
+	}
+}
+
+func (c *configStore) bump() int64 {
+	c.rev++
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return c.rev
+}
+
+// tombstone records the deletion of key. Past maxTombstones the older half is
+// dropped and floor moves to the newest dropped revision: a watcher behind it
+// may have missed a deletion and gets the whole state again (see ConfigWatch).
+func (c *configStore) tombstone(key string) {
+	c.deleted[key] = c.bump()
+	if len(c.deleted) <= maxTombstones {
+		return
+	}
+	revs := make([]int64, 0, len(c.deleted))
+	for _, rev := range c.deleted {
+		revs = append(revs, rev)
+	}
+	sort.Slice(revs, func(i, j int) bool { return revs[i] < revs[j] })
+	c.floor = max(c.floor, revs[len(revs)-maxTombstones/2-1])
+	for k, rev := range c.deleted {
+		if rev <= c.floor {
+			delete(c.deleted, k)
+		}
+	}
+}
+
+// list returns the entries under prefix sorted by key and the last revision that touched them.
+func (c *configStore) list(prefix string) ([]common.ConfigEntry, int64) {
+	var out []common.ConfigEntry
+	var last int64
+	for k, e := range c.entries {
+		if strings.HasPrefix(k, prefix) {
+			out = append(out, e)
+			last = max(last, e.Revision)
+		}
+	}
+	for k, rev := range c.deleted {
+		if strings.HasPrefix(k, prefix) {
+			last = max(last, rev)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Key < out[j].Key })
+	return out, last
+}
+
+func validConfigKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.HasSuffix(key, "/") || strings.Contains(key, "//") {
+		return fmt.Errorf("invalid config key %q", key)
+	}
+	return nil
+}
+
+// ConfigPut creates or updates a configuration entry (optionally compare-and-swap).
+func (r *Registry) ConfigPut(args *common.ConfigPutArgs, reply *common.ConfigPutReply) error {
+	if args == nil {
+		return errors.New("invalid config args")
+	}
+	if err := validConfigKey(args.Key); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cur := r.config.entries[args.Key]
+	if args.CAS && cur.Version != args.ExpectedVersion {
+		reply.Entry = cur
+		return nil
+	}
+	e := common.ConfigEntry{Key: args.Key, Value: args.Value, Version: cur.Version + 1, Revision: r.config.bump()}
+	r.config.entries[args.Key] = e
+	delete(r.config.deleted, args.Key)
+	reply.OK = true
+	reply.Entry = e
+	return nil
+}
+
+// ConfigGet reads one entry.
+func (r *Registry) ConfigGet(args *common.ConfigGetArgs, reply *common.ConfigGetReply) error {
+	if args == nil || args.Key == "" {
+		return errors.New("invalid config args")
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	reply.Entry, reply.Found = r.config.entries[args.Key]
+	return nil
+}
+
+// ConfigList returns every entry under a prefix ("" = all).
+func (r *Registry) ConfigList(args *common.ConfigListArgs, reply *common.ConfigListReply) error {
+	if args == nil {
+		args = &common.ConfigListArgs{}
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	reply.Entries, _ = r.config.list(args.Prefix)
+	reply.Revision = r.config.rev
+	return nil
+}
+
+// ConfigDelete removes an entry (optionally compare-and-swap).
+func (r *Registry) ConfigDelete(args *common.ConfigDeleteArgs, reply *common.ConfigDeleteReply) error {
+	if args == nil || args.Key == "" {
+		return errors.New("invalid config args")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cur, ok := r.config.entries[args.Key]
+	reply.Entry = cur
+	if args.CAS && cur.Version != args.ExpectedVersion {
+		return nil
+	}
+	reply.OK = true
+	if !ok {
+		return nil
+	}
+	delete(r.config.entries, args.Key)
+	r.config.tombstone(args.Key)
+	reply.Deleted = true
+	return nil
+}
+
+// ConfigWatch waits for a change under a prefix, like WatchLock does for a lease.
+// A watcher whose AfterRevision is past the counter (the registry restarted) or
+// behind the tombstone floor gets the current entries at once.
+func (r *Registry) ConfigWatch(args *common.ConfigWatchArgs, reply *common.ConfigWatchReply) error {
+	if args == nil {
+		args = &common.ConfigWatchArgs{}
+	}
+	timer := time.NewTimer(watchWait(args.Timeout))
+	defer timer.Stop()
+	for {
+		r.mu.RLock()
+		entries, last := r.config.list(args.Prefix)
+		rev := r.config.rev
+		// AfterRevision oltre il contatore: il registry è ripartito, i valori del client sono vecchi
+		restarted := args.AfterRevision > rev
+		// cancellazioni dopo AfterRevision forse già dimenticate
+		missed := args.AfterRevision < r.config.floor
+		changed := r.config.changed
+		r.mu.RUnlock()
+
+		reply.Revision = rev
+		if last > args.AfterRevision || restarted || missed {
+			reply.Changed = true
+			reply.Entries = entries
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package registry
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"example.com/service-registry-lb/common"
+)
+
+func configPut(t *testing.T, r *Registry, key, value string) common.ConfigEntry {
+	t.Helper()
+	var rep common.ConfigPutReply
+	if err := r.ConfigPut(&common.ConfigPutArgs{Key: key, Value: value}, &rep); err != nil || !rep.OK {
+		t.Fatalf("ConfigPut %s: ok=%v err=%v", key, rep.OK, err)
+	}
+	return rep.Entry
+}
+
+func configWatch(t *testing.T, r *Registry, prefix string, after int64) common.ConfigWatchReply {
+	t.Helper()
+	var rep common.ConfigWatchReply
+	if err := r.ConfigWatch(&common.ConfigWatchArgs{Prefix: prefix, AfterRevision: after, Timeout: 20 * time.Millisecond}, &rep); err != nil {
+		t.Fatal(err)
+	}
+	return rep
+}
+
+func TestConfigWatch(t *testing.T) {
+	r := New()
+	e := configPut(t, r, "math/delay", "5ms")
+	configPut(t, r, "echo/prefix", "x")
+
+	tests := []struct {
+		name    string
+		prefix  string
+		after   int64
+		changed bool
+	}{
+		{"up to date", "math/", r.config.rev, false},
+		{"other prefix changed later", "math/", e.Revision, false},
+		{"missed a write", "math/", e.Revision - 1, true},
+		// un registry ripartito ha il contatore sotto la revisione del client
+		{"registry restarted", "math/", r.config.rev + 100, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rep := configWatch(t, r, tt.prefix, tt.after)
+			if rep.Changed != tt.changed {
+				t.Fatalf("Changed = %v, want %v", rep.Changed, tt.changed)
+			}
+			if rep.Revision != r.config.rev {
+				t.Errorf("Revision = %d, want %d", rep.Revision, r.config.rev)
+			}
+			if tt.changed && (len(rep.Entries) != 1 || rep.Entries[0].Key != "math/delay") {
+				t.Errorf("Entries = %+v, want math/delay only", rep.Entries)
+			}
+		})
+	}
+}
+
+func TestConfigTombstonesBounded(t *testing.T) {
+	r := New()
+	var firstDelete int64
+	for i := 0; i < maxTombstones+10; i++ {
+		key := fmt.Sprintf("svc/k%d", i)
+		configPut(t, r, key, "v")
+		var rep common.ConfigDeleteReply
+		if err := r.ConfigDelete(&common.ConfigDeleteArgs{Key: key}, &rep); err != nil || !rep.Deleted {
+			t.Fatalf("ConfigDelete %s: deleted=%v err=%v", key, rep.Deleted, err)
+		}
+		if i == 0 {
+			firstDelete = r.config.rev
+		}
+	}
+	if n := len(r.config.deleted); n > maxTombstones {
+		t.Fatalf("%d tombstones kept, want at most %d", n, maxTombstones)
+	}
+	if r.config.floor < firstDelete {
+		t.Fatalf("floor %d below the first dropped deletion %d", r.config.floor, firstDelete)
+	}
+	// chi è rimasto prima del floor potrebbe aver perso una cancellazione: riceve lo stato
+	if rep := configWatch(t, r, "svc/", firstDelete-1); !rep.Changed || len(rep.Entries) != 0 {
+		t.Errorf("watch behind the floor: Changed=%v entries=%d, want a change with no entries", rep.Changed, len(rep.Entries))
+	}
+	if rep := configWatch(t, r, "svc/", r.config.rev); rep.Changed {
+		t.Error("up-to-date watcher woke up")
+	}
+}
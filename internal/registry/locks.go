@@ -0,0 +1,227 @@
+package registry
+
+import (
+	"errors"
+	"time"
+
+	"example.com/service-registry-lb/common"
+)
+
+const (
+	minLockTTL       = 500 * time.Millisecond
+	maxLockTTL       = time.Minute
+	defaultWatchWait = 30 * time.Second
+	maxWatchWait     = 2 * time.Minute
+	minLockSweep     = 64 // numero di lease oltre il quale lockLocked elimina quelle libere
+)
+
+// lease is a named lock held by one owner until expires.
+type lease struct {
+	holder  string
+	value   string
+	token   int64 // fencing token: cresce ad ogni cambio di owner
+	expires time.Time
+	changed chan struct{} // chiuso (e sostituito) quando cambia owner o viene rilasciato
+	waiters int           // WatchLock in attesa: finché ce ne sono la lease non si elimina
+}
+
+func newLease() *lease {
+	return &lease{changed: make(chan struct{})}
+}
+
+func (l *lease) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *lease) heldAt(now time.Time) bool {
+	return l != nil && l.holder != "" && now.Before(l.expires)
+}
+
+func lockTTL(ttl time.Duration) time.Duration {
+	switch {
+	case ttl <= 0:
+		return common.DefaultLockTTL
+	case ttl < minLockTTL:
+		return minLockTTL
+	case ttl > maxLockTTL:
+		return maxLockTTL
+	}
+	return ttl
+}
+
+func watchWait(d time.Duration) time.Duration {
+	if d <= 0 {
+		return defaultWatchWait
+	}
+	if d > maxWatchWait {
+		return maxWatchWait
+	}
+	return d
+}
+
+// lockLocked returns the lease for name, creating a free one. Caller holds r.mu.
+// Free leases are deleted on release; those left to expire are swept here,
+// each time the map has doubled since the last sweep.
+func (r *Registry) lockLocked(name string, now time.Time) *lease {
+	l, ok := r.locks[name]
+	if ok {
+		return l
+	}
+	if len(r.locks) >= max(r.lockSweepAt, minLockSweep) {
+		for n, old := range r.locks {
+			r.pruneLockLocked(n, old, now)
+		}
+		r.lockSweepAt = 2 * len(r.locks)
+	}
+	l = newLease()
+	r.locks[name] = l
+	return l
+}
+
+// pruneLockLocked deletes the lease if it is free and nobody watches it: the
+// fencing tokens come from r.lockToken, so a new lease never reuses one.
+// Caller holds r.mu.
+func (r *Registry) pruneLockLocked(name string, l *lease, now time.Time) {
+	if !l.heldAt(now) && l.waiters == 0 {
+		delete(r.locks, name)
+	}
+}
+
+// AcquireLock grants the lease to args.Owner if nobody else holds it.
+// Expiry is evaluated lazily: an expired lease is simply free.
+func (r *Registry) AcquireLock(args *common.AcquireLockArgs, reply *common.AcquireLockReply) error {
+	if args == nil || args.Name == "" || args.Owner == "" {
+		return errors.New("invalid lock args")
+	}
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	l := r.lockLocked(args.Name, now)
+	if l.heldAt(now) && l.holder != args.Owner {
+		reply.Holder, reply.Value, reply.Token, reply.TTL = l.holder, l.value, l.token, l.expires.Sub(now)
+		return nil
+	}
+	if !l.heldAt(now) || l.token <= args.MinToken {
+		// nuovo owner (o lo stesso dopo la scadenza, o con un token già superato): nuovo token
+		r.lockToken = max(r.lockToken, args.MinToken) + 1
+		l.token = r.lockToken
+		l.holder = args.Owner
+		l.notify()
+	}
+	l.value = args.Value
+	l.expires = now.Add(lockTTL(args.TTL))
+
+	reply.Acquired = true
+	reply.Holder, reply.Value, reply.Token, reply.TTL = l.holder, l.value, l.token, l.expires.Sub(now)
+	return nil
+}
+
+// RenewLock extends the lease only for its current holder and token.
+func (r *Registry) RenewLock(args *common.RenewLockArgs, reply *common.RenewLockReply) error {
+	if args == nil || args.Name == "" || args.Owner == "" {
+		return errors.New("invalid lock args")
+	}
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	l := r.locks[args.Name]
+	if !l.heldAt(now) || l.holder != args.Owner || l.token != args.Token {
+		if l.heldAt(now) {
+			reply.Holder, reply.Token = l.holder, l.token
+		}
+		return nil
+	}
+	l.expires = now.Add(lockTTL(args.TTL))
+	reply.OK = true
+	reply.Holder, reply.Token = l.holder, l.token
+	return nil
+}
+
+// GetLock returns the live holder of a lease, if any.
+func (r *Registry) GetLock(args *common.GetLockArgs, reply *common.GetLockReply) error {
+	if args == nil || args.Name == "" {
+		return errors.New("invalid lock args")
+	}
+	now := time.Now()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	l := r.locks[args.Name]
+	if !l.heldAt(now) {
+		return nil
+	}
+	reply.Held = true
+	reply.Holder, reply.Value, reply.Token, reply.TTL = l.holder, l.value, l.token, l.expires.Sub(now)
+	return nil
+}
+
+// ReleaseLock frees the lease if args.Owner still holds it with args.Token.
+func (r *Registry) ReleaseLock(args *common.ReleaseLockArgs, reply *common.ReleaseLockReply) error {
+	if args == nil || args.Name == "" || args.Owner == "" {
+		return errors.New("invalid lock args")
+	}
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	l := r.locks[args.Name]
+	if !l.heldAt(now) || l.holder != args.Owner || l.token != args.Token {
+		return nil
+	}
+	// il prossimo owner riceverà un token maggiore da r.lockToken
+	l.holder, l.value, l.expires = "", "", time.Time{}
+	l.notify()
+	r.pruneLockLocked(args.Name, l, now)
+	reply.OK = true
+	return nil
+}
+
+// WatchLock is a long poll on the holding of a lease. Expiry is lazy, so besides
+// waiting for an explicit change it wakes up when the current lease runs out.
+func (r *Registry) WatchLock(args *common.WatchLockArgs, reply *common.WatchLockReply) error {
+	if args == nil || args.Name == "" {
+		return errors.New("invalid lock args")
+	}
+	deadline := time.Now().Add(watchWait(args.Timeout))
+	for {
+		now := time.Now()
+		r.mu.Lock()
+		l := r.lockLocked(args.Name, now)
+		*reply = common.WatchLockReply{}
+		if l.heldAt(now) {
+			reply.Held = true
+			reply.Holder, reply.Value, reply.Token, reply.TTL = l.holder, l.value, l.token, l.expires.Sub(now)
+		}
+		wake := deadline
+		if reply.Held && l.expires.Before(wake) {
+			wake = l.expires
+		}
+		changed := l.changed
+		done := reply.Holder != args.Holder || reply.Token != args.Token || !now.Before(deadline)
+		if done {
+			r.pruneLockLocked(args.Name, l, now)
+		} else {
+			l.waiters++
+		}
+		r.mu.Unlock()
+
+		if done {
+			reply.Changed = reply.Holder != args.Holder || reply.Token != args.Token
+			return nil
+		}
+		timer := time.NewTimer(wake.Sub(now))
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+
+		r.mu.Lock()
+		l.waiters--
+		r.pruneLockLocked(args.Name, l, time.Now())
+		r.mu.Unlock()
+	}
+}
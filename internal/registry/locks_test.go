@@ -0,0 +1,159 @@
+package registry
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"example.com/service-registry-lb/common"
+)
+
+func acquire(t *testing.T, r *Registry, name, owner string, minToken int64) common.AcquireLockReply {
+	t.Helper()
+	var rep common.AcquireLockReply
+	if err := r.AcquireLock(&common.AcquireLockArgs{Name: name, Owner: owner, TTL: time.Minute, MinToken: minToken}, &rep); err != nil {
+		t.Fatal(err)
+	}
+	return rep
+}
+
+func release(t *testing.T, r *Registry, name, owner string, token int64) bool {
+	t.Helper()
+	var rep common.ReleaseLockReply
+	if err := r.ReleaseLock(&common.ReleaseLockArgs{Name: name, Owner: owner, Token: token}, &rep); err != nil {
+		t.Fatal(err)
+	}
+	return rep.OK
+}
+
+func TestLockFencingTokens(t *testing.T) {
+	r := New()
+	var last int64
+	steps := []struct {
+		name     string
+		do       func() common.AcquireLockReply
+		acquired bool
+		newToken bool // token maggiore del precedente
+	}{
+		{"first owner", func() common.AcquireLockReply { return acquire(t, r, "job", "a", 0) }, true, true},
+		{"renew by acquire keeps token", func() common.AcquireLockReply { return acquire(t, r, "job", "a", 0) }, true, false},
+		{"other owner refused", func() common.AcquireLockReply { return acquire(t, r, "job", "b", 0) }, false, false},
+		{"after release new token", func() common.AcquireLockReply {
+			if !release(t, r, "job", "a", last) {
+				t.Fatal("release refused")
+			}
+			return acquire(t, r, "job", "b", 0)
+		}, true, true},
+		{"min token above current", func() common.AcquireLockReply { return acquire(t, r, "job", "b", last+10) }, true, true},
+		{"other lock continues the sequence", func() common.AcquireLockReply { return acquire(t, r, "other", "c", 0) }, true, true},
+	}
+	for _, st := range steps {
+		rep := st.do()
+		if rep.Acquired != st.acquired {
+			t.Fatalf("%s: acquired=%v, want %v", st.name, rep.Acquired, st.acquired)
+		}
+		if !rep.Acquired {
+			if rep.Token != last {
+				t.Fatalf("%s: reported token %d, want holder's %d", st.name, rep.Token, last)
+			}
+			continue
+		}
+		if st.newToken && rep.Token <= last || !st.newToken && rep.Token != last {
+			t.Fatalf("%s: token %d after %d (new token: %v)", st.name, rep.Token, last, st.newToken)
+		}
+		last = rep.Token
+	}
+}
+
+func TestRenewAndReleaseCheckToken(t *testing.T) {
+	r := New()
+	tok := acquire(t, r, "job", "a", 0).Token
+
+	var renew common.RenewLockReply
+	if err := r.RenewLock(&common.RenewLockArgs{Name: "job", Owner: "a", Token: tok + 1}, &renew); err != nil || renew.OK {
+		t.Fatalf("renew with a wrong token: ok=%v err=%v", renew.OK, err)
+	}
+	if release(t, r, "job", "a", tok+1) {
+		t.Fatal("release with a wrong token succeeded")
+	}
+	if release(t, r, "job", "b", tok) {
+		t.Fatal("release by another owner succeeded")
+	}
+	if !release(t, r, "job", "a", tok) {
+		t.Fatal("release by the holder refused")
+	}
+}
+
+func TestReleasedLockIsPruned(t *testing.T) {
+	r := New()
+	tok := acquire(t, r, "job", "a", 0).Token
+	release(t, r, "job", "a", tok)
+	if _, ok := r.locks["job"]; ok {
+		t.Fatal("released lock still in the map")
+	}
+	// eliminato il lock, il token non riparte
+	if next := acquire(t, r, "job", "b", 0).Token; next <= tok {
+		t.Fatalf("token %d after pruning, want > %d", next, tok)
+	}
+}
+
+func TestWatchedLockIsKeptUntilWatcherLeaves(t *testing.T) {
+	r := New()
+	tok := acquire(t, r, "job", "a", 0).Token
+
+	done := make(chan common.WatchLockReply)
+	go func() {
+		var rep common.WatchLockReply
+		_ = r.WatchLock(&common.WatchLockArgs{Name: "job", Holder: "a", Token: tok, Timeout: 5 * time.Second}, &rep)
+		done <- rep
+	}()
+	waitFor(t, func() bool {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		return r.locks["job"] != nil && r.locks["job"].waiters == 1
+	})
+
+	release(t, r, "job", "a", tok)
+	rep := <-done
+	if !rep.Changed || rep.Held {
+		t.Fatalf("watch after release: %+v", rep)
+	}
+	if _, ok := r.locks["job"]; ok {
+		t.Fatal("lock still in the map after the watcher left")
+	}
+
+	// watch su un lock mai esistito: non resta nella mappa
+	var wrep common.WatchLockReply
+	if err := r.WatchLock(&common.WatchLockArgs{Name: "ghost", Timeout: time.Millisecond}, &wrep); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.locks["ghost"]; ok {
+		t.Fatal("watched free lock left in the map")
+	}
+}
+
+func TestExpiredLocksAreSwept(t *testing.T) {
+	r := New()
+	for i := 0; i < minLockSweep; i++ {
+		var rep common.AcquireLockReply
+		if err := r.AcquireLock(&common.AcquireLockArgs{Name: fmt.Sprintf("l%d", i), Owner: "a", TTL: minLockTTL}, &rep); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(minLockTTL + 50*time.Millisecond)
+	acquire(t, r, "new", "a", 0)
+	if n := len(r.locks); n != 1 {
+		t.Fatalf("%d locks after the sweep, want 1", n)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
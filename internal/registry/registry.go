@@ -2,20 +2,42 @@ package registry
 
 import (
 	"errors"
+	"maps"
 	"sort"
 	"sync"
+	"time"
 
 	"example.com/service-registry-lb/common"
 )
 
 type Registry struct {
-	mu       sync.RWMutex
-	services map[string]map[string]common.Instance // service -> id -> instance
+	mu          sync.RWMutex
+	services    map[string]map[string]common.Instance // service -> id -> instance
+	shardMaps   map[string]common.ShardMap            // service -> shard map
+	locks       map[string]*lease                     // name -> lease
+	semaphores  map[string]*semaphore                 // name -> semaphore
+	lockToken   int64                                 // ultimo fencing token dato (unico per tutte le lease)
+	lockSweepAt int                                   // dimensione di locks che fa partire la pulizia
+	config      *configStore
+	states      map[string]*instanceState // "service/id" -> registrazione, heartbeat, versione
+	healthTTL   time.Duration
+
+	rev       int64            // contatore globale delle modifiche alle istanze
+	revisions map[string]int64 // service -> revisione dell'ultima modifica (resta dopo l'ultima Deregister)
+	changed   chan struct{}    // chiuso (e sostituito) ad ogni modifica, per WatchService
 }
 
 func New() *Registry {
 	return &Registry{
-		services: make(map[string]map[string]common.Instance),
+		services:   make(map[string]map[string]common.Instance),
+		shardMaps:  make(map[string]common.ShardMap),
+		locks:      make(map[string]*lease),
+		semaphores: make(map[string]*semaphore),
+		config:     newConfigStore(),
+		states:     make(map[string]*instanceState),
+		healthTTL:  DefaultHealthTTL,
+		revisions:  make(map[string]int64),
+		changed:    make(chan struct{}),
 	}
 }
 
@@ -32,7 +54,19 @@ func (r *Registry) Register(args *common.RegisterArgs, reply *common.RegisterRep
 		m = make(map[string]common.Instance)
 		r.services[args.Service] = m
 	}
-	m[args.Instance.ID] = args.Instance
+	old, existed := m[args.Instance.ID]
+	inst := args.Instance
+	if existed && inst.Load.ReportedAt.IsZero() {
+		inst.Load = old.Load
+	}
+	m[args.Instance.ID] = inst
+	st := r.stateLocked(args.Service, args.Instance.ID, existed)
+	st.lastSeen = time.Now()
+	// una ri-registrazione identica non sveglia i watcher
+	if !existed || !sameInstance(old, inst) {
+		st.version++
+		r.bumpLocked(args.Service)
+	}
 	reply.OK = true
 	return nil
 }
@@ -46,7 +80,11 @@ func (r *Registry) Deregister(args *common.DeregisterArgs, reply *common.Deregis
 	defer r.mu.Unlock()
 
 	if m, ok := r.services[args.Service]; ok {
-		delete(m, args.ID)
+		if _, existed := m[args.ID]; existed {
+			delete(m, args.ID)
+			delete(r.states, args.Service+"/"+args.ID)
+			r.bumpLocked(args.Service)
+		}
 		if len(m) == 0 {
 			delete(r.services, args.Service)
 		}
@@ -63,12 +101,54 @@ func (r *Registry) Lookup(args *common.LookupArgs, reply *common.LookupReply) er
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
-	m, ok := r.services[args.Service]
-	if !ok || len(m) == 0 {
-		reply.Instances = nil
-		return nil
+	reply.Instances = r.instancesLocked(args.Service)
+	reply.Revision = r.revisions[args.Service]
+	return nil
+}
+
+// WatchService waits for a change of the instances of a service, like ConfigWatch does for keys.
+func (r *Registry) WatchService(args *common.WatchServiceArgs, reply *common.WatchServiceReply) error {
+	if args == nil || args.Service == "" {
+		return errors.New("invalid watch service args")
 	}
+	timer := time.NewTimer(watchWait(args.Timeout))
+	defer timer.Stop()
+	for {
+		r.mu.RLock()
+		rev := r.revisions[args.Service]
+		// AfterRevision oltre il contatore: il registry è ripartito, lo stato del client è vecchio
+		restarted := args.AfterRevision > r.rev
+		insts := r.instancesLocked(args.Service)
+		changed := r.changed
+		r.mu.RUnlock()
 
+		reply.Revision = rev
+		if rev > args.AfterRevision || restarted {
+			reply.Changed = true
+			reply.Instances = insts
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+func (r *Registry) bumpLocked(service string) {
+	r.rev++
+	r.revisions[service] = r.rev
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// instancesLocked returns the instances of service sorted by id. Caller holds r.mu.
+func (r *Registry) instancesLocked(service string) []common.Instance {
+	m := r.services[service]
+	if len(m) == 0 {
+		return nil
+	}
 	out := make([]common.Instance, 0, len(m))
 	for _, inst := range m {
 		out = append(out, inst)
@@ -81,7 +161,9 @@ func (r *Registry) Lookup(args *common.LookupArgs, reply *common.LookupReply) er
 		}
 		return out[i].ID < out[j].ID
 	})
+	return out
+}
 
-	reply.Instances = out
-	return nil
+func sameInstance(a, b common.Instance) bool {
+	return a.Addr == b.Addr && a.Weight == b.Weight && maps.Equal(a.Meta, b.Meta)
 }
@@ -0,0 +1,115 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"example.com/service-registry-lb/common"
+)
+
+// semaphore is a counting lock: up to limit owners, each with its own lease.
+type semaphore struct {
+	limit   int
+	owners  []string             // in ordine di acquisizione
+	expires map[string]time.Time // owner -> scadenza del posto
+}
+
+// purge drops the expired slots.
+func (s *semaphore) purge(now time.Time) {
+	live := s.owners[:0]
+	for _, o := range s.owners {
+		if now.Before(s.expires[o]) {
+			live = append(live, o)
+		} else {
+			delete(s.expires, o)
+		}
+	}
+	s.owners = live
+}
+
+// AcquireSemaphore grants a slot to args.Owner if fewer than Limit live owners hold one.
+func (r *Registry) AcquireSemaphore(args *common.AcquireSemaphoreArgs, reply *common.AcquireSemaphoreReply) error {
+	if args == nil || args.Name == "" || args.Owner == "" || args.Limit <= 0 {
+		return errors.New("invalid semaphore args")
+	}
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.semaphores[args.Name]
+	if ok {
+		s.purge(now)
+	}
+	if !ok || len(s.owners) == 0 {
+		// senza posti occupati il limite può essere ridefinito
+		s = &semaphore{limit: args.Limit, expires: make(map[string]time.Time)}
+		r.semaphores[args.Name] = s
+	}
+	if s.limit != args.Limit {
+		return fmt.Errorf("semaphore %q has limit %d, not %d", args.Name, s.limit, args.Limit)
+	}
+	_, held := s.expires[args.Owner]
+	if !held && len(s.owners) < s.limit {
+		s.owners = append(s.owners, args.Owner)
+		held = true
+	}
+	if held {
+		s.expires[args.Owner] = now.Add(lockTTL(args.TTL))
+	}
+	reply.Acquired = held
+	reply.Limit = s.limit
+	reply.Holders = append([]string(nil), s.owners...)
+	return nil
+}
+
+// RenewSemaphore extends a slot still held by args.Owner.
+func (r *Registry) RenewSemaphore(args *common.SemaphoreArgs, reply *common.SemaphoreReply) error {
+	if args == nil || args.Name == "" || args.Owner == "" {
+		return errors.New("invalid semaphore args")
+	}
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.semaphores[args.Name]
+	if !ok {
+		return nil
+	}
+	s.purge(now)
+	if _, held := s.expires[args.Owner]; held {
+		s.expires[args.Owner] = now.Add(lockTTL(args.TTL))
+		reply.OK = true
+	}
+	return nil
+}
+
+// ReleaseSemaphore frees the slot of args.Owner.
+func (r *Registry) ReleaseSemaphore(args *common.SemaphoreArgs, reply *common.SemaphoreReply) error {
+	if args == nil || args.Name == "" || args.Owner == "" {
+		return errors.New("invalid semaphore args")
+	}
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.semaphores[args.Name]
+	if !ok {
+		return nil
+	}
+	s.purge(now)
+	if _, held := s.expires[args.Owner]; held {
+		delete(s.expires, args.Owner)
+		for i, o := range s.owners {
+			if o == args.Owner {
+				s.owners = append(s.owners[:i], s.owners[i+1:]...)
+				break
+			}
+		}
+		reply.OK = true
+	}
+	if len(s.owners) == 0 {
+		delete(r.semaphores, args.Name)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package registry
+
+import (
+	"errors"
+
+	"example.com/service-registry-lb/common"
+)
+
+// GetShardMap returns the shard map stored for a service, if any.
+func (r *Registry) GetShardMap(args *common.GetShardMapArgs, reply *common.GetShardMapReply) error {
+	if args == nil || args.Service == "" {
+		return errors.New("invalid shard map args")
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	m, ok := r.shardMaps[args.Service]
+	reply.Found = ok
+	reply.Map = copyShardMap(m)
+	return nil
+}
+
+// SetShardMap is a compare-and-swap on the shard map version, so concurrent
+// rebalancing operations cannot overwrite each other.
+func (r *Registry) SetShardMap(args *common.SetShardMapArgs, reply *common.SetShardMapReply) error {
+	if args == nil || args.Service == "" || len(args.Groups) == 0 {
+		return errors.New("invalid shard map args")
+	}
+	for _, g := range args.Groups {
+		if g == "" {
+			return errors.New("invalid shard map: empty group")
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cur := r.shardMaps[args.Service]
+	if cur.Version != args.ExpectedVersion {
+		reply.OK = false
+		reply.Map = copyShardMap(cur)
+		return nil
+	}
+	if len(cur.Groups) != 0 && len(cur.Groups) != len(args.Groups) {
+		// il numero di shard è fisso: cambiarlo rimappa tutte le chiavi
+		return errors.New("shard count cannot change")
+	}
+	next := common.ShardMap{Version: cur.Version + 1, Groups: append([]string(nil), args.Groups...)}
+	r.shardMaps[args.Service] = next
+	reply.OK = true
+	reply.Map = copyShardMap(next)
+	return nil
+}
+
+// PublishShardMap stores a map known by a kv instance if it is newer than the
+// stored one. The shard count is not checked: a newer version wins even over a
+// map recreated with a different count while the real one was missing.
+func (r *Registry) PublishShardMap(args *common.PublishShardMapArgs, reply *common.PublishShardMapReply) error {
+	if args == nil || args.Service == "" || args.Map.Version <= 0 || len(args.Map.Groups) == 0 {
+		return errors.New("invalid shard map args")
+	}
+	for _, g := range args.Map.Groups {
+		if g == "" {
+			return errors.New("invalid shard map: empty group")
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cur := r.shardMaps[args.Service]
+	if args.Map.Version <= cur.Version {
+		reply.OK = false
+		reply.Map = copyShardMap(cur)
+		return nil
+	}
+	r.shardMaps[args.Service] = copyShardMap(args.Map)
+	reply.OK = true
+	reply.Map = copyShardMap(args.Map)
+	return nil
+}
+
+func copyShardMap(m common.ShardMap) common.ShardMap {
+	m.Groups = append([]string(nil), m.Groups...)
+	return m
+}
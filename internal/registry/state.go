@@ -0,0 +1,148 @@
+package registry
+
+import (
+	"errors"
+	"maps"
+	"time"
+
+	"example.com/service-registry-lb/common"
+)
+
+// Dump returns a copy of instances, shard maps and config entries.
+func (r *Registry) Dump(args *common.DumpArgs, reply *common.DumpReply) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	st := common.RegistryState{
+		Services:  make(map[string][]common.Instance, len(r.services)),
+		ShardMaps: make(map[string]common.ShardMap, len(r.shardMaps)),
+	}
+	for name := range r.services {
+		insts := r.instancesLocked(name)
+		for i := range insts {
+			insts[i].Meta = maps.Clone(insts[i].Meta)
+		}
+		st.Services[name] = insts
+	}
+	for name, m := range r.shardMaps {
+		st.ShardMaps[name] = copyShardMap(m)
+	}
+	st.Config, _ = r.config.list("")
+	reply.State = st
+	reply.TakenAt = time.Now()
+	return nil
+}
+
+// Restore loads a state saved by Dump. Versions only move forward: a restored
+// shard map or config entry gets a version above the current one, so clients
+// doing compare-and-swap notice the change.
+func (r *Registry) Restore(args *common.RestoreArgs, reply *common.RestoreReply) error {
+	if args == nil {
+		return errors.New("invalid restore args")
+	}
+	st := args.State
+	for name, insts := range st.Services {
+		for _, inst := range insts {
+			if name == "" || inst.ID == "" || inst.Addr == "" {
+				return errors.New("invalid restore state: instance without service, id or addr")
+			}
+		}
+	}
+	for name, m := range st.ShardMaps {
+		for _, g := range m.Groups {
+			if name == "" || g == "" {
+				return errors.New("invalid restore state: empty shard map service or group")
+			}
+		}
+	}
+	for _, e := range st.Config {
+		if err := validConfigKey(e.Key); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// istanze
+	if args.Replace {
+		for name, m := range r.services {
+			for id := range m {
+				if !containsInstance(st.Services[name], id) {
+					delete(m, id)
+					delete(r.states, name+"/"+id)
+				}
+			}
+			if len(m) == 0 {
+				delete(r.services, name)
+			}
+			r.bumpLocked(name)
+		}
+	}
+	for name, insts := range st.Services {
+		m, ok := r.services[name]
+		if !ok {
+			m = make(map[string]common.Instance)
+			r.services[name] = m
+		}
+		for _, inst := range insts {
+			inst.Meta = maps.Clone(inst.Meta)
+			old, existed := m[inst.ID]
+			m[inst.ID] = inst
+			// mai visto da questo registry: lastSeen resta zero, healthy solo dopo il prossimo heartbeat
+			is := r.stateLocked(name, inst.ID, existed)
+			if !existed || !sameInstance(old, inst) {
+				is.version++
+			}
+			reply.Instances++
+		}
+		r.bumpLocked(name)
+	}
+
+	// shard map
+	if args.Replace {
+		for name := range r.shardMaps {
+			if _, ok := st.ShardMaps[name]; !ok {
+				delete(r.shardMaps, name)
+			}
+		}
+	}
+	for name, m := range st.ShardMaps {
+		next := copyShardMap(m)
+		next.Version = max(m.Version, r.shardMaps[name].Version+1)
+		r.shardMaps[name] = next
+		reply.ShardMaps++
+	}
+
+	// config
+	c := r.config
+	if args.Replace {
+		keep := make(map[string]bool, len(st.Config))
+		for _, e := range st.Config {
+			keep[e.Key] = true
+		}
+		for k := range c.entries {
+			if !keep[k] {
+				delete(c.entries, k)
+				c.tombstone(k)
+			}
+		}
+	}
+	for _, e := range st.Config {
+		cur := c.entries[e.Key]
+		c.entries[e.Key] = common.ConfigEntry{Key: e.Key, Value: e.Value,
+			Version: max(e.Version, cur.Version+1), Revision: c.bump()}
+		delete(c.deleted, e.Key)
+		reply.Config++
+	}
+	return nil
+}
+
+func containsInstance(insts []common.Instance, id string) bool {
+	for _, inst := range insts {
+		if inst.ID == id {
+			return true
+		}
+	}
+	return false
+}
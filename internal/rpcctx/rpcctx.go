@@ -0,0 +1,404 @@
+// Package rpcctx adds deadlines to net/rpc.
+//
+// Call bounds a call with a context (a per-method default timeout applies when
+// the context has no deadline), so a hung server no longer blocks the caller
+// forever. Connections opened with Dial also carry request metadata: every
+// request is followed on the wire by a small header with the caller's
+// deadline, which the server side (Handle) rejects if already expired and
+// exposes to the handler through Deadline/Context(args).
+//
+// Servers without the metadata path are still reachable: Dial falls back to a
+// plain net/rpc connection and only the client-side deadline applies.
+package rpcctx
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Path is the HTTP CONNECT path of the net/rpc protocol with metadata.
+const Path = "/_goRPC_ctx_"
+
+const (
+	// DefaultTimeout bounds calls of methods without a specific timeout.
+	DefaultTimeout = 5 * time.Second
+	// longPoll covers the longest wait a server grants to a long-poll (2m).
+	longPoll = 2*time.Minute + 10*time.Second
+	bulk     = 30 * time.Second
+)
+
+// methodTimeouts are the defaults that differ from DefaultTimeout.
+var methodTimeouts = map[string]time.Duration{
+	"Registry.WatchLock":    longPoll,
+	"Registry.ConfigWatch":  longPoll,
+	"Registry.WatchService": longPoll,
+	"KV.Watch":              longPoll,
+	"KV.Snapshot":           bulk,
+	"KV.ExportShard":        bulk,
+	"KV.ImportShard":        bulk,
+}
+
+// Timeout returns the default timeout of method.
+func Timeout(method string) time.Duration {
+	if d, ok := methodTimeouts[method]; ok {
+		return d
+	}
+	return DefaultTimeout
+}
+
+// requestMeta is sent after every request header on Path connections.
+type requestMeta struct {
+	Deadline time.Time // zero = nessuna scadenza
+}
+
+// -------- client --------
+
+// withMeta carries the metadata of a call to the client codec, which sends
+// meta and args as two separate values.
+type withMeta struct {
+	meta requestMeta
+	args any
+}
+
+var (
+	metaClients sync.Map // *rpc.Client -> struct{}: connessioni aperte su Path
+	plainAddrs  sync.Map // addr -> struct{}: server senza Path, non ritento
+)
+
+// Dial connects to the net/rpc server at addr, with request metadata if the
+// server supports it; connecting is bounded by DefaultTimeout.
+func Dial(addr string) (*rpc.Client, error) {
+	return DialContext(context.Background(), addr)
+}
+
+// DialContext is Dial bounded by ctx (or by DefaultTimeout if ctx has no deadline):
+// a server that accepts the TCP connection but never answers cannot block it.
+func DialContext(ctx context.Context, addr string) (*rpc.Client, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultTimeout)
+		defer cancel()
+	}
+	path := Path
+	if _, plain := plainAddrs.Load(addr); plain {
+		path = rpc.DefaultRPCPath
+	}
+	conn, err := connect(ctx, addr, path)
+	if errors.Is(err, errNoPath) {
+		// server senza metadati (es. vecchia versione): net/rpc standard
+		plainAddrs.Store(addr, struct{}{})
+		path = rpc.DefaultRPCPath
+		conn, err = connect(ctx, addr, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if path == rpc.DefaultRPCPath {
+		return rpc.NewClient(conn), nil
+	}
+	cc := &clientCodec{rwc: conn, dec: gob.NewDecoder(conn)}
+	cc.encBuf = bufio.NewWriter(conn)
+	cc.enc = gob.NewEncoder(cc.encBuf)
+	c := rpc.NewClientWithCodec(cc)
+	cc.client.Store(c)
+	metaClients.Store(c, struct{}{})
+	if cc.broken.Load() {
+		// la connessione è già caduta prima che registrassi il client
+		metaClients.Delete(c)
+	}
+	return c, nil
+}
+
+var errNoPath = errors.New("rpc path not served")
+
+// connect opens the TCP connection and performs the HTTP CONNECT handshake on path.
+func connect(ctx context.Context, addr, path string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	dl, _ := ctx.Deadline()
+	_ = conn.SetDeadline(dl)
+	_, _ = io.WriteString(conn, "CONNECT "+path+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("rpc CONNECT %s: %w", addr, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, errNoPath
+		}
+		return nil, fmt.Errorf("rpc CONNECT %s: unexpected HTTP response %s", addr, resp.Status)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// Call invokes method on c and waits for the reply until ctx ends; without a
+// deadline in ctx, Timeout(method) applies. On expiry the call is abandoned
+// (net/rpc cannot cancel it): callers should drop the connection.
+func Call(ctx context.Context, c *rpc.Client, method string, args, reply any) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, Timeout(method))
+		defer cancel()
+	}
+	send := args
+	if _, ok := metaClients.Load(c); ok {
+		dl, _ := ctx.Deadline()
+		send = &withMeta{meta: requestMeta{Deadline: dl}, args: args}
+	}
+	call := c.Go(method, send, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return fmt.Errorf("%s: %w", method, ctx.Err())
+	}
+}
+
+// Client is an *rpc.Client whose Call goes through Call with the default timeouts.
+type Client struct {
+	*rpc.Client
+}
+
+func (c *Client) Call(method string, args, reply any) error {
+	return Call(context.Background(), c.Client, method, args, reply)
+}
+
+func (c *Client) CallContext(ctx context.Context, method string, args, reply any) error {
+	return Call(ctx, c.Client, method, args, reply)
+}
+
+// clientCodec is net/rpc's gob client codec plus the metadata value.
+type clientCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+
+	// client is set by DialContext once the rpc.Client exists; broken records a
+	// failure seen before that, so the metaClients entry is never left behind.
+	client atomic.Pointer[rpc.Client]
+	broken atomic.Bool
+}
+
+// forget removes the client from metaClients: net/rpc never calls Close on a
+// connection that failed, only on one the caller closes.
+func (c *clientCodec) forget() {
+	c.broken.Store(true)
+	if cl := c.client.Load(); cl != nil {
+		metaClients.Delete(cl)
+	}
+}
+
+func (c *clientCodec) WriteRequest(r *rpc.Request, body any) (err error) {
+	var meta requestMeta
+	if wm, ok := body.(*withMeta); ok {
+		meta, body = wm.meta, wm.args
+	}
+	if err = c.enc.Encode(r); err != nil {
+		return
+	}
+	if err = c.enc.Encode(&meta); err != nil {
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *clientCodec) ReadResponseHeader(r *rpc.Response) error {
+	// un errore qui chiude il client (connessione caduta o stream corrotto)
+	err := c.dec.Decode(r)
+	if err != nil {
+		c.forget()
+	}
+	return err
+}
+
+func (c *clientCodec) ReadResponseBody(body any) error {
+	return c.dec.Decode(body)
+}
+
+func (c *clientCodec) Close() error {
+	c.forget()
+	return c.rwc.Close()
+}
+
+// -------- server --------
+
+var deadlines sync.Map // args (puntatore) -> time.Time, finché la chiamata è in corso
+
+// Deadline returns the deadline the caller sent with the request whose
+// arguments are args (the pointer received by the handler).
+func Deadline(args any) (time.Time, bool) {
+	v, ok := deadlines.Load(args)
+	if !ok {
+		return time.Time{}, false
+	}
+	return v.(time.Time), true
+}
+
+// Context returns a context that ends at the caller's deadline of the request
+// with arguments args, or a plain cancellable context if it has none.
+func Context(args any) (context.Context, context.CancelFunc) {
+	if dl, ok := Deadline(args); ok {
+		return context.WithDeadline(context.Background(), dl)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// ErrExpired is returned (as the call's error) for requests whose deadline had
+// already passed when the server read them.
+var ErrExpired = errors.New("rpcctx: deadline exceeded before the call started")
+
+// NewServerCodec is net/rpc's gob server codec; with meta it reads the
+// metadata sent by Dial's clients after every request header.
+func NewServerCodec(conn io.ReadWriteCloser, meta bool) rpc.ServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &serverCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+		meta:   meta,
+		bound:  make(map[uint64]any),
+	}
+}
+
+type serverCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	meta   bool
+	closed bool
+
+	// header e body sono letti in sequenza dallo stesso goroutine del server
+	seq      uint64
+	deadline time.Time
+
+	mu    sync.Mutex
+	bound map[uint64]any // seq -> args con scadenza registrata in deadlines
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+	c.seq, c.deadline = r.Seq, time.Time{}
+	if c.meta {
+		var m requestMeta
+		if err := c.dec.Decode(&m); err != nil {
+			return err
+		}
+		c.deadline = m.Deadline
+	}
+	return nil
+}
+
+func (c *serverCodec) ReadRequestBody(body any) error {
+	if err := c.dec.Decode(body); err != nil {
+		return err
+	}
+	if body == nil || c.deadline.IsZero() {
+		return nil
+	}
+	// il body è già letto: l'errore diventa la risposta e il metodo non viene chiamato
+	if !time.Now().Before(c.deadline) {
+		return ErrExpired
+	}
+	deadlines.Store(body, c.deadline)
+	c.mu.Lock()
+	c.bound[c.seq] = body
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *serverCodec) unbind(seq uint64) {
+	c.mu.Lock()
+	args, ok := c.bound[seq]
+	delete(c.bound, seq)
+	c.mu.Unlock()
+	if ok {
+		deadlines.Delete(args)
+	}
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, body any) (err error) {
+	c.unbind(r.Seq)
+	if err = c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			log.Println("rpc: gob error encoding response:", err)
+			_ = c.Close()
+		}
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			log.Println("rpc: gob error encoding body:", err)
+			_ = c.Close()
+		}
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *serverCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.mu.Lock()
+	for _, args := range c.bound {
+		deadlines.Delete(args)
+	}
+	c.bound = make(map[uint64]any)
+	c.mu.Unlock()
+	return c.rwc.Close()
+}
+
+// Handle serves srv on mux at rpc.DefaultRPCPath (plain net/rpc) and at Path
+// (with metadata). wrap, if not nil, decorates every connection's codec.
+func Handle(mux *http.ServeMux, srv *rpc.Server, wrap func(rpc.ServerCodec) rpc.ServerCodec) {
+	mux.Handle(rpc.DefaultRPCPath, handler(srv, false, wrap))
+	mux.Handle(Path, handler(srv, true, wrap))
+}
+
+func handler(srv *rpc.Server, meta bool, wrap func(rpc.ServerCodec) rpc.ServerCodec) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "CONNECT" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			_, _ = io.WriteString(w, "405 must CONNECT\n")
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			log.Printf("rpc hijacking %s: %v", req.RemoteAddr, err)
+			return
+		}
+		_, _ = io.WriteString(conn, "HTTP/1.0 200 Connected to Go RPC\n\n")
+		codec := NewServerCodec(conn, meta)
+		if wrap != nil {
+			codec = wrap(codec)
+		}
+		srv.ServeCodec(codec)
+	})
+}
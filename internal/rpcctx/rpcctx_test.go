@@ -0,0 +1,181 @@
+package rpcctx
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type Args struct{ N int }
+
+// T reports the deadline the server saw for each call.
+type T struct{ calls atomic.Int32 }
+
+func (t *T) Deadline(args *Args, reply *time.Time) error {
+	t.calls.Add(1)
+	*reply, _ = Deadline(args)
+	return nil
+}
+
+// newServer serves T with Handle, or with plain net/rpc only when plain is
+// set; it returns the address and the codecs of the accepted connections.
+func newServer(t *testing.T, plain bool) (*T, string, func() []rpc.ServerCodec) {
+	t.Helper()
+	svc := &T{}
+	srv := rpc.NewServer()
+	if err := srv.Register(svc); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu     sync.Mutex
+		codecs []rpc.ServerCodec
+	)
+	mux := http.NewServeMux()
+	if plain {
+		mux.Handle(rpc.DefaultRPCPath, srv)
+	} else {
+		Handle(mux, srv, func(c rpc.ServerCodec) rpc.ServerCodec {
+			mu.Lock()
+			defer mu.Unlock()
+			codecs = append(codecs, c)
+			return c
+		})
+	}
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+	return svc, ts.Listener.Addr().String(), func() []rpc.ServerCodec {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]rpc.ServerCodec(nil), codecs...)
+	}
+}
+
+func dial(t *testing.T, addr string) *rpc.Client {
+	t.Helper()
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func isMeta(c *rpc.Client) bool {
+	_, ok := metaClients.Load(c)
+	return ok
+}
+
+func TestDeadlinePropagation(t *testing.T) {
+	_, addr, _ := newServer(t, false)
+	c := dial(t, addr)
+	if !isMeta(c) {
+		t.Fatal("client not on the metadata path")
+	}
+	dl := time.Now().Add(3 * time.Second)
+
+	tests := []struct {
+		name      string
+		ctx       func() (context.Context, context.CancelFunc)
+		want      time.Time
+		tolerance time.Duration
+	}{
+		{"caller deadline", func() (context.Context, context.CancelFunc) {
+			return context.WithDeadline(context.Background(), dl)
+		}, dl, 0},
+		{"default timeout", func() (context.Context, context.CancelFunc) {
+			return context.WithCancel(context.Background())
+		}, time.Now().Add(DefaultTimeout), time.Second},
+	}
+	for _, tt := range tests {
+		ctx, cancel := tt.ctx()
+		var got time.Time
+		err := Call(ctx, c, "T.Deadline", &Args{}, &got)
+		cancel()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if d := got.Sub(tt.want).Abs(); d > tt.tolerance {
+			t.Fatalf("%s: server saw deadline %v, want %v (±%v)", tt.name, got, tt.want, tt.tolerance)
+		}
+	}
+	// finita la chiamata la scadenza non resta registrata
+	n := 0
+	deadlines.Range(func(any, any) bool { n++; return true })
+	if n != 0 {
+		t.Fatalf("%d deadlines left after the calls", n)
+	}
+}
+
+func TestExpiredCallIsNotRun(t *testing.T) {
+	svc, addr, _ := newServer(t, false)
+	c := dial(t, addr)
+
+	// la scadenza è già passata quando il server legge la richiesta
+	send := &withMeta{meta: requestMeta{Deadline: time.Now().Add(-time.Second)}, args: &Args{}}
+	var got time.Time
+	err := c.Call("T.Deadline", send, &got)
+	var se rpc.ServerError
+	if !errors.As(err, &se) || string(se) != ErrExpired.Error() {
+		t.Fatalf("err = %v, want %v", err, ErrExpired)
+	}
+	if n := svc.calls.Load(); n != 0 {
+		t.Fatalf("handler ran %d times for an expired call", n)
+	}
+	// la connessione resta usabile
+	if err := Call(context.Background(), c, "T.Deadline", &Args{}, &got); err != nil || got.IsZero() {
+		t.Fatalf("call after an expired one: %v %v", got, err)
+	}
+}
+
+func TestFallbackToPlainServer(t *testing.T) {
+	_, addr, _ := newServer(t, true)
+	c := dial(t, addr)
+	if isMeta(c) {
+		t.Fatal("plain server got a metadata client")
+	}
+	if _, ok := plainAddrs.Load(addr); !ok {
+		t.Fatal("plain server not remembered")
+	}
+	// solo la scadenza lato client: il server non ne vede
+	var got time.Time
+	if err := Call(context.Background(), c, "T.Deadline", &Args{}, &got); err != nil || !got.IsZero() {
+		t.Fatalf("call on a plain server: %v %v", got, err)
+	}
+	// il secondo Dial va diretto sul path standard
+	if c2 := dial(t, addr); isMeta(c2) {
+		t.Fatal("second dial got a metadata client")
+	}
+}
+
+func TestClientForgottenWhenConnectionDies(t *testing.T) {
+	_, addr, codecs := newServer(t, false)
+	closed := dial(t, addr)
+	if err := closed.Close(); err != nil || isMeta(closed) {
+		t.Fatalf("Close: %v, still registered: %v", err, isMeta(closed))
+	}
+
+	c := dial(t, addr)
+	var got time.Time
+	if err := Call(context.Background(), c, "T.Deadline", &Args{}, &got); err != nil {
+		t.Fatal(err)
+	}
+	// la connessione cade lato server senza che il client chiami Close
+	cs := codecs()
+	_ = cs[len(cs)-1].(*serverCodec).rwc.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for isMeta(c) {
+		if time.Now().After(deadline) {
+			t.Fatal("client of a dead connection still in metaClients")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := Call(context.Background(), c, "T.Deadline", &Args{}, &got); !errors.Is(err, rpc.ErrShutdown) {
+		t.Fatalf("call on a dead connection: %v", err)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package servicekit
+
+import "time"
+
+// processCPU is not available here: the reported load has no CPU share.
+func processCPU() (time.Duration, bool) { return 0, false }
@@ -0,0 +1,56 @@
+package servicekit
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"example.com/service-registry-lb/common"
+)
+
+// loadSampler computes the load reported with the heartbeats, as averages over
+// the time since the previous sample.
+type loadSampler struct {
+	m     *metrics
+	queue func() int
+
+	mu    sync.Mutex
+	at    time.Time
+	cpu   time.Duration
+	calls int64
+	busy  time.Duration
+}
+
+func newLoadSampler(m *metrics) *loadSampler {
+	l := &loadSampler{m: m, at: time.Now()}
+	l.cpu, _ = processCPU()
+	l.calls, l.busy, _ = m.totals()
+	return l
+}
+
+func (l *loadSampler) sample() common.Load {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	cpu, cpuOK := processCPU()
+	calls, busy, inFlight := l.m.totals()
+	elapsed := now.Sub(l.at)
+
+	var load common.Load
+	if elapsed > 0 {
+		secs := elapsed.Seconds()
+		if cpuOK {
+			load.CPU = min((cpu-l.cpu).Seconds()/(secs*float64(runtime.NumCPU())), 1)
+		}
+		load.QPS = float64(calls-l.calls) / secs
+		// legge di Little: tempo di servizio accumulato / intervallo = concorrenza media
+		load.InFlight = (busy - l.busy).Seconds() / secs
+	}
+	// le chiamate ancora aperte non sono nel tempo accumulato
+	load.InFlight = max(load.InFlight, float64(inFlight))
+	if l.queue != nil {
+		load.Queue = l.queue()
+	}
+	l.at, l.cpu, l.calls, l.busy = now, cpu, calls, busy
+	return load
+}
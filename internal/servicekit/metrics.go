@@ -0,0 +1,202 @@
+package servicekit
+
+import (
+	"fmt"
+	"io"
+	"net/rpc"
+	"sort"
+	"sync"
+	"time"
+)
+
+// metrics counts the RPCs served by the instance, per method.
+// Long-poll methods (watch) are kept apart: a waiting watcher is neither load
+// nor a call to wait for at shutdown.
+type metrics struct {
+	mu       sync.Mutex
+	methods  map[string]*methodStats
+	longPoll map[string]bool
+	inFlight int
+	watching int
+	idle     chan struct{} // chiuso quando inFlight torna a 0 (per il drain)
+}
+
+type methodStats struct {
+	calls   int64
+	errors  int64
+	latency time.Duration
+}
+
+func newMetrics() *metrics {
+	return &metrics{methods: make(map[string]*methodStats), longPoll: make(map[string]bool)}
+}
+
+func (m *metrics) setLongPoll(methods ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, method := range methods {
+		m.longPoll[method] = true
+	}
+}
+
+func (m *metrics) begin(method string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.longPoll[method] {
+		m.watching++
+	} else {
+		m.inFlight++
+	}
+}
+
+// end settles a call begun with begin; answered is false when the connection
+// closed before the reply, so the call only leaves the in-flight count.
+func (m *metrics) end(method string, d time.Duration, failed, answered bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.longPoll[method] {
+		m.watching--
+		if !answered {
+			return
+		}
+	} else {
+		m.inFlight--
+		if m.inFlight == 0 && m.idle != nil {
+			close(m.idle)
+			m.idle = nil
+		}
+		if !answered {
+			return
+		}
+	}
+	st, ok := m.methods[method]
+	if !ok {
+		st = &methodStats{}
+		m.methods[method] = st
+	}
+	st.calls++
+	st.latency += d
+	if failed {
+		st.errors++
+	}
+}
+
+// totals returns the calls completed so far, their total latency and the calls
+// in flight, long-poll methods excluded (their latency is idle waiting).
+func (m *metrics) totals() (calls int64, busy time.Duration, inFlight int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for method, st := range m.methods {
+		if m.longPoll[method] {
+			continue
+		}
+		calls += st.calls
+		busy += st.latency
+	}
+	return calls, busy, m.inFlight
+}
+
+// waitIdle blocks until no RPC is in flight or timeout elapses.
+func (m *metrics) waitIdle(timeout time.Duration) bool {
+	m.mu.Lock()
+	if m.inFlight == 0 {
+		m.mu.Unlock()
+		return true
+	}
+	if m.idle == nil {
+		m.idle = make(chan struct{})
+	}
+	idle := m.idle
+	m.mu.Unlock()
+	select {
+	case <-idle:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// write prints the metrics in the Prometheus text format.
+func (m *metrics) write(w io.Writer, service, id string, uptime time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.methods))
+	for n := range m.methods {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "# service=%s id=%s\n", service, id)
+	for _, n := range names {
+		fmt.Fprintf(w, "rpc_requests_total{method=%q} %d\n", n, m.methods[n].calls)
+	}
+	for _, n := range names {
+		fmt.Fprintf(w, "rpc_errors_total{method=%q} %d\n", n, m.methods[n].errors)
+	}
+	for _, n := range names {
+		fmt.Fprintf(w, "rpc_latency_seconds_sum{method=%q} %.6f\n", n, m.methods[n].latency.Seconds())
+	}
+	fmt.Fprintf(w, "rpc_in_flight %d\n", m.inFlight)
+	fmt.Fprintf(w, "rpc_watching %d\n", m.watching)
+	fmt.Fprintf(w, "uptime_seconds %.0f\n", uptime.Seconds())
+}
+
+// wrap decorates the codec of an RPC connection so that it feeds the metrics.
+func (m *metrics) wrap(codec rpc.ServerCodec) rpc.ServerCodec {
+	return &countingCodec{inner: codec, m: m, pending: make(map[uint64]call)}
+}
+
+type call struct {
+	method string
+	start  time.Time
+}
+
+// countingCodec adds per-request accounting to a server codec.
+type countingCodec struct {
+	inner rpc.ServerCodec
+
+	m       *metrics
+	mu      sync.Mutex
+	pending map[uint64]call
+	closed  bool // risposte ancora in arrivo non raggiungono più il client
+}
+
+func (c *countingCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.inner.ReadRequestHeader(r); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.pending[r.Seq] = call{method: r.ServiceMethod, start: time.Now()}
+	c.mu.Unlock()
+	c.m.begin(r.ServiceMethod)
+	return nil
+}
+
+func (c *countingCodec) ReadRequestBody(body any) error {
+	return c.inner.ReadRequestBody(body)
+}
+
+func (c *countingCodec) WriteResponse(r *rpc.Response, body any) error {
+	c.mu.Lock()
+	cl, ok := c.pending[r.Seq]
+	delete(c.pending, r.Seq)
+	c.mu.Unlock()
+	if !ok {
+		return c.inner.WriteResponse(r, body)
+	}
+	// net/rpc chiude il codec appena la lettura fallisce, mentre gli handler
+	// sono ancora in corso: la chiamata finisce qui, non in Close
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	err := c.inner.WriteResponse(r, body)
+	c.m.end(cl.method, time.Since(cl.start), r.Error != "", !closed && err == nil)
+	return err
+}
+
+func (c *countingCodec) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return c.inner.Close()
+}
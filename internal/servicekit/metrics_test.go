@@ -0,0 +1,96 @@
+package servicekit
+
+import (
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"testing"
+	"time"
+)
+
+// Slow blocks every call until release is closed.
+type Slow struct{ release chan struct{} }
+
+func (s *Slow) Work(_ *int, reply *int) error  { <-s.release; *reply = 1; return nil }
+func (s *Slow) Watch(_ *int, reply *int) error { <-s.release; *reply = 1; return nil }
+
+func serve(t *testing.T, m *metrics, slow *Slow) *rpc.Client {
+	t.Helper()
+	srv := rpc.NewServer()
+	if err := srv.Register(slow); err != nil {
+		t.Fatal(err)
+	}
+	sc, cc := net.Pipe()
+	go srv.ServeCodec(m.wrap(jsonrpc.NewServerCodec(sc)))
+	return jsonrpc.NewClient(cc)
+}
+
+func (m *metrics) counts() (inFlight, watching int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.inFlight, m.watching
+}
+
+func waitCounts(t *testing.T, m *metrics, inFlight, watching int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		f, w := m.counts()
+		if f == inFlight && w == watching {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("in flight %d watching %d, want %d %d", f, w, inFlight, watching)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestLongPollNotInFlight(t *testing.T) {
+	m := newMetrics()
+	m.setLongPoll("Slow.Watch")
+	slow := &Slow{release: make(chan struct{})}
+	client := serve(t, m, slow)
+	defer client.Close()
+
+	var a, r1, r2 int
+	work := client.Go("Slow.Work", &a, &r1, nil)
+	watch := client.Go("Slow.Watch", &a, &r2, nil)
+	waitCounts(t, m, 1, 1)
+
+	close(slow.release)
+	<-work.Done
+	<-watch.Done
+	waitCounts(t, m, 0, 0)
+
+	calls, _, inFlight := m.totals()
+	if calls != 1 || inFlight != 0 {
+		t.Fatalf("totals: calls=%d inFlight=%d, want 1 0 (watch excluded)", calls, inFlight)
+	}
+	if m.methods["Slow.Watch"].calls != 1 {
+		t.Fatalf("watch calls = %d, want 1 in the per-method metrics", m.methods["Slow.Watch"].calls)
+	}
+}
+
+func TestClosedConnectionKeepsCallInFlight(t *testing.T) {
+	m := newMetrics()
+	slow := &Slow{release: make(chan struct{})}
+	client := serve(t, m, slow)
+
+	var a, r int
+	client.Go("Slow.Work", &a, &r, nil)
+	waitCounts(t, m, 1, 0)
+
+	// il client se ne va: l'handler è ancora in corso e il drain deve aspettarlo
+	client.Close()
+	if m.waitIdle(100 * time.Millisecond) {
+		t.Fatal("idle while the handler is still running")
+	}
+	close(slow.release)
+	if !m.waitIdle(2 * time.Second) {
+		t.Fatal("not idle after the handler returned")
+	}
+	if calls, _, _ := m.totals(); calls != 0 {
+		t.Fatalf("calls = %d, want 0 for an unanswered call", calls)
+	}
+}
@@ -0,0 +1,236 @@
+// Package servicekit is the common main() of the net/rpc services: standard
+// flags with env fallbacks, RPC server and mux, registration through
+// internal/discovery, built-in /health, /version and /metrics endpoints and a
+// graceful shutdown that deregisters and drains in-flight calls.
+//
+//	kit := servicekit.New("echo", ":9101")
+//	kit.Parse()
+//	kit.RegisterRPC("Echo", &EchoService{ID: kit.ID()})
+//	kit.Run()
+package servicekit
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"example.com/service-registry-lb/common"
+	"example.com/service-registry-lb/internal/discovery"
+	"example.com/service-registry-lb/internal/rpcctx"
+	"example.com/service-registry-lb/internal/util"
+)
+
+// Version is reported by /version; set it at build time with
+// -ldflags "-X example.com/service-registry-lb/internal/servicekit.Version=1.2.3".
+var Version = "dev"
+
+type Service struct {
+	name string
+
+	listen       *string
+	registryAddr *string
+	instanceID   *string
+	publicAddr   *string
+	weight       *int
+	drain        *time.Duration
+
+	instance common.Instance
+	registry *discovery.Client
+
+	rpc      *rpc.Server
+	mux      *http.ServeMux
+	metrics  *metrics
+	load     *loadSampler
+	started  time.Time
+	draining atomic.Bool
+
+	health  func() error
+	onStart []func(reg *discovery.Client) error
+	onStop  []func(ctx context.Context)
+}
+
+// New defines the standard flags of a service on flag.CommandLine; the caller
+// can add its own flags before Parse.
+func New(name, defaultListen string) *Service {
+	s := &Service{
+		name:         name,
+		listen:       flag.String("listen", defaultListen, "service listen address"),
+		registryAddr: flag.String("registry", "localhost:9000", "registry address host:port"),
+		instanceID:   flag.String("id", "", "instance id (default: env INSTANCE_ID or '"+name+"-<unix>')"),
+		publicAddr:   flag.String("public", "", "public address to register (default: env PUBLIC_ADDR or listen)"),
+		weight:       flag.Int("weight", 1, "instance weight"),
+		drain:        flag.Duration("drain", 0, "max wait for in-flight calls on shutdown (default: env DRAIN or 2s)"),
+		rpc:          rpc.NewServer(),
+		mux:          http.NewServeMux(),
+		metrics:      newMetrics(),
+	}
+	s.load = newLoadSampler(s.metrics)
+	return s
+}
+
+// Parse parses the command line and resolves the instance (flags > env > defaults).
+func (s *Service) Parse() {
+	flag.Parse()
+	if *s.drain == 0 {
+		*s.drain = util.EnvDuration("DRAIN", 2*time.Second)
+	}
+	s.instance = discovery.BuildInstance(s.name, *s.instanceID, *s.publicAddr, *s.listen, *s.weight, nil)
+}
+
+func (s *Service) ID() string                { return s.instance.ID }
+func (s *Service) Instance() common.Instance { return s.instance }
+
+// Connect dials the registry (once); Run calls it if the service did not need
+// the client earlier, e.g. to build its RPC receiver.
+func (s *Service) Connect() *discovery.Client {
+	if s.registry == nil {
+		reg, err := discovery.Dial(*s.registryAddr, discovery.Options{Load: s.load.sample})
+		if err != nil {
+			log.Fatalf("dial registry: %v", err)
+		}
+		s.registry = reg
+	}
+	return s.registry
+}
+
+// SetMeta adds metadata to the registered instance (call before Run).
+func (s *Service) SetMeta(key, value string) {
+	s.instance.Meta[key] = value
+}
+
+// RegisterRPC publishes rcvr's methods as name.Method.
+func (s *Service) RegisterRPC(name string, rcvr any) {
+	if err := s.rpc.RegisterName(name, rcvr); err != nil {
+		log.Fatalf("register %s RPC: %v", name, err)
+	}
+}
+
+// Handle adds an HTTP endpoint next to the built-in ones.
+func (s *Service) Handle(pattern string, h http.Handler) {
+	s.mux.Handle(pattern, h)
+}
+
+// ReportQueue sets the queue length reported with the load (for services that
+// queue requests before serving them; call before Run).
+func (s *Service) ReportQueue(fn func() int) { s.load.queue = fn }
+
+// LongPoll marks methods that block until something changes (e.g. "KV.Watch"):
+// their calls are left out of the reported load and are not awaited by the drain.
+func (s *Service) LongPoll(methods ...string) { s.metrics.setLongPoll(methods...) }
+
+// HealthCheck sets the check behind /health (healthy when it returns nil).
+func (s *Service) HealthCheck(fn func() error) { s.health = fn }
+
+// OnStart runs fn once the instance is registered; an error is fatal.
+func (s *Service) OnStart(fn func(reg *discovery.Client) error) {
+	s.onStart = append(s.onStart, fn)
+}
+
+// OnStop runs fn at shutdown, before the instance is deregistered.
+func (s *Service) OnStop(fn func(ctx context.Context)) {
+	s.onStop = append(s.onStop, fn)
+}
+
+func (s *Service) logf(format string, args ...any) {
+	log.Printf("[%s %s] "+format, append([]any{s.name, s.instance.ID}, args...)...)
+}
+
+// Run serves until SIGINT/SIGTERM, then deregisters, drains and stops.
+func (s *Service) Run() {
+	s.started = time.Now()
+	rpcctx.Handle(s.mux, s.rpc, s.metrics.wrap)
+	s.mux.HandleFunc("/health", s.serveHealth)
+	s.mux.HandleFunc("/version", s.serveVersion)
+	s.mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.metrics.write(w, s.name, s.instance.ID, time.Since(s.started))
+	})
+
+	// ascolto prima di registrarmi: l'indirizzo pubblicato deve già rispondere
+	ln, err := net.Listen("tcp", *s.listen)
+	if err != nil {
+		log.Fatalf("listen %s: %v", *s.listen, err)
+	}
+	httpSrv := &http.Server{Handler: s.mux}
+	go func() {
+		s.logf("listening on %s", *s.listen)
+		if err := httpSrv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Serve: %v", err)
+		}
+	}()
+
+	reg := s.Connect()
+	if err := reg.Register(s.name, s.instance); err != nil {
+		log.Fatalf("register in registry: %v", err)
+	}
+	s.logf("registered at %s with addr=%s weight=%d", *s.registryAddr, s.instance.Addr, s.instance.Weight)
+	for _, fn := range s.onStart {
+		if err := fn(reg); err != nil {
+			log.Fatalf("[%s %s] start: %v", s.name, s.instance.ID, err)
+		}
+	}
+
+	util.WaitForShutdown(func(ctx context.Context) {
+		s.logf("shutting down...")
+		s.draining.Store(true)
+		for _, fn := range s.onStop {
+			fn(ctx)
+		}
+		_ = reg.Close() // deregistra: i client smettono di sceglierci al prossimo refresh
+		if !s.metrics.waitIdle(*s.drain) {
+			s.logf("drain timeout (%s): closing with calls in flight", *s.drain)
+		}
+		_ = httpSrv.Shutdown(ctx)
+	})
+}
+
+func (s *Service) serveHealth(w http.ResponseWriter, _ *http.Request) {
+	status, code := "ok", http.StatusOK
+	switch {
+	case s.draining.Load():
+		status, code = "draining", http.StatusServiceUnavailable
+	case s.health != nil:
+		if err := s.health(); err != nil {
+			status, code = "unhealthy: "+err.Error(), http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, code, map[string]any{
+		"status":  status,
+		"service": s.name,
+		"id":      s.instance.ID,
+		"uptime":  time.Since(s.started).Round(time.Second).String(),
+	})
+}
+
+func (s *Service) serveVersion(w http.ResponseWriter, _ *http.Request) {
+	out := map[string]any{
+		"service": s.name,
+		"version": Version,
+		"go":      runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, st := range bi.Settings {
+			if st.Key == "vcs.revision" || st.Key == "vcs.time" {
+				out[st.Key] = st.Value
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Fprintln(w, err)
+	}
+}
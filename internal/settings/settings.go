@@ -0,0 +1,112 @@
+// Package settings keeps the configuration of a service instance in sync with the
+// registry config store. A setting "name" is read from "<service>/<id>/name"
+// (per-instance override) or else from "<service>/name".
+package settings
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/service-registry-lb/common"
+	"example.com/service-registry-lb/internal/discovery"
+)
+
+type Settings struct {
+	service string
+	id      string
+
+	mu     sync.RWMutex
+	values map[string]string // chiave completa -> valore
+	rev    int64
+}
+
+// New returns empty settings for service/id: every lookup yields its default
+// until Start has loaded the values.
+func New(service, id string) *Settings {
+	return &Settings{service: service, id: id, values: map[string]string{}}
+}
+
+// Start loads the settings and keeps them updated in background through
+// Registry.ConfigWatch. A failed initial load leaves only the defaults.
+func (s *Settings) Start(reg *discovery.Client) {
+	var rep common.ConfigListReply
+	if err := reg.CallRegistry("Registry.ConfigList", &common.ConfigListArgs{Prefix: s.service + "/"}, &rep); err != nil {
+		log.Printf("[%s %s] config: %v", s.service, s.id, err)
+	} else {
+		s.set(rep.Entries, rep.Revision)
+	}
+	go s.loop(reg)
+}
+
+func (s *Settings) loop(reg *discovery.Client) {
+	for {
+		s.mu.RLock()
+		after := s.rev
+		s.mu.RUnlock()
+
+		var rep common.ConfigWatchReply
+		if err := reg.CallRegistry("Registry.ConfigWatch", &common.ConfigWatchArgs{Prefix: s.service + "/", AfterRevision: after}, &rep); err != nil {
+			time.Sleep(time.Second)
+			continue
+		}
+		if rep.Changed {
+			s.set(rep.Entries, rep.Revision)
+			log.Printf("[%s %s] config updated (rev %d, %d entries)", s.service, s.id, rep.Revision, len(rep.Entries))
+		} else {
+			s.mu.Lock()
+			s.rev = max(s.rev, rep.Revision)
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *Settings) set(entries []common.ConfigEntry, rev int64) {
+	values := make(map[string]string, len(entries))
+	for _, e := range entries {
+		values[e.Key] = e.Value
+	}
+	s.mu.Lock()
+	s.values = values
+	s.rev = rev
+	s.mu.Unlock()
+}
+
+// Get returns setting name, preferring the per-instance override.
+func (s *Settings) Get(name string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if v, ok := s.values[s.service+"/"+s.id+"/"+name]; ok {
+		return v, true
+	}
+	v, ok := s.values[s.service+"/"+name]
+	return v, ok
+}
+
+func (s *Settings) String(name, def string) string {
+	if v, ok := s.Get(name); ok {
+		return v
+	}
+	return def
+}
+
+// Int and Duration fall back to def when the value is missing or malformed.
+func (s *Settings) Int(name string, def int) int {
+	if v, ok := s.Get(name); ok {
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+func (s *Settings) Duration(name string, def time.Duration) time.Duration {
+	if v, ok := s.Get(name); ok {
+		if d, err := time.ParseDuration(strings.TrimSpace(v)); err == nil {
+			return d
+		}
+	}
+	return def
+}
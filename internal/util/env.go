@@ -3,6 +3,7 @@ package util
 import (
 	"os"
 	"strconv"
+	"time"
 )
 
 func Env(key, def string) string {
@@ -20,3 +21,12 @@ func EnvInt(key string, def int) int {
 	}
 	return def
 }
+
+func EnvDuration(key string, def time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return def
+}